@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"os"
@@ -16,13 +17,26 @@ import (
 // UserConfig is a format for /etc/booster.yaml config that is interface between user and booster generator
 type UserConfig struct {
 	Network *struct {
-		Interfaces string `yaml:",omitempty"` // comma-separated list of interfaces to initialize at early-userspace
+		Interfaces string `yaml:",omitempty"` // comma-separated list of interfaces (MAC addresses, names or globs like enp*) to initialize at early-userspace
 
 		Dhcp bool `yaml:",omitempty"`
 
 		Ip         string `yaml:",omitempty"`            // e.g. 10.0.2.15/24
 		Gateway    string `yaml:",omitempty"`            // e.g. 10.0.2.255
 		DNSServers string `yaml:"dns_servers,omitempty"` // comma-separated list of ips, e.g. 10.0.1.1,8.8.8.8
+
+		Dhcp6    bool   `yaml:",omitempty"`
+		Slaac    bool   `yaml:",omitempty"`
+		Ip6      string `yaml:",omitempty"` // e.g. 2001:db8::15/64
+		Gateway6 string `yaml:",omitempty"` // e.g. fe80::1
+
+		Vlans   []NetVlan   `yaml:",omitempty"`
+		Bonds   []NetBond   `yaml:",omitempty"`
+		Bridges []NetBridge `yaml:",omitempty"`
+
+		Keep bool `yaml:",omitempty"` // keep the network configured after switching to the root filesystem
+
+		Wireguard *WireguardConfig `yaml:",omitempty"`
 	}
 	Universal            bool   `yaml:",omitempty"`
 	Modules              string `yaml:",omitempty"`                   // comma separated list of extra modules to add to initramfs
@@ -32,6 +46,14 @@ type UserConfig struct {
 	ExtraFiles           string `yaml:"extra_files,omitempty"`        // comma-separated list of files to add to image
 	StripBinaries        bool   `yaml:"strip,omitempty"`              // if strip symbols from the binaries, shared libraries and kernel modules
 	EnableVirtualConsole bool   `yaml:"vconsole,omitempty"`           // configure virtual console at boot time using config from https://www.freedesktop.org/software/systemd/man/vconsole.conf.html
+	ShutdownHelper       bool   `yaml:"shutdown_helper,omitempty"`    // return to initramfs at shutdown to unmount the root filesystem
+	OnFailure            string `yaml:"on_failure,omitempty"`         // what to do if the boot fails: shell, reboot, poweroff or retry
+	Watchdog             string `yaml:"watchdog,omitempty"`           // hardware watchdog timeout, the boot is reset if it hangs longer
+
+	Verity     *VerityConfig `yaml:",omitempty"`            // dm-verity root hashes of the root and /usr filesystems
+	MeasurePCR int           `yaml:"measure_pcr,omitempty"` // TPM PCR to measure the boot inputs into
+
+	TokenRetry map[string]*TokenRetryConfig `yaml:"token_retry,omitempty"` // retries of LUKS clevis tokens per pin
 }
 
 // read user config from the specified file. If file parameter is empty string then "empty" configuration is considered
@@ -53,6 +75,77 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 			if net.Dhcp && (net.Ip != "" || net.Gateway != "") {
 				return nil, fmt.Errorf("config: option network.(ip|gateway) cannot be used together with network.dhcp")
 			}
+			if (net.Dhcp6 || net.Slaac) && (net.Ip6 != "" || net.Gateway6 != "") {
+				return nil, fmt.Errorf("config: option network.(ip6|gateway6) cannot be used together with network.(dhcp6|slaac)")
+			}
+			if net.Dhcp6 && net.Slaac {
+				return nil, fmt.Errorf("config: option network.dhcp6 cannot be used together with network.slaac, slaac mode runs DHCPv6 if the router requests it")
+			}
+			for _, v := range net.Vlans {
+				if v.Name == "" || v.Parent == "" {
+					return nil, fmt.Errorf("config: network.vlans entries require name and parent")
+				}
+				if v.Id < 1 || v.Id > 4094 {
+					return nil, fmt.Errorf("config: vlan %s has invalid id %d", v.Name, v.Id)
+				}
+			}
+			for _, b := range net.Bonds {
+				if b.Name == "" || len(b.Members) == 0 {
+					return nil, fmt.Errorf("config: network.bonds entries require name and members")
+				}
+			}
+			for _, b := range net.Bridges {
+				if b.Name == "" || len(b.Members) == 0 {
+					return nil, fmt.Errorf("config: network.bridges entries require name and members")
+				}
+			}
+			if wg := net.Wireguard; wg != nil {
+				if wg.PrivateKeyFile == "" {
+					return nil, fmt.Errorf("config: network.wireguard.private_key_file is required")
+				}
+				for _, p := range wg.Peers {
+					if key, err := base64.StdEncoding.DecodeString(p.PublicKey); err != nil || len(key) != 32 {
+						return nil, fmt.Errorf("config: network.wireguard peer has invalid public key %s", p.PublicKey)
+					}
+				}
+			}
+		}
+	}
+
+	if v := u.Verity; v != nil {
+		switch v.OnCorruption {
+		case "", "restart", "panic", "ignore":
+		default:
+			return nil, fmt.Errorf("config: invalid verity.on_corruption value %s, expected restart, panic or ignore", v.OnCorruption)
+		}
+	}
+
+	if u.MeasurePCR < 0 || u.MeasurePCR > 23 {
+		return nil, fmt.Errorf("config: invalid measure_pcr value %d, expected a PCR index between 1 and 23", u.MeasurePCR)
+	}
+
+	switch u.OnFailure {
+	case "", "shell", "reboot", "poweroff", "retry":
+	default:
+		return nil, fmt.Errorf("config: invalid on_failure value %s, expected shell, reboot, poweroff or retry", u.OnFailure)
+	}
+
+	for pin, r := range u.TokenRetry {
+		switch pin {
+		case "tang", "tpm2", "sss":
+		default:
+			return nil, fmt.Errorf("config: invalid token_retry type %s, expected tang, tpm2 or sss", pin)
+		}
+		if r == nil {
+			continue
+		}
+		if r.Retries < 0 {
+			return nil, fmt.Errorf("config: invalid token_retry.%s.retries value %d", pin, r.Retries)
+		}
+		if r.Backoff != "" {
+			if _, err := time.ParseDuration(r.Backoff); err != nil {
+				return nil, fmt.Errorf("config: invalid token_retry.%s.backoff value: %v", pin, err)
+			}
 		}
 	}
 
@@ -69,23 +162,34 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 			}
 		}
 
+		if n.Dhcp6 {
+			conf.network6ConfigType = netDhcp
+		} else if n.Slaac {
+			conf.network6ConfigType = netSlaac
+		} else if n.Ip6 != "" {
+			conf.network6ConfigType = netStatic
+			conf.network6StaticConfig = &networkStaticConfig{
+				n.Ip6, n.Gateway6, n.DNSServers,
+			}
+		}
+
+		conf.networkVlans = n.Vlans
+		conf.networkBonds = n.Bonds
+		conf.networkBridges = n.Bridges
+		conf.networkKeep = n.Keep
+		conf.networkWireguard = n.Wireguard
+
 		if u.Network.Interfaces != "" {
-			// get MAC addresses for the specified interface names
+			// interfaces are matched at boot time, either by MAC address or by name (kernel or predictable one)
 			for _, i := range strings.Split(u.Network.Interfaces, ",") {
-				// user can either provide the mac addr itself
 				if hwAddr, err := net.ParseMAC(i); err == nil {
-					conf.networkActiveInterfaces = append(conf.networkActiveInterfaces, hwAddr)
+					conf.networkActiveInterfaces = append(conf.networkActiveInterfaces, hwAddr.String())
 					continue
 				}
-
-				// or a network interface
-				ifc, err := net.InterfaceByName(i)
-				if err != nil {
+				if _, err := path.Match(i, ""); err != nil {
 					return nil, fmt.Errorf("invalid network interface: %s", i)
 				}
-				// TODO: or maybe instead of resolving it to MAC address here we should compute predictable interface names
-				// in init? See the algorithm https://github.com/systemd/systemd/blob/main/src/udev/udev-builtin-net_id.c
-				conf.networkActiveInterfaces = append(conf.networkActiveInterfaces, ifc.HardwareAddr)
+				conf.networkActiveInterfaces = append(conf.networkActiveInterfaces, i)
 			}
 		}
 	}
@@ -131,9 +235,24 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 	conf.debug = *debugEnabled
 	conf.readDeviceAliases = readDeviceAliases
 	conf.readHostModules = readHostModules
-	conf.readModprobeOptions = readModprobeOptions
+	conf.readModprobeConfig = readModprobeConfig
 	conf.stripBinaries = u.StripBinaries || *strip
 	conf.enableVirtualConsole = u.EnableVirtualConsole
+	conf.shutdownHelper = u.ShutdownHelper
+	conf.verity = u.Verity
+	conf.measurePCR = u.MeasurePCR
+	conf.tokenRetry = u.TokenRetry
+	conf.onFailure = u.OnFailure
+	if u.Watchdog != "" {
+		timeout, err := time.ParseDuration(u.Watchdog)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid watchdog value: %v", err)
+		}
+		if timeout < time.Second {
+			return nil, fmt.Errorf("config: watchdog timeout %v is too short, expected at least 1s", timeout)
+		}
+		conf.watchdog = timeout
+	}
 	if conf.enableVirtualConsole {
 		conf.vconsolePath = "/etc/vconsole.conf"
 		conf.localePath = "/etc/locale.conf"
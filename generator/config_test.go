@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 func TestReadEmptyConfig(t *testing.T) {
 	t.Parallel()
@@ -13,3 +18,51 @@ func TestReadEmptyConfig(t *testing.T) {
 		t.Fatalf("expected default compression zstd, got %s", c.compression)
 	}
 }
+
+func TestReadConfigOnFailure(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "booster.yaml")
+	if err := os.WriteFile(file, []byte("on_failure: reboot\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := readGeneratorConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.onFailure != "reboot" {
+		t.Fatalf("expected on_failure reboot, got %s", c.onFailure)
+	}
+
+	if err := os.WriteFile(file, []byte("on_failure: halt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readGeneratorConfig(file); err == nil {
+		t.Fatal("expected an error for invalid on_failure value")
+	}
+}
+
+func TestReadConfigWatchdog(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "booster.yaml")
+	if err := os.WriteFile(file, []byte("watchdog: 2m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := readGeneratorConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.watchdog != 2*time.Minute {
+		t.Fatalf("expected watchdog timeout 2m, got %v", c.watchdog)
+	}
+
+	for _, v := range []string{"100ms", "60"} {
+		if err := os.WriteFile(file, []byte("watchdog: "+v+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readGeneratorConfig(file); err == nil {
+			t.Fatalf("expected an error for watchdog value %s", v)
+		}
+	}
+}
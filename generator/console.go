@@ -32,6 +32,7 @@ func (img *Image) enableVirtualConsole(vConsolePath, localePath string) (*Virtua
 		lang := lprop["LANG"]
 		debug("detected language - '%s'", lang)
 		conf.Utf = strings.HasSuffix(strings.ToLower(lang), "utf-8")
+		conf.Keymap = keymap
 		conf.KeymapFile = "/console/keymap"
 
 		blob, err := loadKeymap(keymap, vprop["KEYMAP_TOGGLE"], conf.Utf)
@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"net"
 	"os"
 	"strings"
 	"time"
@@ -16,7 +15,14 @@ import (
 type generatorConfig struct {
 	networkConfigType       netConfigType
 	networkStaticConfig     *networkStaticConfig
-	networkActiveInterfaces []net.HardwareAddr
+	network6ConfigType      netConfigType
+	network6StaticConfig    *networkStaticConfig
+	networkActiveInterfaces []string
+	networkVlans            []NetVlan
+	networkBonds            []NetBond
+	networkBridges          []NetBridge
+	networkKeep             bool
+	networkWireguard        *WireguardConfig
 	universal               bool
 	modules                 []string // extra modules to add
 	modulesForceLoad        []string // extra modules to load at the boot time
@@ -31,8 +37,14 @@ type generatorConfig struct {
 	debug                   bool
 	readDeviceAliases       func() (set, error)
 	readHostModules         func() (set, error)
-	readModprobeOptions     func() (map[string]string, error)
+	readModprobeConfig      func() (map[string]string, set, error)
 	stripBinaries           bool
+	shutdownHelper          bool // init installs itself to /run/initramfs as systemd shutdown helper
+	verity                  *VerityConfig
+	measurePCR              int // TPM PCR that init extends with the boot inputs
+	tokenRetry              map[string]*TokenRetryConfig
+	onFailure               string // boot failure policy
+	watchdog                time.Duration
 
 	// virtual console configs
 	enableVirtualConsole     bool
@@ -51,6 +63,7 @@ const (
 	netOff netConfigType = iota
 	netDhcp
 	netStatic
+	netSlaac // IPv6 stateless autoconfiguration
 )
 
 const (
@@ -76,6 +89,7 @@ var defaultModulesList = []string{
 	"kernel/drivers/hid/usbhid/",
 	"hid_generic", "sd_mod", "ahci",
 	"virtio_pci", "virtio_blk", "virtio_scsi", "virtio_crypto",
+	"i6300esb", "iTCO_wdt", // hardware watchdogs
 }
 
 func generateInitRamfs(conf *generatorConfig) error {
@@ -102,6 +116,12 @@ func generateInitRamfs(conf *generatorConfig) error {
 		return err
 	}
 
+	if conf.networkWireguard != nil {
+		if err := img.appendWireguardKey(conf.networkWireguard.PrivateKeyFile); err != nil {
+			return err
+		}
+	}
+
 	var vconsole *VirtualConsole
 	if conf.enableVirtualConsole {
 		vconsole, err = img.enableVirtualConsole(conf.vconsolePath, conf.localePath)
@@ -112,7 +132,7 @@ func generateInitRamfs(conf *generatorConfig) error {
 
 	kmod.filterModprobeForRequiredModules()
 
-	if err := img.appendInitConfig(conf, kmod.dependencies, kmod.postDependencies, vconsole, kmod.modprobeOptions); err != nil {
+	if err := img.appendInitConfig(conf, kmod.dependencies, kmod.postDependencies, vconsole, kmod.modprobeOptions, kmod.modprobeBlacklist); err != nil {
 		return err
 	}
 
@@ -132,6 +152,15 @@ func (img *Image) appendInitBinary(initBinary string) error {
 	return img.AppendContent(content, 0755, "/init")
 }
 
+// appendWireguardKey adds the tunnel private key to the image, the key is readable by root only
+func (img *Image) appendWireguardKey(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("wireguard private key: %v", err)
+	}
+	return img.AppendContent(content, 0600, wireguardKeyPath)
+}
+
 func (img *Image) appendExtraFiles(binaries []string) error {
 	for _, f := range binaries {
 		if !strings.HasPrefix(f, "/") {
@@ -160,7 +189,7 @@ func (img *Image) appendFirmwareFiles(modName string, fws []string) error {
 	return nil
 }
 
-func (img *Image) appendInitConfig(conf *generatorConfig, kmodDeps map[string][]string, kmodPostDeps map[string][]string, vconsole *VirtualConsole, modprobeOptions map[string]string) error {
+func (img *Image) appendInitConfig(conf *generatorConfig, kmodDeps map[string][]string, kmodPostDeps map[string][]string, vconsole *VirtualConsole, modprobeOptions map[string]string, modprobeBlacklist set) error {
 	var initConfig InitConfig // config for init stored to /etc/booster.init.yaml
 
 	initConfig.MountTimeout = int(conf.timeout.Seconds())
@@ -169,7 +198,14 @@ func (img *Image) appendInitConfig(conf *generatorConfig, kmodDeps map[string][]
 	initConfig.ModulePostDependencies = kmodPostDeps
 	initConfig.ModulesForceLoad = conf.modulesForceLoad
 	initConfig.ModprobeOptions = modprobeOptions
+	initConfig.ModprobeBlacklist = modprobeBlacklist.sortedKeys()
 	initConfig.VirtualConsole = vconsole
+	initConfig.ShutdownHelper = conf.shutdownHelper
+	initConfig.Verity = conf.verity
+	initConfig.MeasurePCR = conf.measurePCR
+	initConfig.TokenRetry = conf.tokenRetry
+	initConfig.OnFailure = conf.onFailure
+	initConfig.Watchdog = int(conf.watchdog.Seconds())
 
 	if conf.networkConfigType == netDhcp {
 		initConfig.Network = &InitNetworkConfig{}
@@ -180,9 +216,33 @@ func (img *Image) appendInitConfig(conf *generatorConfig, kmodDeps map[string][]
 		initConfig.Network.Gateway = conf.networkStaticConfig.gateway
 		initConfig.Network.DNSServers = conf.networkStaticConfig.dnsServers
 	}
+	if conf.network6ConfigType != netOff && initConfig.Network == nil {
+		initConfig.Network = &InitNetworkConfig{}
+	}
+	switch conf.network6ConfigType {
+	case netDhcp:
+		initConfig.Network.Dhcp6 = true
+	case netSlaac:
+		initConfig.Network.Slaac = true
+	case netStatic:
+		initConfig.Network.Ip6 = conf.network6StaticConfig.ip
+		initConfig.Network.Gateway6 = conf.network6StaticConfig.gateway
+		initConfig.Network.DNSServers = conf.network6StaticConfig.dnsServers
+	}
 	if conf.networkActiveInterfaces != nil {
 		initConfig.Network.Interfaces = conf.networkActiveInterfaces
 	}
+	if initConfig.Network != nil {
+		initConfig.Network.Vlans = conf.networkVlans
+		initConfig.Network.Bonds = conf.networkBonds
+		initConfig.Network.Bridges = conf.networkBridges
+		initConfig.Network.Keep = conf.networkKeep
+		if conf.networkWireguard != nil {
+			wg := *conf.networkWireguard
+			wg.PrivateKeyFile = wireguardKeyPath // path of the key inside the image
+			initConfig.Network.Wireguard = &wg
+		}
+	}
 
 	content, err := yaml.Marshal(initConfig)
 	if err != nil {
@@ -210,6 +270,25 @@ func (img *Image) appendModules(conf *generatorConfig) (*Kmod, error) {
 		return nil, err
 	}
 
+	if conf.networkConfigType != netOff || conf.network6ConfigType != netOff {
+		// virtual links can be declared in the config or with vlan=, bond=, bridge= boot params
+		if err := kmod.activateModules(false, false, "8021q", "bonding", "bridge"); err != nil {
+			return nil, err
+		}
+	}
+	if conf.networkWireguard != nil {
+		if err := kmod.activateModules(false, true, "wireguard"); err != nil {
+			return nil, err
+		}
+	}
+
+	// dm-verity is enabled either in the config or with roothash= boot param, in the latter case the host already uses it
+	if conf.verity != nil || kmod.hostModules["dm_verity"] {
+		if err := kmod.activateModules(false, false, "dm_verity"); err != nil {
+			return nil, err
+		}
+	}
+
 	// cbc module is a hard requirement for "encrypted_keys"
 	// https://github.com/torvalds/linux/blob/master/security/keys/encrypted-keys/encrypted.c#L42
 	kmod.addExtraDep("encrypted_keys", "cbc")
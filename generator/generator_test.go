@@ -65,6 +65,7 @@ type options struct {
 	builtin                      []string
 	extraFiles                   []string
 	modprobeOptions              map[string]string
+	modprobeBlacklist            set
 	expectError                  string
 	stripBinaries                bool
 	enableVirtualConsole         bool
@@ -187,7 +188,7 @@ func createTestInitRamfs(t *testing.T, opts *options) {
 		output:               wd + "/booster.img",
 		readDeviceAliases:    listAsFunc(opts.hostAliases),
 		readHostModules:      listAsFunc(opts.hostModules),
-		readModprobeOptions:  func() (map[string]string, error) { return opts.modprobeOptions, nil },
+		readModprobeConfig:   func() (map[string]string, set, error) { return opts.modprobeOptions, opts.modprobeBlacklist, nil },
 		extraFiles:           opts.extraFiles,
 		modules:              opts.extraModules,
 		stripBinaries:        opts.stripBinaries,
@@ -597,6 +598,35 @@ func testModprobeOptions(t *testing.T) {
 	}
 }
 
+func testModprobeBlacklist(t *testing.T) {
+	opts := options{
+		prepareModulesAt:  []string{"test1.ko", "test2.ko", "test3.ko"},
+		modprobeBlacklist: set{"test1": true, "test3": true, "test4": true},
+		unpackImage:       true,
+		hostModules:       []string{"test1", "test2", "test3"},
+	}
+	createTestInitRamfs(t, &opts)
+
+	c, err := os.ReadFile(opts.workDir + "/image.unpacked/etc/booster.init.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := struct {
+		ModprobeBlacklist []string `yaml:",omitempty"`
+	}{}
+
+	if err := yaml.Unmarshal(c, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// test4 is not in the image
+	expect := []string{"test1", "test3"}
+	if !reflect.DeepEqual(expect, cfg.ModprobeBlacklist) {
+		t.Fatalf("incorrect modprobe blacklist saved, expected %v, got %v", expect, cfg.ModprobeBlacklist)
+	}
+}
+
 func TestGenerator(t *testing.T) {
 	*debugEnabled = testing.Verbose()
 
@@ -619,4 +649,5 @@ func TestGenerator(t *testing.T) {
 	t.Run("StripBinaries", testStripBinaries)
 	t.Run("EnableVirtualConsole", testEnableVirtualConsole)
 	t.Run("ModprobeOptions", testModprobeOptions)
+	t.Run("ModprobeBlacklist", testModprobeBlacklist)
 }
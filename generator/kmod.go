@@ -35,6 +35,7 @@ type Kmod struct {
 	dependencies      map[string][]string // dependency list for modules
 	postDependencies  map[string][]string // post dependency list for modules
 	modprobeOptions   map[string]string   // module options parsed from modprobe.d
+	modprobeBlacklist set                 // modules blacklisted in modprobe.d
 	aliases           []alias
 	extraDep          map[string][]string // extra dependencies added by the generator
 	loadModules       []string            // force modules to load in init
@@ -74,7 +75,7 @@ func NewKmod(conf *generatorConfig) (*Kmod, error) {
 		return nil, err
 	}
 
-	kmod.modprobeOptions, err = conf.readModprobeOptions()
+	kmod.modprobeOptions, kmod.modprobeBlacklist, err = conf.readModprobeConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -710,8 +711,8 @@ func readModuleFirmwareRequirements(ef *elf.File) ([]string, error) {
 }
 
 // parseModprobeFunction parses the content of modprobe.d file and appends found module options to the input map
-// the map represents modname->[]options
-func parseModprobe(content string, options map[string][]string) error {
+// the map represents modname->[]options. Modules from 'blacklist' lines are added to the blacklist set.
+func parseModprobe(content string, options map[string][]string, blacklist set) error {
 	s := bufio.NewScanner(strings.NewReader(content))
 	var (
 		multiLine bool         // if true means that we are processing multiline directive
@@ -742,6 +743,20 @@ func parseModprobe(content string, options map[string][]string) error {
 			b.Reset()
 		}
 
+		const blacklistPrefix = "blacklist "
+		if strings.HasPrefix(line, blacklistPrefix) {
+			fields := strings.Fields(line[len(blacklistPrefix):])
+			if len(fields) == 0 {
+				return fmt.Errorf("blacklist line format needs to have 'blacklist modname'")
+			}
+			if len(fields) > 1 {
+				// kmod ignores trailing tokens as well
+				warning("modprobe.d: ignoring extra tokens at line '%s'", line)
+			}
+			blacklist[normalizeModuleName(fields[0])] = true
+			continue
+		}
+
 		const prefix = "options "
 		if !strings.HasPrefix(line, prefix) {
 			continue
@@ -762,7 +777,8 @@ func parseModprobe(content string, options map[string][]string) error {
 	return nil
 }
 
-func readModprobeOptions() (map[string]string, error) {
+// readModprobeConfig reads module options and the module blacklist from modprobe.d directories
+func readModprobeConfig() (map[string]string, set, error) {
 	dirs := []string{
 		"/lib/modprobe.d/",
 		"/etc/modprobe.d/",
@@ -770,22 +786,23 @@ func readModprobeOptions() (map[string]string, error) {
 	}
 
 	options := make(map[string][]string)
+	blacklist := make(set)
 	for _, d := range dirs {
 		dir, err := os.ReadDir(d)
 		if os.IsNotExist(err) {
 			continue
 		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		for _, e := range dir {
 			content, err := os.ReadFile(path.Join(d, e.Name()))
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			if err := parseModprobe(string(content), options); err != nil {
-				return nil, err
+			if err := parseModprobe(string(content), options, blacklist); err != nil {
+				return nil, nil, err
 			}
 		}
 	}
@@ -795,7 +812,7 @@ func readModprobeOptions() (map[string]string, error) {
 		result[m] = strings.Join(o, " ")
 	}
 
-	return result, nil
+	return result, blacklist, nil
 }
 
 func (k *Kmod) filterModprobeForRequiredModules() {
@@ -804,4 +821,9 @@ func (k *Kmod) filterModprobeForRequiredModules() {
 			delete(k.modprobeOptions, m)
 		}
 	}
+	for m := range k.modprobeBlacklist {
+		if _, ok := k.requiredModules[m]; !ok {
+			delete(k.modprobeBlacklist, m)
+		}
+	}
 }
@@ -25,12 +25,12 @@ func TestModuleNames(t *testing.T) {
 	}
 
 	conf := &generatorConfig{
-		universal:           true,
-		kernelVersion:       ver,
-		modulesDir:          "/usr/lib/modules/" + ver,
-		readHostModules:     readHostModules,
-		readDeviceAliases:   readDeviceAliases,
-		readModprobeOptions: readModprobeOptions,
+		universal:          true,
+		kernelVersion:      ver,
+		modulesDir:         "/usr/lib/modules/" + ver,
+		readHostModules:    readHostModules,
+		readDeviceAliases:  readDeviceAliases,
+		readModprobeConfig: readModprobeConfig,
 	}
 	kmod, err := NewKmod(conf)
 	if err != nil {
@@ -171,7 +171,7 @@ func TestReadBuiltinModinfo(t *testing.T) {
 func TestParseModprobe(t *testing.T) {
 	check := func(content string, expected map[string][]string) {
 		got := make(map[string][]string)
-		if err := parseModprobe(content, got); err != nil {
+		if err := parseModprobe(content, got, make(set)); err != nil {
 			t.Fatal(err)
 		}
 
@@ -196,12 +196,39 @@ func TestParseModprobe(t *testing.T) {
 		})
 }
 
-func TestReadModprobeOptions(t *testing.T) {
-	opts, err := readModprobeOptions()
+func TestParseModprobeBlacklist(t *testing.T) {
+	options := make(map[string][]string)
+	blacklist := make(set)
+	content := "# watchdog drivers\nblacklist iTCO_wdt\nblacklist  snd-pcsp \noptions btusb reset=1\nblacklist \\\n pcspkr\n"
+	if err := parseModprobe(content, options, blacklist); err != nil {
+		t.Fatal(err)
+	}
+	expected := set{"iTCO_wdt": true, "snd_pcsp": true, "pcspkr": true}
+	if !reflect.DeepEqual(expected, blacklist) {
+		t.Fatalf("invalid blacklist: expected %v, got %v", expected, blacklist)
+	}
+	if !reflect.DeepEqual(map[string][]string{"btusb": {"reset=1"}}, options) {
+		t.Fatalf("invalid options: %v", options)
+	}
+
+	// trailing tokens are ignored the same way kmod does
+	if err := parseModprobe("blacklist foo bar\n", options, blacklist); err != nil {
+		t.Fatal(err)
+	}
+	if !blacklist["foo"] || blacklist["bar"] {
+		t.Fatalf("invalid blacklist: %v", blacklist)
+	}
+}
+
+func TestReadModprobeConfig(t *testing.T) {
+	opts, blacklist, err := readModprobeConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
 	if opts == nil {
 		t.Fatal("expect non-nil options map")
 	}
+	if blacklist == nil {
+		t.Fatal("expect non-nil blacklist set")
+	}
 }
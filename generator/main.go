@@ -7,6 +7,7 @@ import (
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 )
 
 var (
@@ -25,6 +26,16 @@ var (
 
 type set map[string]bool
 
+// sortedKeys returns elements of the set in a stable order
+func (s set) sortedKeys() []string {
+	var keys []string
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func debug(format string, v ...interface{}) {
 	if *debugEnabled {
 		fmt.Printf(format+"\n", v...)
@@ -27,7 +27,7 @@ func readBlkInfo(path string) (*blkInfo, error) {
 	defer r.Close()
 
 	type probeFn func(r io.ReaderAt) *blkInfo
-	probes := []probeFn{probeGpt, probeMbr, probeLuks, probeExt4, probeBtrfs, probeXfs, probeF2fs}
+	probes := []probeFn{probeGpt, probeMbr, probeLuks, probeVerity, probeExt4, probeBtrfs, probeXfs, probeF2fs}
 	for _, fn := range probes {
 		info := fn(r)
 		if info != nil {
@@ -58,12 +58,16 @@ func probeGpt(r io.ReaderAt) *blkInfo {
 	if _, err := r.ReadAt(d, tableHeaderOffset+guidOffset); err != nil {
 		return nil
 	}
-	uuid := []byte{d[3], d[2], d[1], d[0],
+	return &blkInfo{"gpt", false, gptGUID(d), ""}
+}
+
+// gptGUID converts mixed-endian GUID as it is stored at GPT to UUID
+func gptGUID(d []byte) UUID {
+	return []byte{d[3], d[2], d[1], d[0],
 		d[5], d[4],
 		d[7], d[6],
 		d[8], d[9],
 		d[10], d[11], d[12], d[13], d[14], d[15]}
-	return &blkInfo{"gpt", false, uuid, ""}
 }
 
 func probeMbr(r io.ReaderAt) *blkInfo {
@@ -142,6 +146,24 @@ func probeLuks(r io.ReaderAt) *blkInfo {
 	return &blkInfo{"luks", false, uuid, label}
 }
 
+func probeVerity(r io.ReaderAt) *blkInfo {
+	// https://gitlab.com/cryptsetup/cryptsetup/-/wikis/DMVerity
+	const uuidOffset = 0x10
+
+	magic := make([]byte, len(veritySignature))
+	if _, err := r.ReadAt(magic, 0x0); err != nil {
+		return nil
+	}
+	if string(magic) != veritySignature {
+		return nil
+	}
+	uuid := make([]byte, 16)
+	if _, err := r.ReadAt(uuid, uuidOffset); err != nil {
+		return nil
+	}
+	return &blkInfo{"verity", false, uuid, ""}
+}
+
 func probeExt4(r io.ReaderAt) *blkInfo {
 	const (
 		// from fs/ext4/ext4.h
@@ -266,3 +288,115 @@ func probeF2fs(r io.ReaderAt) *blkInfo {
 	label := string(utf16.Decode(runes))
 	return &blkInfo{"f2fs", true, uuid, label}
 }
+
+type partEntry struct {
+	scheme string // gpt or dos
+	number int
+	uuid   string
+	typ    string
+	name   string
+}
+
+// readPartitionEntry reads information about partition 'number' (starting from 1) from the disk partition table.
+// size is the disk size in bytes. Returns nil if the disk has no known partition table or the entry does not exist.
+func readPartitionEntry(r io.ReaderAt, size int64, number int) *partEntry {
+	if number < 1 {
+		return nil
+	}
+	if probeGpt(r) != nil {
+		return readGptEntry(r, size, number)
+	}
+	if table := probeMbr(r); table != nil {
+		return readMbrEntry(r, table.uuid, number)
+	}
+	return nil
+}
+
+func readGptEntry(r io.ReaderAt, size int64, number int) *partEntry {
+	const (
+		// https://wiki.osdev.org/GPT, the same 512 bytes sector size is assumed as in probeGpt
+		sectorSize         = 0x200
+		tableHeaderOffset  = 0x200
+		entriesLbaOffset   = 0x48
+		entriesNumOffset   = 0x50
+		entrySizeOffset    = 0x54
+		entryTypeOffset    = 0x0
+		entryUUIDOffset    = 0x10
+		entryNameOffset    = 0x38
+		entryNameMaxLength = 72
+		entryMaxSize       = 4096
+	)
+
+	hdr := make([]byte, 16)
+	if _, err := r.ReadAt(hdr, tableHeaderOffset+entriesLbaOffset); err != nil {
+		return nil
+	}
+	entriesLba := binary.LittleEndian.Uint64(hdr[0:8])
+	entriesNum := binary.LittleEndian.Uint32(hdr[8:12])
+	entrySize := binary.LittleEndian.Uint32(hdr[12:16])
+	if uint32(number) > entriesNum {
+		return nil
+	}
+	// the header comes from the disk, do not trust it before allocating memory
+	if entrySize < 128 || entrySize > entryMaxSize || entrySize%8 != 0 {
+		return nil
+	}
+	if size <= 0 || entriesLba > uint64(size)/sectorSize || uint64(entriesNum)*uint64(entrySize) > uint64(size)-entriesLba*sectorSize {
+		return nil
+	}
+
+	entry := make([]byte, entrySize)
+	if _, err := r.ReadAt(entry, int64(entriesLba*sectorSize)+int64(number-1)*int64(entrySize)); err != nil {
+		return nil
+	}
+	typ := gptGUID(entry[entryTypeOffset : entryTypeOffset+16])
+	if bytes.Equal(typ, make([]byte, 16)) {
+		return nil // unused entry
+	}
+
+	runes := make([]uint16, entryNameMaxLength/2)
+	if err := binary.Read(bytes.NewReader(entry[entryNameOffset:]), binary.LittleEndian, &runes); err != nil {
+		return nil
+	}
+	for i, r := range runes {
+		if r == 0 {
+			runes = runes[:i]
+			break
+		}
+	}
+
+	return &partEntry{
+		scheme: "gpt",
+		number: number,
+		uuid:   gptGUID(entry[entryUUIDOffset : entryUUIDOffset+16]).toString(),
+		typ:    typ.toString(),
+		name:   string(utf16.Decode(runes)),
+	}
+}
+
+func readMbrEntry(r io.ReaderAt, diskID UUID, number int) *partEntry {
+	const (
+		partitionTableOffset = 0x1be
+		entrySize            = 0x10
+		entryTypeOffset      = 0x4
+	)
+
+	// partition UUID is constructed from the disk id the same way as kernel does it for PARTUUID= root param
+	entry := &partEntry{
+		scheme: "dos",
+		number: number,
+		uuid:   fmt.Sprintf("%s-%02x", diskID.toString(), number),
+	}
+	if number <= 4 {
+		// type of logical partitions requires walking the extended partition chain, it is not needed by anyone yet
+		typ := make([]byte, 1)
+		if _, err := r.ReadAt(typ, int64(partitionTableOffset+(number-1)*entrySize+entryTypeOffset)); err != nil {
+			return nil
+		}
+		if typ[0] == 0 {
+			return nil
+		}
+		entry.typ = fmt.Sprintf("0x%x", typ[0])
+	}
+	return entry
+}
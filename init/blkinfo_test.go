@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"os"
 	"os/exec"
+	"reflect"
 	"strings"
 	"testing"
+	"unicode/utf16"
 )
 
 func check(t *testing.T, name, fstype, uuidStr, label string, size int64, script string) {
@@ -87,3 +90,79 @@ func TestBlkInfo(t *testing.T) {
 	check(t, "gpt", "gpt", "c26fcabe-8010-4bff-a066-8c73e76dbb32", "", 1, "fdisk $OUTPUT <<< 'g\nx\ni\n$UUID\nr\nw\n'")
 	check(t, "mbr", "mbr", "2beab180", "", 1, "fdisk $OUTPUT <<< 'o\nx\ni\n0x$UUID\nr\nw\n'")
 }
+
+// gptImage creates a disk image with GPT that has a single partition
+func gptImage(t *testing.T, partType, partUUID, name string) []byte {
+	t.Helper()
+	img := make([]byte, 64*1024)
+	copy(img[0x1fe:], "\x55\xaa")
+	copy(img[0x200:], "EFI PART")
+	binary.LittleEndian.PutUint64(img[0x248:], 2)   // entries start at LBA 2
+	binary.LittleEndian.PutUint32(img[0x250:], 128) // number of entries
+	binary.LittleEndian.PutUint32(img[0x254:], 128) // entry size
+
+	for i, s := range []string{partType, partUUID} {
+		u, err := parseUUID(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(img[0x400+i*16:], gptGUID(u)) // the conversion is symmetric
+	}
+	for i, r := range utf16.Encode([]rune(name)) {
+		binary.LittleEndian.PutUint16(img[0x400+0x38+2*i:], r)
+	}
+	return img
+}
+
+func TestReadPartitionEntry(t *testing.T) {
+	const (
+		linuxFsType = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+		partUUID    = "a3bf4e2c-58f4-4d1b-9a8c-7b95e4a1c0d2"
+	)
+	r := bytes.NewReader(gptImage(t, linuxFsType, partUUID, "rootfs"))
+
+	entry := readPartitionEntry(r, r.Size(), 1)
+	expected := &partEntry{scheme: "gpt", number: 1, uuid: partUUID, typ: linuxFsType, name: "rootfs"}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Fatalf("readPartitionEntry() = %+v, expected %+v", entry, expected)
+	}
+	for _, n := range []int{0, 2, 129} {
+		if entry := readPartitionEntry(r, r.Size(), n); entry != nil {
+			t.Fatalf("partition %d is not expected to exist, got %+v", n, entry)
+		}
+	}
+
+	// corrupted GPT headers
+	for _, c := range []struct{ offset, value int }{
+		{0x254, 0xffffffff}, // huge entry size
+		{0x254, 100},        // entry size less than the minimum
+		{0x254, 130},        // entry size is not a multiple of 8
+		{0x250, 0x7fffffff}, // the entries do not fit the disk
+		{0x248, 0x7fffffff}, // the entries start beyond the disk
+	} {
+		img := gptImage(t, linuxFsType, partUUID, "rootfs")
+		if c.offset == 0x248 {
+			binary.LittleEndian.PutUint64(img[c.offset:], uint64(c.value))
+		} else {
+			binary.LittleEndian.PutUint32(img[c.offset:], uint32(c.value))
+		}
+		if entry := readPartitionEntry(bytes.NewReader(img), int64(len(img)), 1); entry != nil {
+			t.Fatalf("header field 0x%x=0x%x: expected no entry, got %+v", c.offset, c.value, entry)
+		}
+	}
+
+	mbr := make([]byte, 1024)
+	copy(mbr[0x1b8:], []byte{0x80, 0xb1, 0xea, 0x2b})
+	copy(mbr[0x1fe:], "\x55\xaa")
+	mbr[0x1be+0x10+4] = 0x83 // second partition is a Linux filesystem
+	r = bytes.NewReader(mbr)
+
+	entry = readPartitionEntry(r, r.Size(), 2)
+	expected = &partEntry{scheme: "dos", number: 2, uuid: "2beab180-02", typ: "0x83"}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Fatalf("readPartitionEntry() = %+v, expected %+v", entry, expected)
+	}
+	if entry := readPartitionEntry(r, r.Size(), 1); entry != nil {
+		t.Fatalf("unused partition entry is returned: %+v", entry)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coldplug handles devices that appeared before init started listening to uevents. Sysfs walking, modalias matching
+// and block device probing are done by a bounded pool of workers. Storage and input devices are handled first
+// as they are needed to find the root filesystem and to enter a password.
+
+const (
+	coldplugMinWorkers = 4
+	coldplugMaxWorkers = 32
+)
+
+var concurrentColdplug = true
+
+func coldplugWorkers() int {
+	if !concurrentColdplug {
+		return 1
+	}
+	n := 2 * runtime.NumCPU()
+	if n < coldplugMinWorkers {
+		n = coldplugMinWorkers
+	}
+	if n > coldplugMaxWorkers {
+		n = coldplugMaxWorkers
+	}
+	return n
+}
+
+const (
+	priorityStorage = iota
+	priorityInput
+	priorityOther
+)
+
+// modaliasPriority classifies the device by its modalias
+func modaliasPriority(alias string) int {
+	bus := alias
+	if i := strings.IndexByte(alias, ':'); i != -1 {
+		bus = alias[:i]
+	}
+
+	switch bus {
+	case "scsi", "nvme", "mmc", "ata", "ide", "sdio", "nd", "vmbus":
+		return priorityStorage
+	case "pci":
+		if strings.Contains(alias, "bc01sc") { // mass storage controller class
+			return priorityStorage
+		}
+		if strings.Contains(alias, "bc09sc") { // input device controller class
+			return priorityInput
+		}
+	case "usb":
+		if strings.Contains(alias, "ic08isc") { // mass storage interface class
+			return priorityStorage
+		}
+		if strings.Contains(alias, "ic03isc") { // HID interface class
+			return priorityInput
+		}
+	case "virtio":
+		if strings.HasPrefix(alias, "virtio:d00000002v") || strings.HasPrefix(alias, "virtio:d00000008v") { // block and scsi
+			return priorityStorage
+		}
+		if strings.HasPrefix(alias, "virtio:d00000012v") {
+			return priorityInput
+		}
+	case "input", "hid", "serio":
+		return priorityInput
+	}
+	return priorityOther
+}
+
+// walkFiles finds all files with the given name under root. It does not follow symlinks, the same as filepath.Walk.
+// Directories are read concurrently by 'workers' goroutines, the result order is not defined.
+func walkFiles(root, name string, workers int) ([]string, error) {
+	var (
+		mu       sync.Mutex
+		cond     = sync.NewCond(&mu)
+		queue    = []string{root}
+		pending  = 1 // directories queued or being read
+		result   []string
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	worker := func() {
+		defer wg.Done()
+		for {
+			mu.Lock()
+			for len(queue) == 0 && pending > 0 {
+				cond.Wait()
+			}
+			if pending == 0 {
+				mu.Unlock()
+				return
+			}
+			dir := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			mu.Unlock()
+
+			entries, err := os.ReadDir(dir)
+
+			mu.Lock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			for _, e := range entries {
+				p := filepath.Join(dir, e.Name())
+				if e.IsDir() {
+					queue = append(queue, p)
+					pending++
+				} else if e.Name() == name {
+					result = append(result, p)
+				}
+			}
+			pending--
+			cond.Broadcast()
+			mu.Unlock()
+		}
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+	wg.Wait()
+
+	return result, firstErr
+}
+
+// runWorkers calls fn(i) for every i in [0, count) using a pool of n goroutines. Items are picked up in the index order.
+// It returns the first error returned by fn and the sum of time spent in fn.
+func runWorkers(n, count int, fn func(i int) error) (time.Duration, error) {
+	jobs := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		busy     time.Duration
+	)
+
+	wg.Add(n)
+	for w := 0; w < n; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				start := time.Now()
+				err := fn(i)
+				elapsed := time.Since(start)
+
+				mu.Lock()
+				busy += elapsed
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return busy, firstErr
+}
+
+type coldplugDevice struct {
+	file     string
+	alias    string
+	priority int
+}
+
+// readModaliases reads modalias files of all devices under root. The result is ordered by the device priority.
+func readModaliases(root string, workers int) ([]coldplugDevice, error) {
+	files, err := walkFiles(root, "modalias", workers)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]coldplugDevice, len(files))
+	_, err = runWorkers(workers, len(files), func(i int) error {
+		b, err := os.ReadFile(files[i])
+		if err != nil {
+			return err
+		}
+		alias := strings.TrimSpace(string(b))
+		devices[i] = coldplugDevice{files[i], alias, modaliasPriority(alias)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].priority != devices[j].priority {
+			return devices[i].priority < devices[j].priority
+		}
+		return devices[i].file < devices[j].file
+	})
+	return devices, nil
+}
+
+// coldplugModaliases loads modules for devices that are present at sysfs
+func coldplugModaliases() error {
+	start := time.Now()
+	workers := coldplugWorkers()
+
+	devices, err := readModaliases("/sys/devices", workers)
+	if err != nil {
+		return err
+	}
+
+	// many devices share the same alias (e.g. CPUs), match every alias only once
+	var aliases []string
+	seen := make(map[string]bool)
+	for _, d := range devices {
+		if d.alias == "" || seen[d.alias] {
+			continue
+		}
+		seen[d.alias] = true
+		aliases = append(aliases, d.alias)
+	}
+
+	busy, err := runWorkers(workers, len(aliases), func(i int) error {
+		if err := loadModalias(aliases[i]); err != nil {
+			debug("%v", err)
+		}
+		return nil
+	})
+	debug("coldplug: %d devices (%d unique modaliases) processed in %v, matching took %v, workers=%d",
+		len(devices), len(aliases), time.Since(start), busy, workers)
+	return err
+}
+
+// blockDevices returns names of all block devices and their partitions
+func blockDevices() ([]string, error) {
+	devs, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, d := range devs {
+		names = append(names, d.Name())
+
+		parts, err := os.ReadDir(filepath.Join("/sys/block/", d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parts {
+			// partition name should start with the same prefix as the device itself
+			if strings.HasPrefix(p.Name(), d.Name()) {
+				names = append(names, p.Name())
+			}
+		}
+	}
+	return names, nil
+}
+
+// scanSysBlock probes block devices that are present at sysfs
+func scanSysBlock() error {
+	start := time.Now()
+	workers := coldplugWorkers()
+
+	names, err := blockDevices()
+	if err != nil {
+		return err
+	}
+	busy, err := runWorkers(workers, len(names), func(i int) error {
+		return addBlockDevice(names[i])
+	})
+	debug("coldplug: %d block devices probed in %v, probing took %v, workers=%d", len(names), time.Since(start), busy, workers)
+	return err
+}
+
+// coldplug handles modaliases and block devices concurrently
+func coldplug() error {
+	var wg sync.WaitGroup
+	var modaliasErr, blockErr error
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		modaliasErr = coldplugModaliases()
+	}()
+	go func() {
+		defer wg.Done()
+		blockErr = scanSysBlock()
+	}()
+	wg.Wait()
+
+	if modaliasErr != nil {
+		return modaliasErr
+	}
+	return blockErr
+}
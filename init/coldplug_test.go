@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+func TestModaliasPriority(t *testing.T) {
+	check := func(alias string, expected int) {
+		if p := modaliasPriority(alias); p != expected {
+			t.Fatalf("modaliasPriority(%s) = %d, expected %d", alias, p, expected)
+		}
+	}
+
+	check("pci:v0000144Dd0000A808sv0000144Dsd0000A801bc01sc08i02", priorityStorage)
+	check("pci:v00008086d00002922sv00001AF4sd00001100bc01sc06i01", priorityStorage)
+	check("usb:v0781p5581d0100dc00dsc00dp00ic08isc06ip50in00", priorityStorage)
+	check("virtio:d00000002v00001AF4", priorityStorage)
+	check("scsi:t-0x00", priorityStorage)
+	check("usb:v046DpC52Bd1211dc00dsc00dp00ic03isc01ip01in00", priorityInput)
+	check("input:b0011v0001p0001eAB41-e0,1,4,11,14,k71,72,r,am4,lsfw", priorityInput)
+	check("hid:b0003g0001v0000046Dp0000C52B", priorityInput)
+	check("serio:ty06pr00id00ex00", priorityInput)
+	check("pci:v00008086d000015B8sv000017AAsd00002292bc02sc00i00", priorityOther)
+	check("virtio:d00000001v00001AF4", priorityOther)
+	check("cpu:type:x86,ven0000fam0006mod009E:feature:,0000,0001", priorityOther)
+	check("", priorityOther)
+}
+
+// createSysfsTree creates a directory tree that resembles /sys/devices with 'n' devices
+func createSysfsTree(tb testing.TB, n int) string {
+	tb.Helper()
+	root := tb.TempDir()
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("pci0000:%02x", i%4), fmt.Sprintf("0000:00:%02x.%d", i/8, i%8), "power")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		devDir := filepath.Dir(dir)
+		for _, f := range []string{"vendor", "device", "uevent"} {
+			if err := os.WriteFile(filepath.Join(devDir, f), []byte("0x8086\n"), 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		alias := fmt.Sprintf("pci:v00008086d%08Xsv00000000sd00000000bc%02Xsc00i00\n", i, i%16)
+		if err := os.WriteFile(filepath.Join(devDir, "modalias"), []byte(alias), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		// sysfs has a lot of symlinks, they must not be followed
+		if err := os.Symlink("../..", filepath.Join(devDir, "subsystem")); err != nil && !os.IsExist(err) {
+			tb.Fatal(err)
+		}
+	}
+	return root
+}
+
+func walkFilesSerial(root, name string) ([]string, error) {
+	var result []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.Name() == name {
+			result = append(result, path)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func TestWalkFiles(t *testing.T) {
+	root := createSysfsTree(t, 100)
+
+	expected, err := walkFilesSerial(root, "modalias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 100 {
+		t.Fatalf("expected 100 modalias files, got %d", len(expected))
+	}
+
+	for _, workers := range []int{1, 4, 32} {
+		files, err := walkFiles(root, "modalias", workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, expected) {
+			t.Fatalf("workers=%d: walkFiles() = %v, expected %v", workers, files, expected)
+		}
+	}
+
+	if _, err := walkFiles(filepath.Join(root, "nonexistent"), "modalias", 4); !os.IsNotExist(err) {
+		t.Fatalf("expected not-exist error, got %v", err)
+	}
+}
+
+func TestReadModaliases(t *testing.T) {
+	root := createSysfsTree(t, 40)
+
+	devices, err := readModaliases(root, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 40 {
+		t.Fatalf("expected 40 devices, got %d", len(devices))
+	}
+	// devices 1, 17, 33 have mass storage class (bc01), devices 9, 25 have input class (bc09)
+	if devices[0].priority != priorityStorage || devices[1].priority != priorityStorage || devices[2].priority != priorityStorage {
+		t.Fatalf("storage devices are expected to go first: %+v", devices[:3])
+	}
+	if devices[3].priority != priorityInput {
+		t.Fatalf("input devices are expected to go after storage: %+v", devices[3])
+	}
+	for i := 1; i < len(devices); i++ {
+		if devices[i-1].priority > devices[i].priority {
+			t.Fatalf("devices are not ordered by priority: %+v", devices)
+		}
+	}
+}
+
+func TestRunWorkers(t *testing.T) {
+	var sum int64
+	_, err := runWorkers(8, 1000, func(i int) error {
+		atomic.AddInt64(&sum, int64(i))
+		if i == 500 {
+			return fmt.Errorf("item %d failed", i)
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "item 500 failed" {
+		t.Fatalf("expected error from item 500, got %v", err)
+	}
+	if sum != 999*1000/2 {
+		t.Fatalf("not all items processed, sum = %d", sum)
+	}
+}
+
+func BenchmarkColdplugWalk(b *testing.B) {
+	root := createSysfsTree(b, 2000)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			files, err := walkFilesSerial(root, "modalias")
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, f := range files {
+				if _, err := os.ReadFile(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := readModaliases(root, coldplugWorkers()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
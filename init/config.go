@@ -1,18 +1,68 @@
 package main
 
-import "net"
-
 type InitNetworkConfig struct {
-	Interfaces []net.HardwareAddr `yaml:",omitempty"` // list of active interfaces to use
+	Interfaces []string `yaml:",omitempty"` // list of active interfaces to use: MAC addresses, names or name globs like 'enp*'
 
 	Dhcp bool `yaml:",omitempty"`
 
 	Ip         string `yaml:",omitempty"`            // e.g. 10.0.2.15/24
 	Gateway    string `yaml:",omitempty"`            // e.g. 10.0.2.255
 	DNSServers string `yaml:"dns_servers,omitempty"` // comma-separated list of ips, e.g. 10.0.1.1,8.8.8.8
+
+	Dhcp6    bool   `yaml:",omitempty"` // stateful DHCPv6
+	Slaac    bool   `yaml:",omitempty"` // IPv6 configuration with router advertisements (plus DHCPv6 if the router asks for it)
+	Ip6      string `yaml:",omitempty"` // e.g. 2001:db8::15/64
+	Gateway6 string `yaml:",omitempty"` // e.g. fe80::1
+
+	Vlans   []NetVlan   `yaml:",omitempty"`
+	Bonds   []NetBond   `yaml:",omitempty"`
+	Bridges []NetBridge `yaml:",omitempty"`
+
+	Keep bool `yaml:",omitempty"` // leave the interfaces configured at switch root and hand them over to systemd-networkd
+
+	Wireguard *WireguardConfig `yaml:",omitempty"`
+}
+
+// WireguardConfig is a tunnel used to reach network services (e.g. tang servers) at boot time
+type WireguardConfig struct {
+	Interface      string          `yaml:",omitempty"`                 // tunnel interface name, wg0 if not specified
+	PrivateKeyFile string          `yaml:"private_key_file,omitempty"` // file with base64 encoded private key
+	Address        string          `yaml:",omitempty"`                 // tunnel address and its prefix length, e.g. 10.100.0.2/24
+	ListenPort     int             `yaml:"listen_port,omitempty"`
+	Peers          []WireguardPeer `yaml:",omitempty"`
+}
+
+type WireguardPeer struct {
+	PublicKey           string   `yaml:"public_key,omitempty"`           // base64 encoded
+	Endpoint            string   `yaml:",omitempty"`                     // host:port
+	AllowedIPs          []string `yaml:"allowed_ips,omitempty"`          // e.g. 10.100.0.0/24
+	PersistentKeepalive int      `yaml:"persistent_keepalive,omitempty"` // interval in seconds
+}
+
+// NetVlan is a 802.1q VLAN interface on top of the parent link
+type NetVlan struct {
+	Name   string `yaml:",omitempty"` // e.g. vlan100
+	Parent string `yaml:",omitempty"` // name of the lower link, can be a physical interface or a bond
+	Id     int    `yaml:",omitempty"`
+}
+
+// NetBond is a bonding interface that aggregates member links
+type NetBond struct {
+	Name    string   `yaml:",omitempty"` // e.g. bond0
+	Mode    string   `yaml:",omitempty"` // balance-rr, active-backup, 802.3ad, ...
+	Members []string `yaml:",omitempty"` // names of the member interfaces
+	Miimon  int      `yaml:",omitempty"` // link monitoring frequency in milliseconds
+	Mtu     int      `yaml:",omitempty"`
+}
+
+// NetBridge is a software bridge interface
+type NetBridge struct {
+	Name    string   `yaml:",omitempty"` // e.g. br0
+	Members []string `yaml:",omitempty"` // names of the bridge ports
 }
 
 type VirtualConsole struct {
+	Keymap          string `yaml:",omitempty"` // keymap name shown at the password prompt, e.g. de-latin1
 	KeymapFile      string `yaml:",omitempty"`
 	Utf             bool   `yaml:",omitempty"`
 	FontFile        string `yaml:",omitempty"`
@@ -20,15 +70,40 @@ type VirtualConsole struct {
 	FontUnicodeFile string `yaml:",omitempty"`
 }
 
+// VerityConfig specifies dm-verity root hashes, roothash= and usrhash= boot params take precedence over it
+type VerityConfig struct {
+	RootHash     string `yaml:"root_hash,omitempty"`
+	UsrHash      string `yaml:"usr_hash,omitempty"`
+	OnCorruption string `yaml:"on_corruption,omitempty"` // restart, panic or ignore. By default I/O errors are returned
+}
+
+// TokenRetryConfig specifies how init retries unlocking LUKS devices with a clevis token of the given pin (tang, tpm2 or sss)
+type TokenRetryConfig struct {
+	Retries int    `yaml:",omitempty"` // number of attempts after the first failed one
+	Backoff string `yaml:",omitempty"` // delay between attempts, e.g. 500ms
+}
+
 type InitConfig struct {
 	Network                *InitNetworkConfig  `yaml:",omitempty"`
 	ModuleDependencies     map[string][]string `yaml:",omitempty"`
 	ModulePostDependencies map[string][]string `yaml:",omitempty"`
 	ModulesForceLoad       []string            `yaml:",omitempty"`
 	ModprobeOptions        map[string]string   `yaml:",omitempty"`
+	ModprobeBlacklist      []string            `yaml:",omitempty"` // modules that are not loaded for matching aliases, from 'blacklist' lines in modprobe.d
 	Kernel                 string              `yaml:",omitempty"` // kernel version this image was built for
 	MountTimeout           int                 `yaml:",omitempty"` // mount timeout in seconds
 	VirtualConsole         *VirtualConsole     `yaml:",omitempty"`
+	ShutdownHelper         bool                `yaml:",omitempty"` // copy init to /run/initramfs to unmount the root filesystem at shutdown
+	Verity                 *VerityConfig       `yaml:",omitempty"`
+	MeasurePCR             int                 `yaml:",omitempty"` // TPM PCR to measure boot inputs into, 0 disables measurements
+	OnFailure              string              `yaml:",omitempty"` // boot failure policy: shell, reboot, poweroff or retry
+	Watchdog               int                 `yaml:",omitempty"` // hardware watchdog timeout in seconds, 0 disables the watchdog
+
+	TokenRetry map[string]*TokenRetryConfig `yaml:",omitempty"` // keyed by clevis pin
 }
 
-const initConfigPath = "/etc/booster.init.yaml"
+const (
+	initConfigPath      = "/etc/booster.init.yaml"
+	wireguardKeyPath    = "/etc/booster.wireguard.key" // private key of the WireGuard tunnel
+	wireguardDefaultDev = "wg0"
+)
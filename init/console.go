@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -145,57 +149,214 @@ func configureVirtualConsole() error {
 	return nil
 }
 
-// readPasswordLine reads from reader until it finds \n or io.EOF.
-// The slice returned does not include the \n.
-// readPasswordLine also ignores any \r it finds.
-// Windows uses \r as end of line. So, on Windows, readPasswordLine
-// reads until it finds \r and ignores any \n it finds during processing.
-func readPasswordLine(reader io.Reader) ([]byte, error) {
+// password-echo values of rd.luks.options, the same as in systemd
+const (
+	passwordEchoNo     = "no"     // nothing is printed
+	passwordEchoMasked = "masked" // an asterisk is printed for every typed character
+	passwordEchoYes    = "yes"    // the typed characters are printed
+)
+
+// errPasswordSkipped is returned if user presses Ctrl-C or Ctrl-D at the password prompt
+var errPasswordSkipped = errors.New("password prompt is skipped by user")
+
+// control characters handled by the password line editor
+const (
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyBackspace = 0x08
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyDelete    = 0x7f
+)
+
+// passwordLine is a password being edited. Memory with the password content is zeroed once it is not needed anymore.
+type passwordLine struct {
+	buf  []byte
+	w    io.Writer
+	echo string
+}
+
+func (l *passwordLine) append(b byte) {
+	if len(l.buf) == cap(l.buf) {
+		// grow the buffer manually so no copies of the password are left in the memory
+		grown := make([]byte, len(l.buf), 2*cap(l.buf)+64)
+		copy(grown, l.buf)
+		MemZeroBytes(l.buf)
+		l.buf = grown
+	}
+	l.buf = append(l.buf, b)
+
+	switch l.echo {
+	case passwordEchoYes:
+		_, _ = l.w.Write([]byte{b})
+	case passwordEchoMasked:
+		// one asterisk per UTF-8 character, continuation bytes have 10xxxxxx form
+		if !utf8.RuneStart(b) {
+			return
+		}
+		_, _ = l.w.Write([]byte{'*'})
+	}
+}
+
+// deleteRunes removes the last n characters
+func (l *passwordLine) deleteRunes(n int) {
+	for ; n > 0 && len(l.buf) > 0; n-- {
+		_, size := utf8.DecodeLastRune(l.buf)
+		MemZeroBytes(l.buf[len(l.buf)-size:])
+		l.buf = l.buf[:len(l.buf)-size]
+		if l.echo != passwordEchoNo {
+			_, _ = l.w.Write([]byte("\b \b"))
+		}
+	}
+}
+
+// deleteWord removes the last word together with the spaces following it
+func (l *passwordLine) deleteWord() {
+	for len(l.buf) > 0 {
+		if r, _ := utf8.DecodeLastRune(l.buf); !unicode.IsSpace(r) {
+			break
+		}
+		l.deleteRunes(1)
+	}
+	for len(l.buf) > 0 {
+		if r, _ := utf8.DecodeLastRune(l.buf); unicode.IsSpace(r) {
+			break
+		}
+		l.deleteRunes(1)
+	}
+}
+
+// readPasswordLine reads a password from reader until it finds \n or io.EOF and echoes the input to w
+// according to the echo mode. The slice returned does not include the \n, any \r is ignored.
+// Backspace deletes the last UTF-8 character, Ctrl-U deletes the whole line, Ctrl-W deletes the last word.
+// Ctrl-C and Ctrl-D discard the input and errPasswordSkipped is returned.
+func readPasswordLine(reader io.Reader, w io.Writer, echo string) ([]byte, error) {
 	var buf [1]byte
-	var ret []byte
+	line := &passwordLine{buf: make([]byte, 0, 64), w: w, echo: echo}
 
 	for {
 		n, err := reader.Read(buf[:])
 		if n > 0 {
 			switch buf[0] {
-			case '\b':
-				if len(ret) > 0 {
-					ret = ret[:len(ret)-1]
-				}
+			case keyBackspace, keyDelete:
+				line.deleteRunes(1)
+			case keyCtrlU:
+				line.deleteRunes(len(line.buf))
+			case keyCtrlW:
+				line.deleteWord()
+			case keyCtrlC, keyCtrlD:
+				MemZeroBytes(line.buf)
+				return nil, errPasswordSkipped
 			case '\n':
-				return ret, nil
+				return line.buf, nil
+			case '\r':
 			default:
-				ret = append(ret, buf[0])
+				line.append(buf[0])
 			}
 			continue
 		}
 		if err != nil {
-			if err == io.EOF && len(ret) > 0 {
-				return ret, nil
+			if err == io.EOF && len(line.buf) > 0 {
+				return line.buf, nil
 			}
-			return ret, err
+			return line.buf, err
+		}
+	}
+}
+
+// pollReader reads from a file descriptor until the context is cancelled
+type pollReader struct {
+	ctx context.Context
+	fd  int
+}
+
+func (r pollReader) Read(p []byte) (int, error) {
+	for {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		// wake up periodically to check whether the read has been cancelled
+		fds := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 100)
+		if err == unix.EINTR || n == 0 {
+			continue
 		}
+		if err != nil {
+			return 0, err
+		}
+		n, err = unix.Read(r.fd, p)
+		if n == 0 && err == nil {
+			return 0, io.EOF
+		}
+		if n > 0 {
+			// somebody is typing at the console, the boot is not stuck
+			petWatchdog()
+		}
+		return n, err
 	}
 }
 
-func readPassword() ([]byte, error) {
-	stdin := os.Stdin
-	fd := int(stdin.Fd())
+// readPassword shows the prompt and reads a password from the console, see readPasswordLine for the supported line editing.
+// If ctx is cancelled then the input typed so far is discarded and ctx.Err() is returned.
+func readPassword(ctx context.Context, console *os.File, prompt, echo string) ([]byte, error) {
+	fd := int(console.Fd())
 
 	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
 	if err != nil {
 		return nil, err
 	}
 
+	// the line is edited and echoed by readPasswordLine, Ctrl-C is read as a regular character
 	newState := *termios
-	newState.Lflag &^= unix.ECHO
-	newState.Lflag |= unix.ICANON | unix.ISIG
+	newState.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
 	newState.Iflag |= unix.ICRNL
+	newState.Cc[unix.VMIN] = 1
+	newState.Cc[unix.VTIME] = 0
 	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &newState); err != nil {
 		return nil, err
 	}
 
 	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
 
-	return readPasswordLine(stdin)
+	// the prompt is shown once the terminal is ready to handle the input
+	if _, err := fmt.Fprint(console, prompt); err != nil {
+		return nil, err
+	}
+	password, err := readPasswordLine(pollReader{ctx, fd}, console, echo)
+	if ctx.Err() != nil {
+		// drop the partially typed password
+		MemZeroBytes(password)
+		_ = unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIFLUSH)
+		return nil, ctx.Err()
+	}
+	return password, err
+}
+
+// keyboard flags returned by KDGKBLED ioctl
+const (
+	kdgkbled         = 0x4B64
+	keyboardNumLock  = 0x02
+	keyboardCapsLock = 0x04
+)
+
+// keyboardHints returns the keymap name and warnings about enabled Caps Lock and Num Lock. The hints are shown for
+// virtual terminals only, serial consoles get the characters from the remote terminal.
+func keyboardHints(console *os.File) []string {
+	var flags byte
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, console.Fd(), kdgkbled, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return nil
+	}
+
+	keymap := "us" // kernel default keymap
+	if c := config.VirtualConsole; c != nil && c.Keymap != "" {
+		keymap = c.Keymap
+	}
+	hints := []string{"Keyboard layout: " + keymap}
+	if flags&keyboardCapsLock != 0 {
+		hints = append(hints, "Warning: Caps Lock is on")
+	}
+	if flags&keyboardNumLock != 0 {
+		hints = append(hints, "Warning: Num Lock is on")
+	}
+	return hints
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPollReader(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	if _, err := w.WriteString("secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	password, err := readPasswordLine(pollReader{context.Background(), int(r.Fd())}, io.Discard, passwordEchoNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password) != "secret" {
+		t.Fatalf("expected password 'secret', got '%s'", password)
+	}
+
+	// partially typed password is interrupted by the cancellation
+	if _, err := w.WriteString("sec"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := readPasswordLine(pollReader{ctx, int(r.Fd())}, io.Discard, passwordEchoNo); err != context.DeadlineExceeded {
+		t.Fatalf("expected the read to be cancelled, got %v", err)
+	}
+}
+
+func TestReadPasswordLine(t *testing.T) {
+	check := func(input, echo, expectedPassword, expectedOutput string) {
+		t.Helper()
+		var out bytes.Buffer
+		password, err := readPasswordLine(bytes.NewReader([]byte(input)), &out, echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(password) != expectedPassword {
+			t.Fatalf("input %q: expected password %q, got %q", input, expectedPassword, password)
+		}
+		if out.String() != expectedOutput {
+			t.Fatalf("input %q: expected output %q, got %q", input, expectedOutput, out.String())
+		}
+	}
+
+	check("1234\n", passwordEchoNo, "1234", "")
+	check("1234\r\n", passwordEchoMasked, "1234", "****")
+	check("12345\b\n", passwordEchoYes, "1234", "12345\b \b")
+	check("pässwörd\x7f\x7f\n", passwordEchoMasked, "pässwö", "********\b \b\b \b")
+	check("wrong\x15right\n", passwordEchoMasked, "right", "*****\b \b\b \b\b \b\b \b\b \b*****")
+	check("correct horse  battery  \x17staple\n", passwordEchoNo, "correct horse  staple", "")
+	check("no newline", passwordEchoNo, "no newline", "")
+
+	for _, key := range []string{"\x03", "\x04"} {
+		if _, err := readPasswordLine(bytes.NewReader([]byte("1234"+key+"5678\n")), io.Discard, passwordEchoNo); err != errPasswordSkipped {
+			t.Fatalf("expected the prompt to be skipped with %q, got %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/client4"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dhcpAttempts        = 12 // number of DHCP exchanges before giving up
+	dhcpMaxBackoff      = 32 * time.Second
+	dhcpInfiniteLease   = 0xffffffff * time.Second
+	optionMSStaticRoute = 249 // Microsoft-specific predecessor of the classless static route option 121
+)
+
+var (
+	dhcpRequestedOptions = dhcpv4.WithRequestedOptions(
+		dhcpv4.OptionSubnetMask,
+		dhcpv4.OptionRouter,
+		dhcpv4.OptionDomainNameServer,
+		dhcpv4.OptionHostName,
+		dhcpv4.OptionDomainName,
+		dhcpv4.OptionInterfaceMTU,
+		dhcpv4.OptionDNSDomainSearchList,
+		dhcpv4.OptionClasslessStaticRoute,
+		dhcpv4.GenericOptionCode(optionMSStaticRoute),
+	)
+
+	// closed at network shutdown to stop the lease renewal goroutines
+	dhcpStop     = make(chan struct{})
+	dhcpStopOnce sync.Once
+
+	dhcpRand      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	dhcpRandMutex sync.Mutex
+)
+
+// dhcpBackoff returns the delay before the next DHCP attempt. The delay grows exponentially from 1 second up to 32 seconds
+// and is randomized by ±25% so the machines that booted at the same time do not flood the server in lockstep (RFC 2131 section 4.1).
+func dhcpBackoff(attempt int) time.Duration {
+	d := dhcpMaxBackoff
+	if attempt < 5 {
+		d = time.Second << attempt
+	}
+	dhcpRandMutex.Lock()
+	defer dhcpRandMutex.Unlock()
+	return d - d/4 + time.Duration(dhcpRand.Int63n(int64(d/2)))
+}
+
+func runDhcp(link netlink.Link, c *ifaceNetConfig) error {
+	ifname := link.Attrs().Name
+	ack, err := acquireDhcpLease(ifname)
+	if err != nil {
+		return err
+	}
+	if err := applyDhcpLease(link, c, ack); err != nil {
+		return err
+	}
+
+	// a LUKS password prompt might wait for user input longer than the lease time
+	go renewDhcpLease(link, c, ack)
+	return nil
+}
+
+// acquireDhcpLease runs DISCOVER/OFFER/REQUEST/ACK exchange at the interface
+func acquireDhcpLease(ifname string) (*dhcpv4.DHCPv4, error) {
+	dhcp := client4.NewClient()
+	for attempt := 0; attempt < dhcpAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(dhcpBackoff(attempt - 1))
+		}
+
+		conversation, err := dhcp.Exchange(ifname, dhcpRequestedOptions)
+		if err != nil {
+			debug("DHCP %s: %v", ifname, err)
+			continue
+		}
+		for _, m := range conversation {
+			if m.MessageType() == dhcpv4.MessageTypeAck {
+				return m, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("DHCP: no ACK received")
+}
+
+// applyDhcpLease configures the interface with the address, routes, MTU, hostname and DNS servers received from the server
+func applyDhcpLease(link netlink.Link, c *ifaceNetConfig, ack *dhcpv4.DHCPv4) error {
+	ifname := link.Attrs().Name
+
+	// MTU from ip= boot param has higher priority
+	if mtu := dhcpInterfaceMTU(ack); mtu != 0 && c.mtu == 0 {
+		debug("DHCP %s: setting MTU %d", ifname, mtu)
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return err
+		}
+	}
+
+	if err := netlink.AddrReplace(link, dhcpLeaseAddr(ack)); err != nil {
+		return err
+	}
+	saveDhcpLease(ifname, ack)
+
+	routes, err := dhcpClasslessRoutes(ack)
+	if err != nil {
+		return err
+	}
+	if len(routes) > 0 {
+		// per RFC 3442 the router option is ignored if the classless static route option is present
+		for _, r := range routes {
+			route := netlink.Route{LinkIndex: link.Attrs().Index, Dst: r.Dest}
+			if r.Router.IsUnspecified() {
+				route.Scope = netlink.SCOPE_LINK
+			} else {
+				route.Gw = r.Router
+			}
+			if err := netlink.RouteReplace(&route); err != nil {
+				return fmt.Errorf("DHCP %s: unable to add route %v: %v", ifname, r, err)
+			}
+		}
+	} else if gateway := dhcpv4.GetIP(dhcpv4.OptionRouter, ack.Options); gateway != nil {
+		defaultRoute := netlink.Route{LinkIndex: link.Attrs().Index, Gw: gateway}
+		if err := netlink.RouteReplace(&defaultRoute); err != nil {
+			return err
+		}
+	}
+
+	// hostname from ip= boot param has higher priority
+	if hostname := ack.HostName(); hostname != "" && c.hostname == "" {
+		debug("DHCP %s: setting hostname %s", ifname, hostname)
+		if err := unix.Sethostname([]byte(hostname)); err != nil {
+			return err
+		}
+	}
+
+	var search []string
+	if labels := ack.DomainSearch(); labels != nil {
+		search = labels.Labels
+	} else if domain := ack.DomainName(); domain != "" {
+		search = []string{domain}
+	}
+	dnsServers := dhcpv4.GetIPs(dhcpv4.OptionDomainNameServer, ack.Options)
+	if dnsServers != nil || search != nil {
+		if err := writeResolvConf(dnsServers, search); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dhcpLeaseAddr(ack *dhcpv4.DHCPv4) *netlink.Addr {
+	addr := &netlink.Addr{IPNet: &net.IPNet{
+		IP:   ack.YourIPAddr,
+		Mask: ack.SubnetMask(),
+	}}
+	if lease := ack.IPAddressLeaseTime(0); lease != 0 && lease != dhcpInfiniteLease {
+		// the kernel removes the address if the lease is not renewed
+		addr.ValidLft = int(lease / time.Second)
+		addr.PreferedLft = addr.ValidLft
+	}
+	return addr
+}
+
+// dhcpInterfaceMTU returns the value of option 26 or 0 if the option is not present
+func dhcpInterfaceMTU(ack *dhcpv4.DHCPv4) int {
+	v := ack.Options.Get(dhcpv4.OptionInterfaceMTU)
+	if len(v) != 2 {
+		return 0
+	}
+	mtu := int(binary.BigEndian.Uint16(v))
+	if mtu < 68 {
+		return 0 // minimum IPv4 MTU per RFC 791
+	}
+	return mtu
+}
+
+// dhcpClasslessRoutes returns static routes from option 121 or from its Microsoft-specific variant 249
+func dhcpClasslessRoutes(ack *dhcpv4.DHCPv4) (dhcpv4.Routes, error) {
+	for _, code := range []dhcpv4.OptionCode{dhcpv4.OptionClasslessStaticRoute, dhcpv4.GenericOptionCode(optionMSStaticRoute)} {
+		v := ack.Options.Get(code)
+		if v == nil {
+			continue
+		}
+		var routes dhcpv4.Routes
+		if err := routes.FromBytes(v); err != nil {
+			return nil, fmt.Errorf("DHCP: unable to parse option %d: %v", code.Code(), err)
+		}
+		return routes, nil
+	}
+	return nil, nil
+}
+
+// renewDhcpLease extends the lease at T1 and keeps doing it until the network is shut down.
+// If the server does not respond till the lease end then a new lease is acquired.
+func renewDhcpLease(link netlink.Link, c *ifaceNetConfig, ack *dhcpv4.DHCPv4) {
+	ifname := link.Attrs().Name
+	for {
+		lease := ack.IPAddressLeaseTime(0)
+		if lease == 0 || lease == dhcpInfiniteLease {
+			return
+		}
+		start := time.Now()
+		select {
+		case <-time.After(ack.IPAddressRenewalTime(lease / 2)):
+		case <-dhcpStop:
+			return
+		}
+
+		var renewed *dhcpv4.DHCPv4
+		for attempt := 0; renewed == nil && time.Since(start) < lease; attempt++ {
+			var err error
+			renewed, err = requestDhcpRenewal(link, ack)
+			if err == nil {
+				break
+			}
+			debug("DHCP %s: lease renewal: %v", ifname, err)
+			select {
+			case <-time.After(dhcpBackoff(attempt)):
+			case <-dhcpStop:
+				return
+			}
+		}
+
+		if renewed == nil {
+			warning("DHCP %s: unable to renew lease, requesting a new one", ifname)
+			var err error
+			renewed, err = acquireDhcpLease(ifname)
+			if err != nil {
+				warning("DHCP %s: %v", ifname, err)
+				return
+			}
+		}
+
+		select {
+		case <-dhcpStop:
+			return // the network is being shut down, do not touch the interface anymore
+		default:
+		}
+
+		if !renewed.YourIPAddr.Equal(ack.YourIPAddr) {
+			debug("DHCP %s: leased address changed from %v to %v", ifname, ack.YourIPAddr, renewed.YourIPAddr)
+			_ = netlink.AddrDel(link, dhcpLeaseAddr(ack))
+		}
+		if err := applyDhcpLease(link, c, renewed); err != nil {
+			warning("DHCP %s: %v", ifname, err)
+		}
+		ack = renewed
+	}
+}
+
+// requestDhcpRenewal sends DHCPREQUEST for the currently leased address
+func requestDhcpRenewal(link netlink.Link, ack *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	ifname := link.Attrs().Name
+	sfd, err := client4.MakeBroadcastSocket(ifname)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(sfd)
+	rfd, err := client4.MakeListeningSocket(ifname)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(rfd)
+
+	request, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithHwAddr(link.Attrs().HardwareAddr),
+		dhcpv4.WithClientIP(ack.YourIPAddr),
+		dhcpRequestedOptions,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return client4.NewClient().SendReceive(sfd, rfd, request, dhcpv4.MessageTypeAck)
+}
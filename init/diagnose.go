@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// When the root filesystem is not found init prints a summary of what it has seen during the boot: block devices,
+// the requested device specs and why the devices did not match, LUKS devices that are not unlocked, modules that
+// failed to load and storage controllers without a driver in the image. The summary ends with suggested fixes.
+
+const diagnosticsFile = "/run/initramfs/booster-diag.txt"
+
+type diagBlockDevice struct {
+	path string
+	info *blkInfo // nil if the device cannot be read
+	err  error
+}
+
+var (
+	diagMutex           sync.Mutex
+	diagBlockDevices    = map[string]*diagBlockDevice{}
+	diagLuksStatus      = map[string]string{} // devpath -> status of the LUKS device
+	unmatchedModaliases = map[string]bool{}
+)
+
+func diagAddBlockDevice(path string, info *blkInfo, err error) {
+	diagMutex.Lock()
+	defer diagMutex.Unlock()
+	diagBlockDevices[path] = &diagBlockDevice{path, info, err}
+}
+
+func diagSetLuksStatus(path, status string) {
+	diagMutex.Lock()
+	defer diagMutex.Unlock()
+	diagLuksStatus[path] = status
+}
+
+func diagAddUnmatchedModalias(alias string) {
+	diagMutex.Lock()
+	defer diagMutex.Unlock()
+	unmatchedModaliases[alias] = true
+}
+
+// isStorageModalias reports whether the modalias belongs to a storage controller or a disk
+func isStorageModalias(alias string) bool {
+	switch {
+	case strings.HasPrefix(alias, "pci:"):
+		// pci:v00008086d00002922sv00001AF4sd00001100bc01sc06i01, the IDs are upper case hex
+		return strings.Contains(alias, "bc01")
+	case strings.HasPrefix(alias, "usb:"):
+		// mass storage interface class
+		return strings.Contains(alias, "ic08")
+	case strings.HasPrefix(alias, "virtio:"):
+		// virtio block and virtio scsi devices
+		return strings.HasPrefix(alias, "virtio:d00000002v") || strings.HasPrefix(alias, "virtio:d00000008v")
+	case strings.HasPrefix(alias, "scsi:"):
+		return strings.HasPrefix(alias, "scsi:t-0x00") // disk
+	case strings.HasPrefix(alias, "mmc:"):
+		return true
+	}
+	return false
+}
+
+// formatBlkInfo returns human readable description of the device content
+func formatBlkInfo(info *blkInfo) string {
+	if info == nil || info.format == "" {
+		return "unknown content"
+	}
+	s := info.format
+	if len(info.uuid) != 0 {
+		s += " UUID=" + info.uuid.toString()
+	}
+	if info.label != "" {
+		s += fmt.Sprintf(" LABEL=%q", info.label)
+	}
+	return s
+}
+
+// specMismatch returns the reason why the device does not match the spec (e.g. root= value), or an empty string if it matches
+func specMismatch(spec string, d *diagBlockDevice) string {
+	switch {
+	case d.info == nil:
+		return fmt.Sprintf("cannot be read: %v", d.err)
+	case d.path == spec:
+	case strings.HasPrefix(spec, "UUID="):
+		u, err := parseUUID(stripQuotes(strings.TrimPrefix(spec, "UUID=")))
+		if err != nil {
+			return fmt.Sprintf("invalid UUID in %s: %v", spec, err)
+		}
+		if len(d.info.uuid) == 0 {
+			return "has no UUID"
+		}
+		if !bytes.Equal(u, d.info.uuid) {
+			return "UUID " + d.info.uuid.toString() + " differs"
+		}
+	case strings.HasPrefix(spec, "LABEL="):
+		if d.info.label == "" {
+			return "has no label"
+		}
+		if d.info.label != strings.TrimPrefix(spec, "LABEL=") {
+			return fmt.Sprintf("label %q differs", d.info.label)
+		}
+	case strings.HasPrefix(spec, "/dev/"):
+		return "path differs"
+	default:
+		return "unsupported device spec"
+	}
+
+	if !d.info.isFs {
+		return fmt.Sprintf("matches but %s is not a filesystem", d.info.format)
+	}
+	return ""
+}
+
+type diagnostics struct {
+	cmdline       map[string]string
+	devices       []*diagBlockDevice
+	luksStatus    map[string]string
+	failedModules []string
+	unmatched     []string // storage modaliases without a matching module
+}
+
+// collectDiagnostics takes snapshot of the boot state
+func collectDiagnostics() *diagnostics {
+	diagMutex.Lock()
+	defer diagMutex.Unlock()
+
+	d := &diagnostics{
+		cmdline:       cmdlineSnapshot(),
+		luksStatus:    make(map[string]string),
+		failedModules: failedModules(),
+	}
+	for _, dev := range diagBlockDevices {
+		d.devices = append(d.devices, dev)
+	}
+	sort.Slice(d.devices, func(i, j int) bool { return d.devices[i].path < d.devices[j].path })
+	for k, v := range diagLuksStatus {
+		d.luksStatus[k] = v
+	}
+	for a := range unmatchedModaliases {
+		if isStorageModalias(a) {
+			d.unmatched = append(d.unmatched, a)
+		}
+	}
+	sort.Strings(d.unmatched)
+	return d
+}
+
+// requestedSpecs returns boot params that specify devices needed for boot
+func (d *diagnostics) requestedSpecs() []string {
+	var result []string
+	for _, p := range []string{"root", "rootfstype", "rd.luks.uuid", "rd.luks.name", "resume", "roothash", "usrhash"} {
+		if v, ok := d.cmdline[p]; ok {
+			result = append(result, p+"="+v)
+		}
+	}
+	return result
+}
+
+func (d *diagnostics) suggestions() []string {
+	var result []string
+
+	root := d.cmdline["root"]
+	_, hasLuksParam := d.cmdline["rd.luks.uuid"]
+	if _, ok := d.cmdline["rd.luks.name"]; ok {
+		hasLuksParam = true
+	}
+
+	if root == "" {
+		result = append(result, "root= boot param is not specified, set it to the root filesystem, e.g. root=UUID=<uuid>.")
+	} else if !strings.HasPrefix(root, "/dev/") && !strings.HasPrefix(root, "UUID=") && !strings.HasPrefix(root, "LABEL=") {
+		result = append(result, fmt.Sprintf("root=%s format is not supported, use a device path, UUID= or LABEL=.", root))
+	}
+
+	if len(d.devices) == 0 {
+		result = append(result, "No block devices found. The storage controller driver is probably missing in the image: add it to 'modules' in booster.yaml or enable 'universal' mode.")
+	}
+
+	rootPathFound := false
+	for _, dev := range d.devices {
+		if dev.path == root {
+			rootPathFound = true
+		}
+		if dev.info == nil {
+			continue
+		}
+		if dev.info.format == "luks" {
+			uuid := dev.info.uuid.toString()
+			if root == "UUID="+uuid {
+				result = append(result, fmt.Sprintf("root=%s points to a LUKS container, unlock it with rd.luks.uuid=%s and set root= to the filesystem inside it.", root, uuid))
+			} else if !hasLuksParam {
+				result = append(result, fmt.Sprintf("LUKS device %s is not unlocked as neither rd.luks.uuid nor rd.luks.name is specified, add rd.luks.uuid=%s if it contains the root filesystem.", dev.path, uuid))
+			}
+		}
+	}
+	if strings.HasPrefix(root, "/dev/") && !strings.HasPrefix(root, "/dev/mapper/") && !rootPathFound {
+		result = append(result, fmt.Sprintf("Device %s does not exist, kernel device names might change between boots, use root=UUID=<uuid> instead.", root))
+	}
+
+	paths := make([]string, 0, len(d.luksStatus))
+	for p := range d.luksStatus {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if strings.HasPrefix(d.luksStatus[p], "waiting") {
+			result = append(result, fmt.Sprintf("LUKS device %s is still waiting to be unlocked, enter the passphrase or check that the Clevis token (tang server or TPM) is available.", p))
+		}
+	}
+
+	if len(d.failedModules) > 0 {
+		result = append(result, fmt.Sprintf("Modules %s failed to load, check 'dmesg' for the errors.", strings.Join(d.failedModules, ", ")))
+	}
+	for _, a := range d.unmatched {
+		result = append(result, fmt.Sprintf("The image has no driver for storage device %s, find it on the host with 'modprobe -R %s' and add it to 'modules' in booster.yaml.", a, a))
+	}
+	return result
+}
+
+func (d *diagnostics) format() string {
+	var b strings.Builder
+
+	b.WriteString("Root filesystem is not found. Boot diagnostics:\n")
+	b.WriteString("Requested devices:\n")
+	specs := d.requestedSpecs()
+	if len(specs) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, s := range specs {
+		fmt.Fprintf(&b, "  %s\n", s)
+	}
+
+	b.WriteString("Block devices:\n")
+	if len(d.devices) == 0 {
+		b.WriteString("  none\n")
+	}
+	root := d.cmdline["root"]
+	for _, dev := range d.devices {
+		fmt.Fprintf(&b, "  %s: %s", dev.path, formatBlkInfo(dev.info))
+		if status, ok := d.luksStatus[dev.path]; ok {
+			fmt.Fprintf(&b, ", %s", status)
+		} else if root != "" {
+			if reason := specMismatch(root, dev); reason != "" {
+				fmt.Fprintf(&b, ", does not match root=%s: %s", root, reason)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	if len(d.failedModules) > 0 {
+		fmt.Fprintf(&b, "Failed modules: %s\n", strings.Join(d.failedModules, ", "))
+	}
+	if len(d.unmatched) > 0 {
+		b.WriteString("Storage devices without a driver in the image:\n")
+		for _, a := range d.unmatched {
+			fmt.Fprintf(&b, "  %s\n", a)
+		}
+	}
+
+	if s := d.suggestions(); len(s) > 0 {
+		b.WriteString("Suggestions:\n")
+		for _, s := range s {
+			fmt.Fprintf(&b, "  * %s\n", s)
+		}
+	}
+	return b.String()
+}
+
+// reportRootNotFound prints the boot diagnostics to the console and saves them to /run/initramfs
+func reportRootNotFound() {
+	report := collectDiagnostics().format()
+	fmt.Print(report)
+	if err := os.WriteFile(diagnosticsFile, []byte(report), 0644); err != nil {
+		warning("unable to write %s: %v", diagnosticsFile, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIsStorageModalias(t *testing.T) {
+	check := func(alias string, expected bool) {
+		t.Helper()
+		if isStorageModalias(alias) != expected {
+			t.Fatalf("isStorageModalias(%s) expected to be %v", alias, expected)
+		}
+	}
+
+	check("pci:v00008086d00002922sv00001AF4sd00001100bc01sc06i01", true) // AHCI
+	check("pci:v0000144Dd0000A808sv0000144Dsd0000A801bc01sc08i02", true) // NVMe
+	check("pci:v00008086d0000100Esv00001AF4sd00001100bc02sc00i00", false)
+	check("usb:v0781p5581d0100dc00dsc00dp00ic08isc06ip50in00", true)
+	check("usb:v046DpC52Bd1201dc00dsc00dp00ic03isc01ip01in00", false)
+	check("virtio:d00000002v00001AF4", true)
+	check("virtio:d00000001v00001AF4", false)
+	check("scsi:t-0x00", true)
+	check("scsi:t-0x05", false)
+	check("acpi:PNP0A03:", false)
+}
+
+func TestDiagnostics(t *testing.T) {
+	rootUUID, _ := parseUUID("7bbf9363-eb42-4476-8c1c-9f1f4d091385")
+	luksUUID, _ := parseUUID("639b8fdd-36ba-443e-be3e-e5b335935502")
+	d := &diagnostics{
+		cmdline: map[string]string{"root": "UUID=639b8fdd-36ba-443e-be3e-e5b335935502"},
+		devices: []*diagBlockDevice{
+			{path: "/dev/sda", err: fmt.Errorf("input/output error")},
+			{path: "/dev/vda1", info: &blkInfo{"ext4", true, rootUUID, "root"}},
+			{path: "/dev/vda2", info: &blkInfo{"luks", false, luksUUID, ""}},
+		},
+		luksStatus:    map[string]string{"/dev/vda2": "does not match rd.luks.uuid/rd.luks.name params"},
+		failedModules: []string{"ahci"},
+		unmatched:     []string{"pci:v00001B4Bd00009230sv00001B4Bsd00009230bc01sc06i01"},
+	}
+
+	report := d.format()
+	for _, s := range []string{
+		"Requested devices:\n  root=UUID=639b8fdd-36ba-443e-be3e-e5b335935502\n",
+		"  /dev/sda: unknown content, does not match root=UUID=639b8fdd-36ba-443e-be3e-e5b335935502: cannot be read: input/output error\n",
+		"  /dev/vda1: ext4 UUID=7bbf9363-eb42-4476-8c1c-9f1f4d091385 LABEL=\"root\", does not match root=UUID=639b8fdd-36ba-443e-be3e-e5b335935502: UUID 7bbf9363-eb42-4476-8c1c-9f1f4d091385 differs\n",
+		"  /dev/vda2: luks UUID=639b8fdd-36ba-443e-be3e-e5b335935502, does not match rd.luks.uuid/rd.luks.name params\n",
+		"Failed modules: ahci\n",
+		"root=UUID=639b8fdd-36ba-443e-be3e-e5b335935502 points to a LUKS container, unlock it with rd.luks.uuid=639b8fdd-36ba-443e-be3e-e5b335935502",
+		"Modules ahci failed to load",
+		"find it on the host with 'modprobe -R pci:v00001B4Bd00009230sv00001B4Bsd00009230bc01sc06i01'",
+	} {
+		if !strings.Contains(report, s) {
+			t.Fatalf("report does not contain %q:\n%s", s, report)
+		}
+	}
+
+	// nothing is found
+	d = &diagnostics{cmdline: map[string]string{"root": "/dev/sda2"}, luksStatus: map[string]string{}}
+	report = d.format()
+	for _, s := range []string{"Block devices:\n  none\n", "No block devices found", "Device /dev/sda2 does not exist"} {
+		if !strings.Contains(report, s) {
+			t.Fatalf("report does not contain %q:\n%s", s, report)
+		}
+	}
+
+	// specs matching
+	dev := &diagBlockDevice{path: "/dev/vda1", info: &blkInfo{"ext4", true, rootUUID, "root"}}
+	for spec, reason := range map[string]string{
+		"UUID=7bbf9363-eb42-4476-8c1c-9f1f4d091385": "",
+		"LABEL=root":         "",
+		"/dev/vda1":          "",
+		"LABEL=home":         `label "root" differs`,
+		"/dev/vda2":          "path differs",
+		"PARTUUID=1234-5678": "unsupported device spec",
+	} {
+		if r := specMismatch(spec, dev); r != reason {
+			t.Fatalf("%s: expected mismatch reason %q, got %q", spec, reason, r)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The boot failure policy is specified with booster.on_failure= boot param or on_failure option in booster.yaml:
+//  shell    - start busybox or the built-in rescue shell and reboot once it exits (default)
+//  reboot   - reboot the computer after a countdown
+//  poweroff - power off the computer after a countdown
+//  retry    - rescan devices a few times with a longer timeout if the root filesystem is not found, then reboot
+// The kernel panic= param is respected: if it is set then the countdown takes its value, and if the policy is not specified
+// then the computer is rebooted. The failure reason is saved to an EFI variable and pstore so the next boot can report it.
+
+const (
+	failureShell    = "shell"
+	failureReboot   = "reboot"
+	failurePoweroff = "poweroff"
+	failureRetry    = "retry"
+)
+
+const (
+	defaultRebootCountdown = 10 * time.Second
+	failureRetries         = 3
+	failureReasonMaxLen    = 256
+
+	// BoosterFailureReason-dd2c3c3e-ec9c-4b69-9b0b-3e0f5ad2b9a4, non-volatile and accessible at runtime
+	failureEfiVariable = "BoosterFailureReason-dd2c3c3e-ec9c-4b69-9b0b-3e0f5ad2b9a4"
+	efiVariableAttrs   = 0x1 | 0x2 | 0x4 // EFI_VARIABLE_NON_VOLATILE | EFI_VARIABLE_BOOTSERVICE_ACCESS | EFI_VARIABLE_RUNTIME_ACCESS
+	fsImmutableFlag    = 0x10            // FS_IMMUTABLE_FL, efivarfs sets it on the variables it does not know to be safe to modify
+)
+
+var (
+	efivarsDir = "/sys/firmware/efi/efivars"
+	pmsgDevice = "/dev/pmsg0"
+)
+
+// failurePolicy returns the action to take when the boot fails and the countdown before rebooting or powering off
+func failurePolicy() (string, time.Duration) {
+	policy := config.OnFailure
+	if p, ok := cmdlineParam("booster.on_failure"); ok {
+		policy = p
+	}
+
+	countdown := defaultRebootCountdown
+	if p, ok := cmdlineParam("panic"); ok {
+		// panic=N reboots in N seconds after a kernel panic, negative value reboots immediately and 0 disables reboot
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			warning("invalid panic=%s boot param: %v", p, err)
+		} else if n != 0 {
+			countdown = 0
+			if n > 0 {
+				countdown = time.Duration(n) * time.Second
+			}
+			if policy == "" {
+				policy = failureReboot
+			}
+		}
+	}
+
+	switch policy {
+	case "":
+		policy = failureShell
+	case failureShell, failureReboot, failurePoweroff, failureRetry:
+	default:
+		warning("invalid booster.on_failure value %s, expected shell, reboot, poweroff or retry", policy)
+		policy = failureShell
+	}
+	return policy, countdown
+}
+
+// shellRequested reports whether the shell failure policy is chosen explicitly rather than used by default
+func shellRequested() bool {
+	if p, ok := cmdlineParam("booster.on_failure"); ok {
+		return p == failureShell
+	}
+	return config.OnFailure == failureShell
+}
+
+// onBootFailure saves the failure reason and applies the failure policy. It returns if a shell needs to be started.
+func onBootFailure(err error) {
+	saveFailureReason(err)
+
+	policy, countdown := failurePolicy()
+	switch policy {
+	case failureRetry:
+		if err := retryBoot(err); err != nil {
+			severe("%v", err)
+			saveFailureReason(err)
+		}
+		rebootCountdown(countdown, unix.LINUX_REBOOT_CMD_RESTART)
+	case failureReboot:
+		rebootCountdown(countdown, unix.LINUX_REBOOT_CMD_RESTART)
+	case failurePoweroff:
+		rebootCountdown(countdown, unix.LINUX_REBOOT_CMD_POWER_OFF)
+	}
+}
+
+// retryBoot runs device discovery again doubling the mount timeout each time, it returns only if the boot still fails
+func retryBoot(err error) error {
+	timeout := time.Duration(config.MountTimeout) * time.Second
+	if timeout == 0 {
+		timeout = rescueMountTimeout
+	}
+
+	for i := 1; i <= failureRetries && errors.Is(err, errRootTimeout); i++ {
+		timeout *= 2
+		warning("retrying device discovery (%d/%d), waiting %v for the root filesystem", i, failureRetries, timeout)
+		petWatchdog()
+		// devices that appeared since the first scan are added, the known ones are matched against the boot params again
+		if err := coldplug(); err != nil {
+			warning("coldplug: %v", err)
+		}
+		rescanBlockDevices()
+		if err = waitForRoot(timeout); err == nil {
+			cleanup()
+			return switchRoot()
+		}
+	}
+	return err
+}
+
+func rebootCountdown(countdown time.Duration, cmd int) {
+	action := "Rebooting"
+	if cmd == unix.LINUX_REBOOT_CMD_POWER_OFF {
+		action = "Powering off"
+	}
+	for i := int(countdown.Seconds()); i > 0; i-- {
+		fmt.Printf("\r%s in %d seconds ", action, i)
+		time.Sleep(time.Second)
+	}
+	fmt.Println()
+	if err := rescueReboot(cmd); err != nil {
+		severe("%s failed: %v", action, err)
+	}
+}
+
+// failureReason returns a short description of the failure suitable for the non-volatile storage
+func failureReason(err error) string {
+	reason := "booster: " + err.Error()
+	if len(reason) > failureReasonMaxLen {
+		reason = reason[:failureReasonMaxLen]
+	}
+	return reason
+}
+
+// saveFailureReason stores the failure reason to the places that survive a reboot
+func saveFailureReason(err error) {
+	reason := failureReason(err)
+
+	if mountEfivars() {
+		if err := writeEfiVariable(filepath.Join(efivarsDir, failureEfiVariable), []byte(reason)); err != nil {
+			warning("unable to save the failure reason to EFI variable: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(pmsgDevice); err == nil {
+		if err := os.WriteFile(pmsgDevice, []byte(reason+"\n"), 0); err != nil {
+			warning("unable to save the failure reason to pstore: %v", err)
+		}
+	}
+}
+
+// clearFailureReason removes the reason saved by a previous failed boot once the boot succeeds. The reason is
+// printed to the log so it is still available in the booted system.
+func clearFailureReason() {
+	if !mountEfivars() {
+		return
+	}
+	path := filepath.Join(efivarsDir, failureEfiVariable)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		warning("unable to read the previous failure reason: %v", err)
+		return
+	}
+	if len(data) > 4 {
+		info("previous boot failed: %s", data[4:])
+	}
+	if err := clearImmutableFlag(path); err != nil {
+		debug("%s: %v", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		warning("unable to remove the previous failure reason: %v", err)
+	}
+}
+
+// mountEfivars makes EFI variables accessible, it returns false if the system is not booted in UEFI mode
+func mountEfivars() bool {
+	if _, err := os.Stat(filepath.Dir(efivarsDir)); err != nil {
+		return false
+	}
+	if !isMountpoint(efivarsDir) {
+		if err := mount("efivarfs", efivarsDir, "efivarfs", unix.MS_NOSUID|unix.MS_NOEXEC|unix.MS_NODEV, ""); err != nil {
+			debug("%v", err)
+		}
+	}
+	return true
+}
+
+// clearImmutableFlag makes an existing EFI variable writable, efivarfs refuses to modify or delete immutable files
+func clearImmutableFlag(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fd := int(f.Fd())
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	if flags&fsImmutableFlag == 0 {
+		return nil
+	}
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags&^fsImmutableFlag))
+}
+
+// writeEfiVariable writes the variable to efivarfs, the content is prepended with the variable attributes
+func writeEfiVariable(path string, data []byte) error {
+	// the filesystem might not support file flags (e.g. in tests), the write below reports if the file is really immutable
+	if err := clearImmutableFlag(path); err != nil {
+		debug("%s: %v", path, err)
+	}
+
+	buf := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(buf, efiVariableAttrs)
+	buf = append(buf, data...)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	// efivarfs requires the whole variable to be written with a single write() call
+	_, err = f.Write(buf)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
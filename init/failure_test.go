@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailurePolicy(t *testing.T) {
+	prevConfig, prevCmdline := config, cmdline
+	defer func() { config, cmdline = prevConfig, prevCmdline }()
+
+	check := func(configPolicy string, params map[string]string, expectedPolicy string, expectedCountdown time.Duration) {
+		t.Helper()
+		config = InitConfig{OnFailure: configPolicy}
+		cmdline = params
+		policy, countdown := failurePolicy()
+		if policy != expectedPolicy || countdown != expectedCountdown {
+			t.Fatalf("expected policy %s with %v countdown, got %s with %v", expectedPolicy, expectedCountdown, policy, countdown)
+		}
+	}
+
+	check("", map[string]string{}, failureShell, defaultRebootCountdown)
+	check("reboot", map[string]string{}, failureReboot, defaultRebootCountdown)
+	check("reboot", map[string]string{"booster.on_failure": "retry"}, failureRetry, defaultRebootCountdown)
+	check("", map[string]string{"booster.on_failure": "halt"}, failureShell, defaultRebootCountdown)
+	// panic= enables reboot unless the policy is specified explicitly
+	check("", map[string]string{"panic": "30"}, failureReboot, 30*time.Second)
+	check("", map[string]string{"panic": "-1"}, failureReboot, 0)
+	check("", map[string]string{"panic": "0"}, failureShell, defaultRebootCountdown)
+	check("shell", map[string]string{"panic": "5"}, failureShell, 5*time.Second)
+	check("", map[string]string{"booster.on_failure": "poweroff", "panic": "5"}, failurePoweroff, 5*time.Second)
+}
+
+func TestFailureReason(t *testing.T) {
+	if r := failureReason(errRootTimeout); r != "booster: Timeout waiting for root filesystem" {
+		t.Fatalf("unexpected failure reason %s", r)
+	}
+	long := fmt.Errorf("%w, failed to load modules: %s", errRootTimeout, strings.Repeat("module,", 100))
+	if r := failureReason(long); len(r) != failureReasonMaxLen {
+		t.Fatalf("failure reason is not truncated: %d bytes", len(r))
+	}
+}
+
+func TestWriteEfiVariable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), failureEfiVariable)
+	if err := writeEfiVariable(path, []byte("booster: first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEfiVariable(path, []byte("booster: second")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte("\x07\x00\x00\x00booster: second"); !bytes.Equal(data, expected) {
+		t.Fatalf("expected variable content %q, got %q", expected, data)
+	}
+}
+
+func TestClearFailureReason(t *testing.T) {
+	prevDir := efivarsDir
+	defer func() { efivarsDir = prevDir }()
+	efivarsDir = filepath.Join(t.TempDir(), "efivars")
+	if err := os.Mkdir(efivarsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(efivarsDir, failureEfiVariable)
+	if err := writeEfiVariable(path, []byte("booster: failed")); err != nil {
+		t.Fatal(err)
+	}
+	clearFailureReason()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("failure reason is not removed after a successful boot: %v", err)
+	}
+	// nothing to remove
+	clearFailureReason()
+}
+
+func TestShellRequested(t *testing.T) {
+	prevConfig, prevCmdline := config, cmdline
+	defer func() { config, cmdline = prevConfig, prevCmdline }()
+
+	check := func(configPolicy string, params map[string]string, expected bool) {
+		t.Helper()
+		config = InitConfig{OnFailure: configPolicy}
+		cmdline = params
+		if shellRequested() != expected {
+			t.Fatalf("config %q, params %v: expected shell requested %v", configPolicy, params, expected)
+		}
+	}
+	check("", map[string]string{}, false)
+	check("shell", map[string]string{}, true)
+	check("", map[string]string{"booster.on_failure": "shell"}, true)
+	check("shell", map[string]string{"booster.on_failure": "reboot"}, false)
+}
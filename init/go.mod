@@ -7,13 +7,14 @@ require (
 	github.com/anatol/devmapper.go v0.0.0-20210322024145-ba6a046aeb3d
 	github.com/anatol/luks.go v0.0.0-20210314231502-552c7e4aa186
 	github.com/anatol/uevent.go v1.0.1-0.20210327185707-f514f64e9887
+	github.com/google/go-tpm v0.3.2
 	github.com/insomniacslk/dhcp v0.0.0-20210315110227-c51060810aaa
-	github.com/lestrrat-go/jwx v1.1.5 // indirect
+	github.com/lestrrat-go/jwx v1.1.5
 	github.com/vishvananda/netlink v1.1.0
 	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f // indirect
 	github.com/yookoala/realpath v1.0.0
 	golang.org/x/crypto v0.0.0-20210317152858-513c2a44f670 // indirect
-	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4 // indirect
+	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4
 	golang.org/x/sys v0.0.0-20210317091845-390168757d9c
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
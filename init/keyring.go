@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Passphrases entered by the user are cached in the kernel user keyring the same way as systemd-ask-password does it:
+// a key of 'user' type with description 'cryptsetup' contains NUL-separated list of passphrases. The key is
+// limited in time and is available to systemd-cryptsetup after switching to the root filesystem.
+
+const (
+	passphraseKeyType        = "user"
+	passphraseKeyDescription = "cryptsetup"
+	passphraseKeyTimeout     = 150 // in seconds, the same as KEYRING_TIMEOUT_USEC in systemd
+)
+
+var passphraseCacheMutex sync.Mutex
+
+// splitPassphrases splits the keyring payload into a list of passphrases. The result refers to the payload memory.
+func splitPassphrases(payload []byte) [][]byte {
+	var result [][]byte
+	for _, p := range bytes.Split(payload, []byte{0}) {
+		if len(p) != 0 {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// appendPassphrase returns a new keyring payload with the passphrase added, or nil if the payload contains it already
+func appendPassphrase(payload, password []byte) []byte {
+	for _, p := range splitPassphrases(payload) {
+		if bytes.Equal(p, password) {
+			return nil
+		}
+	}
+
+	result := make([]byte, 0, len(payload)+len(password)+1)
+	result = append(result, payload...)
+	if len(result) != 0 && result[len(result)-1] != 0 {
+		result = append(result, 0)
+	}
+	return append(result, password...)
+}
+
+// readPassphraseKey returns the payload of the cached passphrases key, or nil if the key does not exist
+func readPassphraseKey() ([]byte, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, passphraseKeyType, passphraseKeyDescription, 0)
+	if err == unix.ENOKEY || err == unix.EKEYEXPIRED || err == unix.EKEYREVOKED {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for {
+		// the first call returns size of the payload
+		size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+		if err != nil {
+			MemZeroBytes(buf)
+			return nil, err
+		}
+		if n <= size {
+			return buf[:n], nil
+		}
+		// the key has been updated in between, retry
+		MemZeroBytes(buf)
+	}
+}
+
+// cachedPassphrases returns passphrases cached in the keyring. The caller has to zero the result with MemZeroBytes.
+func cachedPassphrases() [][]byte {
+	passphraseCacheMutex.Lock()
+	defer passphraseCacheMutex.Unlock()
+
+	payload, err := readPassphraseKey()
+	if err != nil {
+		warning("unable to read cached passphrases: %v", err)
+		return nil
+	}
+	return splitPassphrases(payload)
+}
+
+// cachePassphrase adds the passphrase to the keyring and resets the key timeout
+func cachePassphrase(password []byte) error {
+	passphraseCacheMutex.Lock()
+	defer passphraseCacheMutex.Unlock()
+
+	payload, err := readPassphraseKey()
+	if err != nil {
+		return err
+	}
+	defer MemZeroBytes(payload)
+
+	updated := appendPassphrase(payload, password)
+	if updated == nil {
+		return nil
+	}
+	defer MemZeroBytes(updated)
+
+	// adding a key with the same description updates the existing key
+	id, err := unix.AddKey(passphraseKeyType, passphraseKeyDescription, updated, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return err
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, passphraseKeyTimeout, 0, 0)
+	return err
+}
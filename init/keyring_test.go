@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPassphraseKeyPayload(t *testing.T) {
+	if p := splitPassphrases(nil); len(p) != 0 {
+		t.Fatalf("expected no passphrases, got %q", p)
+	}
+
+	payload := appendPassphrase(nil, []byte("1234"))
+	if string(payload) != "1234" {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+	payload = appendPassphrase(payload, []byte("secret"))
+	if string(payload) != "1234\x00secret" {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+	if appendPassphrase(payload, []byte("secret")) != nil {
+		t.Fatal("duplicated passphrase is added to the payload")
+	}
+
+	// systemd-ask-password might leave a trailing NUL
+	expected := [][]byte{[]byte("1234"), []byte("secret"), []byte("pass")}
+	if p := splitPassphrases([]byte("1234\x00secret\x00pass\x00")); !reflect.DeepEqual(p, expected) {
+		t.Fatalf("expected passphrases %q, got %q", expected, p)
+	}
+	if p := appendPassphrase([]byte("1234\x00"), []byte("pass")); string(p) != "1234\x00pass" {
+		t.Fatalf("unexpected payload %q", p)
+	}
+}
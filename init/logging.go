@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
 	// TOTHINK rename to debug/info/warning
 	levelSevere = iota
 	levelWarning
+	levelInfo
 	levelDebug
 )
 
@@ -16,30 +21,122 @@ var (
 	verbosityLevel = levelWarning // by default show warnings and errors
 
 	kmsg *os.File
+
+	// logs keeps every message printed by init regardless of the verbosity level
+	logs = newLogRing(logRingSize)
+)
+
+const (
+	logRingSize = 16384 // max number of messages kept in memory
+	logFile     = "/run/initramfs/booster.log"
 )
 
-func printMessage(format string, kLevel int, v ...interface{}) {
+var levelNames = map[string]int{
+	"severe":  levelSevere,
+	"error":   levelSevere,
+	"warning": levelWarning,
+	"info":    levelInfo,
+	"debug":   levelDebug,
+}
+
+// parseLogLevel converts the value of booster.log_level boot param to a verbosity level
+func parseLogLevel(name string) (int, error) {
+	level, ok := levelNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level '%s'", name)
+	}
+	return level, nil
+}
+
+type logEntry struct {
+	timestamp uint64 // monotonic clock in usec
+	level     int
+	msg       string
+}
+
+// logRing is a fixed-size circular buffer of log messages
+type logRing struct {
+	mu      sync.Mutex
+	entries []logEntry
+	next    int  // index where the next entry is going to be written
+	full    bool // set when the ring wrapped around at least once
+	dropped int  // number of messages overwritten
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{entries: make([]logEntry, size)}
+}
+
+func (r *logRing) add(level int, msg string) {
+	ts, _ := readClock(unix.CLOCK_MONOTONIC)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.full {
+		r.dropped++
+	}
+	r.entries[r.next] = logEntry{ts, level, msg}
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// ordered returns the stored messages from the oldest to the newest
+func (r *logRing) ordered() []logEntry {
+	if !r.full {
+		return r.entries[:r.next]
+	}
+	return append(r.entries[r.next:len(r.entries):len(r.entries)], r.entries[:r.next]...)
+}
+
+// format serializes the log in a dmesg-like form "[seconds.usec] message"
+func (r *logRing) format() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var buf bytes.Buffer
+	if r.dropped > 0 {
+		fmt.Fprintf(&buf, "... %d earlier messages dropped\n", r.dropped)
+	}
+	for _, e := range r.ordered() {
+		fmt.Fprintf(&buf, "[%5d.%06d] %s\n", e.timestamp/1000000, e.timestamp%1000000, e.msg)
+	}
+	return buf.Bytes()
+}
+
+// writeLogFile stores the full init log to /run/initramfs so it is available at the booted system
+func writeLogFile() error {
+	return os.WriteFile(logFile, logs.format(), 0644)
+}
+
+func printMessage(level int, kLevel int, format string, v ...interface{}) {
 	msg := fmt.Sprintf(format, v...)
+	logs.add(level, msg)
+
+	if verbosityLevel < level {
+		return
+	}
 	fmt.Println(msg)
 	_, _ = fmt.Fprint(kmsg, "<", kLevel, ">booster: ", msg)
 }
 
 func debug(format string, v ...interface{}) {
-	if verbosityLevel >= levelDebug {
-		printMessage(format, 7, v...)
-	}
+	printMessage(levelDebug, 7, format, v...)
+}
+
+func info(format string, v ...interface{}) {
+	printMessage(levelInfo, 6, format, v...)
 }
 
 func warning(format string, v ...interface{}) {
-	if verbosityLevel >= levelWarning {
-		printMessage(format, 6, v...)
-	}
+	printMessage(levelWarning, 6, format, v...)
 }
 
 func severe(format string, v ...interface{}) {
-	if verbosityLevel >= levelSevere {
-		printMessage(format, 4, v...)
-	}
+	printMessage(levelSevere, 4, format, v...)
 }
 
 const sysKmsgFile = "/proc/sys/kernel/printk_devkmsg"
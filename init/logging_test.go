@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogRing(t *testing.T) {
+	r := newLogRing(3)
+	r.add(levelDebug, "one")
+	r.add(levelWarning, "two")
+
+	out := string(r.format())
+	if !strings.Contains(out, "] one\n") || !strings.Contains(out, "] two\n") {
+		t.Fatalf("expected both messages in the log, got %q", out)
+	}
+
+	r.add(levelDebug, "three")
+	r.add(levelSevere, "four")
+	r.add(levelDebug, "five")
+
+	lines := strings.Split(strings.TrimSpace(string(r.format())), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %q", lines)
+	}
+	if lines[0] != "... 2 earlier messages dropped" {
+		t.Fatalf("expected dropped messages header, got %q", lines[0])
+	}
+	for i, msg := range []string{"three", "four", "five"} {
+		if !strings.HasSuffix(lines[i+1], "] "+msg) {
+			t.Fatalf("line %d: expected message %s, got %q", i+1, msg, lines[i+1])
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	check := func(name string, expected int) {
+		level, err := parseLogLevel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level != expected {
+			t.Fatalf("%s: expected level %d, got %d", name, expected, level)
+		}
+	}
+
+	check("debug", levelDebug)
+	check("warning", levelWarning)
+	check("info", levelInfo)
+	check("error", levelSevere)
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+}
+
+func TestInfoLevel(t *testing.T) {
+	prevLevel, prevStdout := verbosityLevel, os.Stdout
+	defer func() { verbosityLevel, os.Stdout = prevLevel, prevStdout }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	verbosityLevel = levelWarning
+	info("hidden info")
+	verbosityLevel, _ = parseLogLevel("info")
+	info("shown info")
+	debug("hidden debug")
+	warning("shown warning")
+	_ = w.Close()
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "shown info\nshown warning\n"; string(out) != expected {
+		t.Fatalf("expected output %q, got %q", expected, out)
+	}
+}
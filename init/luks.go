@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/anatol/clevis.go"
 	"github.com/anatol/luks.go"
+	"github.com/lestrrat-go/jwx/jwe"
 )
 
 // rd luks options match systemd naming https://www.freedesktop.org/software/systemd/man/crypttab.html
@@ -21,12 +24,15 @@ var rdLuksOptions = map[string]string{
 }
 
 func luksApplyFlags(d luks.Device) error {
-	param, ok := cmdline["rd.luks.options"]
+	param, ok := cmdlineParam("rd.luks.options")
 	if !ok {
 		return nil
 	}
 
 	for _, o := range strings.Split(param, ",") {
+		if strings.HasPrefix(o, "password-echo=") {
+			continue // handled by luksPasswordEcho
+		}
 		flag, ok := rdLuksOptions[o]
 		if !ok {
 			return fmt.Errorf("Unknown value in rd.luks.options: %v", o)
@@ -38,37 +44,145 @@ func luksApplyFlags(d luks.Device) error {
 	return nil
 }
 
-func luksOpen(dev string, name string) error {
-	wg := loadModules("dm_crypt")
-	wg.Wait()
+// luksPasswordEcho returns the password prompt echo mode set with rd.luks.options=password-echo=masked|no|yes
+func luksPasswordEcho() (string, error) {
+	echo := passwordEchoNo
+	for _, o := range strings.Split(cmdlineValue("rd.luks.options"), ",") {
+		if !strings.HasPrefix(o, "password-echo=") {
+			continue
+		}
+		echo = strings.TrimPrefix(o, "password-echo=")
+		switch echo {
+		case passwordEchoNo, passwordEchoMasked, passwordEchoYes:
+		default:
+			return "", fmt.Errorf("invalid password-echo value %s in rd.luks.options, expected masked, no or yes", echo)
+		}
+	}
+	return echo, nil
+}
 
-	d, err := luks.Open(dev)
-	if err != nil {
+// luksUnlocker serializes unlock attempts of the methods that run concurrently (tokens and passphrase prompt).
+// Only the first successful attempt creates the device mapper device.
+type luksUnlocker struct {
+	mutex    sync.Mutex
+	d        luks.Device
+	name     string
+	unlocked bool
+}
+
+// unlock tries the password against the slots. It returns ctx.Err() if the device has been unlocked already
+// by another method.
+func (u *luksUnlocker) unlock(ctx context.Context, slots []int, password []byte) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.unlocked {
+		return context.Canceled
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	defer d.Close()
+	for _, s := range slots {
+		err := u.d.Unlock(s, password, u.name)
+		if err == luks.ErrPassphraseDoesNotMatch {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		u.unlocked = true
+		measureString("cryptsetup", u.name+":"+u.d.Uuid())
+		return nil
+	}
+	return luks.ErrPassphraseDoesNotMatch
+}
 
-	if len(d.Slots()) == 0 {
-		return fmt.Errorf("device %s has no slots to unlock", dev)
+// default retries of a clevis token, the tang server might need time to become reachable
+var defaultTokenRetry = TokenRetryConfig{Retries: 40, Backoff: "1s"}
+
+// tokenRetry returns retry config for a clevis pin
+func tokenRetry(pin string) (int, time.Duration) {
+	conf := defaultTokenRetry
+	if c, ok := config.TokenRetry[pin]; ok && c != nil {
+		conf = *c
 	}
 
-	if err := luksApplyFlags(d); err != nil {
-		return err
+	backoff, err := time.ParseDuration(conf.Backoff)
+	if conf.Backoff == "" || err != nil {
+		backoff = time.Second
 	}
+	return conf.Retries, backoff
+}
 
-	// first try to unlock with token
-	tokens, err := d.Tokens()
-	if err != nil {
-		return err
+// clevisPin returns the pin name ('tang', 'tpm2', 'sss') of a clevis bound message
+func clevisPin(payload []byte) string {
+	msg, err := jwe.Parse(payload)
+	if err != nil || len(msg.Recipients()) == 0 {
+		return ""
 	}
-	for _, t := range tokens {
-		if t.Type != luks.ClevisTokenType {
-			continue
+	node, _ := msg.Recipients()[0].Headers().PrivateParams()["clevis"].(map[string]interface{})
+	pin, _ := node["pin"].(string)
+	return pin
+}
+
+// clevisDecryptFn is replaced in tests
+var clevisDecryptFn = clevis.Decrypt
+
+type clevisResult struct {
+	password []byte
+	err      error
+}
+
+// clevisDecryptOnce decrypts the payload. The decryption (e.g. a request to an unreachable tang server) cannot be
+// interrupted, so if ctx is cancelled it returns right away and the late result is discarded.
+func clevisDecryptOnce(ctx context.Context, payload []byte) ([]byte, error) {
+	result := make(chan clevisResult, 1)
+	go func() {
+		password, err := clevisDecryptFn(payload)
+		result <- clevisResult{password, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.password, r.err
+	case <-ctx.Done():
+		go func() {
+			r := <-result
+			MemZeroBytes(r.password)
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// clevisDecrypt decrypts the payload retrying on errors (e.g. network errors) until ctx is cancelled
+func clevisDecrypt(ctx context.Context, payload []byte) ([]byte, error) {
+	pin := clevisPin(payload)
+	retries, backoff := tokenRetry(pin)
+
+	for i := 0; ; i++ {
+		password, err := clevisDecryptOnce(ctx, payload)
+		if err == nil {
+			return password, nil
 		}
+		if i >= retries {
+			return nil, err
+		}
+		warning("%v", err)
 
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// luksUnlockTokens tries to unlock the device with clevis tokens
+func luksUnlockTokens(ctx context.Context, u *luksUnlocker, tokens []luks.Token) error {
+	for _, t := range tokens {
 		var payload []byte
 		// Note that token metadata stored differently in LUKS v1 and v2
-		if d.Version() == 1 {
+		if u.d.Version() == 1 {
 			payload = t.Payload
 		} else {
 			var node struct {
@@ -81,66 +195,176 @@ func luksOpen(dev string, name string) error {
 			payload = node.Jwe
 		}
 
-		// in case of a (network) error retry it several times. or maybe retry logic needs to be inside the clevis itself?
-		var password []byte
-		for i := 0; i < 40; i++ {
-			password, err = clevis.Decrypt(payload)
-			if err == nil {
-				break
-			} else {
-				warning("%v", err)
-				time.Sleep(time.Second)
-			}
-		}
+		// clevis might seal the key to the PCR with booster measurements, they need to be extended first
+		flushMeasurements()
 
-		for _, s := range t.Slots {
-			err = d.Unlock(s, password, name)
-			if err == luks.ErrPassphraseDoesNotMatch {
-				continue
-			}
+		// tang servers might be reachable through the tunnel only
+		waitForWireguard(ctx, 30*time.Second)
+
+		password, err := clevisDecrypt(ctx, payload)
+		if ctx.Err() != nil {
 			MemZeroBytes(password)
-			return err
+			return ctx.Err()
+		}
+		if err != nil {
+			warning("%v", err)
+			continue
 		}
+
+		err = u.unlock(ctx, t.Slots, password)
 		MemZeroBytes(password)
+		if err == luks.ErrPassphraseDoesNotMatch {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("%s: unable to unlock the device with tokens", u.name)
+}
+
+// luksUnlockCached tries passphrases cached in the kernel keyring, e.g. the ones used for other devices
+func luksUnlockCached(ctx context.Context, u *luksUnlocker) error {
+	cached := cachedPassphrases()
+	defer func() {
+		for _, p := range cached {
+			MemZeroBytes(p)
+		}
+	}()
+
+	for _, p := range cached {
+		err := u.unlock(ctx, u.d.Slots(), p)
+		if err != luks.ErrPassphraseDoesNotMatch {
+			return err
+		}
+	}
+	return luks.ErrPassphraseDoesNotMatch
+}
+
+// luksUnlockPassphrase asks user for a passphrase until it unlocks the device or ctx is cancelled
+func luksUnlockPassphrase(ctx context.Context, u *luksUnlocker) error {
+	// while the prompt waits in the queue the user might enter a passphrase for another device that fits this one too
+	var cachedErr error
+	tryCached := func() bool {
+		cachedErr = luksUnlockCached(ctx, u)
+		if cachedErr == nil {
+			debug("%s is unlocked with a cached passphrase", u.name)
+		}
+		return cachedErr != luks.ErrPassphraseDoesNotMatch
 	}
 
-	// tokens did not work, let's unlock with a password
+	echo, err := luksPasswordEcho()
+	if err != nil {
+		return err
+	}
+
+	message := "Enter passphrase for " + u.name + ":"
 	for {
-		fmt.Print("Enter passphrase for ", name, ":")
-		password, err := readPassword()
+		password, err := askPassword(ctx, message, echo, tryCached)
+		if err == errPromptSkipped {
+			return cachedErr
+		}
 		if err != nil {
 			return err
 		}
+		tryCached = nil
 		if len(password) == 0 {
-			fmt.Println("")
 			continue
 		}
 
-		for _, s := range d.Slots() {
-			err = d.Unlock(s, password, name)
-			if err == luks.ErrPassphraseDoesNotMatch {
-				continue
+		err = u.unlock(ctx, u.d.Slots(), password)
+		if err == nil {
+			// other devices and systemd-cryptsetup try the cached passphrases before asking user
+			if err := cachePassphrase(password); err != nil {
+				warning("unable to cache passphrase in the kernel keyring: %v", err)
 			}
-			MemZeroBytes(password)
-			return err
 		}
-
 		// zeroify the password so we do not keep the sensitive data in the memory
 		MemZeroBytes(password)
+		if err != luks.ErrPassphraseDoesNotMatch {
+			return err
+		}
 
 		// retry password
-		fmt.Println("   incorrect passphrase, please try again")
+		message = "Incorrect passphrase, please try again\nEnter passphrase for " + u.name + ":"
+	}
+}
+
+func luksOpen(dev string, name string) error {
+	if err := loadModules("dm_crypt").Wait(); err != nil {
+		// dm_crypt might be compiled into the kernel, let the device mapper report the problem if it is really missing
+		warning("%v", err)
+	}
+
+	d, err := luks.Open(dev)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if len(d.Slots()) == 0 {
+		return fmt.Errorf("device %s has no slots to unlock", dev)
+	}
+
+	if err := luksApplyFlags(d); err != nil {
+		return err
 	}
+
+	tokens, err := d.Tokens()
+	if err != nil {
+		return err
+	}
+	var clevisTokens []luks.Token
+	for _, t := range tokens {
+		if t.Type == luks.ClevisTokenType {
+			clevisTokens = append(clevisTokens, t)
+		}
+	}
+
+	// tokens and the passphrase prompt race with each other, the first method that unlocks the device cancels the other one
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	u := &luksUnlocker{d: d, name: name}
+
+	results := make(chan error, 2)
+	methods := 1
+	if len(clevisTokens) > 0 {
+		methods++
+		go func() { results <- luksUnlockTokens(ctx, u, clevisTokens) }()
+	}
+	go func() { results <- luksUnlockPassphrase(ctx, u) }()
+
+	// wait for all the methods as they use the device
+	var errs []string
+	skipped := false
+	for ; methods > 0; methods-- {
+		err := <-results
+		if err == nil {
+			cancel()
+		} else if err == errPasswordSkipped {
+			// user does not want to unlock the device, stop the tokens as well
+			skipped = true
+			cancel()
+		} else if err != context.Canceled {
+			warning("%v", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if u.unlocked {
+		return nil
+	}
+	if skipped {
+		return errPasswordSkipped
+	}
+	return fmt.Errorf("unable to unlock %s: %s", dev, strings.Join(errs, "; "))
 }
 
 func handleLuksBlockDevice(info *blkInfo, devpath string) error {
 	var name string
 	var matches bool
 
-	if param, ok := cmdline["rd.luks.name"]; ok {
+	if param, ok := cmdlineParam("rd.luks.name"); ok {
 		parts := strings.Split(param, "=")
 		if len(parts) != 2 {
-			return fmt.Errorf("invalid rd.luks.name kernel parameter %s, expected format rd.luks.name=<UUID>=<name>", cmdline["rd.luks.name"])
+			return fmt.Errorf("invalid rd.luks.name kernel parameter %s, expected format rd.luks.name=<UUID>=<name>", cmdlineValue("rd.luks.name"))
 		}
 		uuid, err := parseUUID(stripQuotes(parts[0]))
 		if err != nil {
@@ -150,7 +374,7 @@ func handleLuksBlockDevice(info *blkInfo, devpath string) error {
 			matches = true
 			name = parts[1]
 		}
-	} else if uuid, ok := cmdline["rd.luks.uuid"]; ok {
+	} else if uuid, ok := cmdlineParam("rd.luks.uuid"); ok {
 		stripped := stripQuotes(uuid)
 		u, err := parseUUID(stripped)
 		if err != nil {
@@ -162,14 +386,23 @@ func handleLuksBlockDevice(info *blkInfo, devpath string) error {
 		}
 	}
 	if matches {
+		diagSetLuksStatus(devpath, "waiting to be unlocked as "+name)
 		go func() {
 			// opening a luks device is a slow operation, run it in a separate goroutine
-			if err := luksOpen(devpath, name); err != nil {
+			err := luksOpen(devpath, name)
+			if err == errPasswordSkipped {
+				warning("unlocking of %s is skipped by user", name)
+				diagSetLuksStatus(devpath, "unlocking is skipped by user")
+			} else if err != nil {
 				severe("%v", err)
+				diagSetLuksStatus(devpath, "unlocking failed: "+err.Error())
+			} else {
+				diagSetLuksStatus(devpath, "unlocked as "+name)
 			}
 		}()
 	} else {
 		debug("luks device %s does not match rd.luks.xx param", devpath)
+		diagSetLuksStatus(devpath, "does not match rd.luks.uuid/rd.luks.name params")
 	}
 	return nil
 }
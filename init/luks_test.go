@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anatol/luks.go"
+)
+
+// clevisMessage creates a compact JWE message with the given clevis pin, the content is not encrypted
+func clevisMessage(pin string) []byte {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"dir","enc":"A256GCM","clevis":{"pin":"` + pin + `"}}`))
+	part := base64.RawURLEncoding.EncodeToString([]byte("x"))
+	return []byte(header + ".." + part + "." + part + "." + part)
+}
+
+func TestClevisPin(t *testing.T) {
+	for _, pin := range []string{"tang", "tpm2", "sss"} {
+		if p := clevisPin(clevisMessage(pin)); p != pin {
+			t.Fatalf("expected pin %s, got %s", pin, p)
+		}
+	}
+	if p := clevisPin([]byte("garbage")); p != "" {
+		t.Fatalf("expected no pin for invalid message, got %s", p)
+	}
+}
+
+func TestTokenRetry(t *testing.T) {
+	prevConfig := config
+	defer func() { config = prevConfig }()
+
+	config = InitConfig{TokenRetry: map[string]*TokenRetryConfig{
+		"tpm2": {},
+		"tang": {Retries: 5, Backoff: "200ms"},
+	}}
+	check := func(pin string, expectedRetries int, expectedBackoff time.Duration) {
+		retries, backoff := tokenRetry(pin)
+		if retries != expectedRetries || backoff != expectedBackoff {
+			t.Fatalf("%s: expected %d retries with %v backoff, got %d with %v", pin, expectedRetries, expectedBackoff, retries, backoff)
+		}
+	}
+	check("tang", 5, 200*time.Millisecond)
+	check("tpm2", 0, time.Second)
+	check("sss", 40, time.Second)
+}
+
+func TestLuksPasswordEcho(t *testing.T) {
+	prevCmdline := cmdline
+	defer func() { cmdline = prevCmdline }()
+
+	check := func(options, expected string) {
+		t.Helper()
+		cmdline = map[string]string{"rd.luks.options": options}
+		echo, err := luksPasswordEcho()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if echo != expected {
+			t.Fatalf("rd.luks.options=%s: expected echo %s, got %s", options, expected, echo)
+		}
+	}
+	check("", passwordEchoNo)
+	check("discard", passwordEchoNo)
+	check("discard,password-echo=masked", passwordEchoMasked)
+	check("password-echo=yes,no-read-workqueue", passwordEchoYes)
+
+	cmdline = map[string]string{"rd.luks.options": "password-echo=asterisk"}
+	if _, err := luksPasswordEcho(); err == nil {
+		t.Fatal("expected an error for invalid password-echo value")
+	}
+}
+
+// fakeLuksDevice unlocks with password "1234" only
+type fakeLuksDevice struct {
+	luks.Device
+	mutex    sync.Mutex
+	unlocked int
+}
+
+func (d *fakeLuksDevice) Unlock(keyslot int, passphrase []byte, dmName string) error {
+	if string(passphrase) != "1234" {
+		return luks.ErrPassphraseDoesNotMatch
+	}
+	d.mutex.Lock()
+	d.unlocked++
+	d.mutex.Unlock()
+	return nil
+}
+
+func (d *fakeLuksDevice) Uuid() string {
+	return "3756ba2c-1505-4283-8f0b-b1d1bd7b844f"
+}
+
+func TestLuksUnlocker(t *testing.T) {
+	d := &fakeLuksDevice{}
+	u := &luksUnlocker{d: d, name: "cryptroot"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := u.unlock(ctx, []int{0, 1}, []byte("wrong")); err != luks.ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected passphrase mismatch, got %v", err)
+	}
+
+	// concurrent methods, only one of them creates the device
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := u.unlock(ctx, []int{0}, []byte("1234")); err == nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if !u.unlocked || d.unlocked != 1 {
+		t.Fatalf("expected the device unlocked once, got %d", d.unlocked)
+	}
+}
+
+func TestClevisDecryptCancel(t *testing.T) {
+	prevDecrypt := clevisDecryptFn
+	defer func() { clevisDecryptFn = prevDecrypt }()
+
+	// the tang server does not respond
+	release := make(chan struct{})
+	defer close(release)
+	clevisDecryptFn = func([]byte) ([]byte, error) {
+		<-release
+		return []byte("1234"), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := clevisDecrypt(ctx, clevisMessage("tang")); err != context.DeadlineExceeded {
+		t.Fatalf("expected the decryption cancelled, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("cancelled decryption returned after %v", d)
+	}
+
+	ctx = context.Background()
+	clevisDecryptFn = func([]byte) ([]byte, error) { return []byte("1234"), nil }
+	if p, err := clevisDecrypt(ctx, clevisMessage("tang")); err != nil || string(p) != "1234" {
+		t.Fatalf("unexpected decryption result %q: %v", p, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -26,18 +27,68 @@ const (
 
 var (
 	cmdline = make(map[string]string)
+	// some params (e.g. ip= or nameserver=) can be specified multiple times, cmdlineList preserves all their values
+	cmdlineList = make(map[string][]string)
+	// the rescue shell modifies boot params while the device handlers read them, cmdlineMutex guards both maps
+	cmdlineMutex sync.RWMutex
 	// all boot params (from cmdline) that look like module.name=value considered as potential module parameters for 'module'
 	// it preserved to moduleParams for later use. cmdline is not modified.
 	moduleParams            = make(map[string][]string)
 	rootMounted             sync.WaitGroup // waits until the root partition is mounted
+	rootMountedOnce         sync.Once      // the root might be mounted manually from the rescue shell
 	concurrentModuleLoading = true
 )
 
 func parseCmdline() error {
+	if err := readCmdline(); err != nil {
+		return err
+	}
+
+	if _, ok := cmdlineParam("booster.debug"); ok {
+		verbosityLevel = levelDebug
+	} else if _, ok := cmdlineParam("quiet"); ok {
+		verbosityLevel = levelSevere
+	}
+
+	// booster.log_level changes the console verbosity only, the log file at /run/initramfs always contains all messages
+	if name, ok := cmdlineParam("booster.log_level"); ok {
+		if level, err := parseLogLevel(name); err == nil {
+			verbosityLevel = level
+		} else {
+			warning("booster.log_level: %v", err)
+		}
+	}
+
+	if verbosityLevel >= levelDebug {
+		// booster debug generates a lot of kmsg logs, to be able to preserve all these logs we disable kmsg throttling
+		if err := disableKmsgThrottling(); err != nil {
+			// user might set 'printk.devkmsg' param and it disables changing the throttling level
+			// in this case ignore the error
+			debug("%v", err)
+		}
+	}
+
+	if _, ok := cmdlineParam("booster.disable_concurrent_module_loading"); ok {
+		concurrentModuleLoading = false
+	}
+	if _, ok := cmdlineParam("booster.disable_concurrent_coldplug"); ok {
+		concurrentColdplug = false
+	}
+
+	parseModuleBlacklist()
+
+	return parseVerityCmdline()
+}
+
+// readCmdline splits the boot params into cmdline, cmdlineList and moduleParams
+func readCmdline() error {
 	b, err := os.ReadFile("/proc/cmdline")
 	if err != nil {
 		return err
 	}
+	cmdlineMutex.Lock()
+	defer cmdlineMutex.Unlock()
+
 	parts := strings.Split(strings.TrimSpace(string(b)), " ")
 	for _, part := range parts {
 		// separate key/value based on the first = character;
@@ -45,6 +96,7 @@ func parseCmdline() error {
 		if idx := strings.IndexByte(part, '='); idx > -1 {
 			key, val := part[:idx], part[idx+1:]
 			cmdline[key] = val
+			cmdlineList[key] = append(cmdlineList[key], val)
 
 			if dot := strings.IndexByte(key, '.'); dot != -1 {
 				// this param looks like a module options
@@ -56,25 +108,47 @@ func parseCmdline() error {
 			cmdline[part] = ""
 		}
 	}
+	return nil
+}
 
-	if _, ok := cmdline["booster.debug"]; ok {
-		verbosityLevel = levelDebug
+// cmdlineParam returns the boot param value and whether the param is specified
+func cmdlineParam(key string) (string, bool) {
+	cmdlineMutex.RLock()
+	defer cmdlineMutex.RUnlock()
+	v, ok := cmdline[key]
+	return v, ok
+}
 
-		// booster debug generates a lot of kmsg logs, to be able to preserve all these logs we disable kmsg throttling
-		if err := disableKmsgThrottling(); err != nil {
-			// user might set 'printk.devkmsg' param and it disables changing the throttling level
-			// in this case ignore the error
-			debug("%v", err)
-		}
-	} else if _, ok := cmdline["quiet"]; ok {
-		verbosityLevel = levelSevere
-	}
+// cmdlineValue returns the boot param value, empty if the param is not specified
+func cmdlineValue(key string) string {
+	v, _ := cmdlineParam(key)
+	return v
+}
 
-	if _, ok := cmdline["booster.disable_concurrent_module_loading"]; ok {
-		concurrentModuleLoading = false
-	}
+// cmdlineValues returns all values of a boot param that can be specified multiple times
+func cmdlineValues(key string) []string {
+	cmdlineMutex.RLock()
+	defer cmdlineMutex.RUnlock()
+	return cmdlineList[key]
+}
 
-	return nil
+// setCmdlineParam overrides all values of the boot param
+func setCmdlineParam(key, val string) {
+	cmdlineMutex.Lock()
+	defer cmdlineMutex.Unlock()
+	cmdline[key] = val
+	cmdlineList[key] = []string{val}
+}
+
+// cmdlineSnapshot returns a copy of the boot params
+func cmdlineSnapshot() map[string]string {
+	cmdlineMutex.RLock()
+	defer cmdlineMutex.RUnlock()
+	result := make(map[string]string, len(cmdline))
+	for k, v := range cmdline {
+		result[k] = v
+	}
+	return result
 }
 
 var (
@@ -97,22 +171,38 @@ func addBlockDevice(devname string) error {
 
 	debug("found a new device %s", devname)
 
-	cmdroot := cmdline["root"]
-
 	devpath := path.Join("/dev", devname)
 	info, err := readBlkInfo(devpath)
+	// the udev database describes only the content that is really detected
+	udevInfo := info
 	if err == errUnknownBlockType {
 		// provide a fake blkid with fs type specified by user
 		info = &blkInfo{
-			format: cmdline["rootfstype"],
+			format: cmdlineValue("rootfstype"),
 			isFs:   true,
 		}
-		debug("unable to detect fs type for %s, using one specified by rootfstype boot param %s", devpath, cmdline["rootfstype"])
+		udevInfo = nil
+		debug("unable to detect fs type for %s, using one specified by rootfstype boot param %s", devpath, cmdlineValue("rootfstype"))
 	} else if err != nil {
+		diagAddBlockDevice(devpath, nil, err)
+		// device mapper devices still need their record, e.g. DM_UDEV_PRIMARY_SOURCE_FLAG
+		if err := updateUdevDb(devpath, nil); err != nil {
+			warning("unable to update udev database for %s: %v", devpath, err)
+		}
 		return fmt.Errorf("%s: %v", devpath, err)
 	}
+	diagAddBlockDevice(devpath, info, nil)
+
+	if err := updateUdevDb(devpath, udevInfo); err != nil {
+		warning("unable to update udev database for %s: %v", devpath, err)
+	}
 
-	if cmdresume, ok := cmdline["resume"]; ok {
+	// verity data and hash devices are not used directly
+	if handled, err := handleVerityBlockDevice(devpath, info); handled || err != nil {
+		return err
+	}
+
+	if cmdresume, ok := cmdlineParam("resume"); ok {
 		if cmdresume == devpath || blkIdMatches(cmdresume, info) {
 			if err := resume(devpath); err != nil {
 				return err
@@ -120,6 +210,12 @@ func addBlockDevice(devname string) error {
 		}
 	}
 
+	return matchBlockDevice(devpath, info)
+}
+
+// matchBlockDevice compares the device with root= and rd.luks.* boot params and mounts or unlocks it
+func matchBlockDevice(devpath string, info *blkInfo) error {
+	cmdroot := cmdlineValue("root")
 	matchesRoot := devpath == cmdroot || blkIdMatches(cmdroot, info)
 
 	if matchesRoot {
@@ -195,28 +291,41 @@ func fsck(dev string) error {
 }
 
 func mountRootFs(dev, fstype string) error {
-	wg := loadModules(fstype)
-	wg.Wait()
+	if err := loadModules(fstype).Wait(); err != nil {
+		// the filesystem might be compiled into the kernel, let mount() report the problem if it is really missing
+		warning("%v", err)
+	}
 
-	if err := fsck(dev); err != nil {
+	stopWatchdog := keepWatchdogAlive()
+	err := fsck(dev)
+	stopWatchdog()
+	if err != nil {
 		return err
 	}
 
-	rootMountFlags, options := sunderMountFlags(cmdline["rootflags"])
-	if _, ro := cmdline["ro"]; ro {
+	rootMountFlags, options := sunderMountFlags(cmdlineValue("rootflags"))
+	if _, ro := cmdlineParam("ro"); ro {
 		rootMountFlags |= unix.MS_RDONLY
 	}
-	if _, rw := cmdline["rw"]; rw {
+	if _, rw := cmdlineParam("rw"); rw {
 		rootMountFlags &^= unix.MS_RDONLY
 	}
+	if isVerityDevice(dev) {
+		rootMountFlags |= unix.MS_RDONLY
+	}
 	if err := mount(dev, newRoot, fstype, rootMountFlags, options); err != nil {
 		return err
 	}
 
-	rootMounted.Done()
+	markRootMounted()
 	return nil
 }
 
+// markRootMounted signals that the root filesystem is mounted at newRoot
+func markRootMounted() {
+	rootMountedOnce.Do(rootMounted.Done)
+}
+
 // sunderMountFlags separates list of mount parameters (usually provided by a user) into `flags` and `options`
 // consumable by mount() functions.
 // for example 'noatime,user_xattr,nodev,nobarrier' becomes MS_NOATIME|MS_NODEV and 'user_xattr,nobarrier'
@@ -404,6 +513,19 @@ func deleteRamfs() error {
 
 // https://github.com/mirror/busybox/blob/9aa751b08ab03d6396f86c3df77937a19687981b/util-linux/switch_root.c#L297
 func switchRoot() error {
+	measureLeaveInitrd()
+	clearFailureReason()
+
+	// save the log before /run is moved to the new root
+	if err := writeLogFile(); err != nil {
+		warning("unable to write log file %s: %v", logFile, err)
+	}
+	if config.ShutdownHelper {
+		if err := prepareShutdownHelper(); err != nil {
+			warning("unable to install shutdown helper: %v", err)
+		}
+	}
+
 	if err := moveSlashRunMountpoint(); err != nil {
 		return err
 	}
@@ -454,6 +576,8 @@ func switchRoot() error {
 		initArgs = append(initArgs, "--switched-root", "--system", "--deserialize", strconv.Itoa(fd))
 	}
 
+	handOverWatchdog()
+
 	// Run the OS init
 	debug("Switching to the new userspace now. Да пабачэння!")
 	if err := unix.Exec(newInitBin, initArgs, nil); err != nil {
@@ -463,69 +587,19 @@ func switchRoot() error {
 }
 
 // Cleanup the state before handing off the machine to the new init
-func cleanup() {
-	// We need to close our uevent connection, otherwise it will stay open forever and mess with the new init. .
-	// See https://github.com/s-urbaniak/uevent/pull/1 and https://github.com/anatol/booster/issues/22
-	// _ = udevReader.Close()
-
-	shutdownNetwork()
-}
-
-func scanSysBlock() error {
-	devs, err := os.ReadDir("/sys/block")
-	if err != nil {
-		return err
-	}
-	for _, d := range devs {
-		target := filepath.Join("/sys/block/", d.Name())
-		if err := addBlockDevice(d.Name()); err != nil {
-			// even if it fails to find UUID here (e.g. in case of unsupported partition table)
-			// we still want to check its partitions
-			return err
-		}
-
-		// Probe all partitions of this block device, too:
-		parts, err := os.ReadDir(target)
-		if err != nil {
-			return err
-		}
-		for _, p := range parts {
-			// partition name should start with the same prefix as the device itself
-			if !strings.HasPrefix(p.Name(), d.Name()) {
-				continue
-			}
-			if err := addBlockDevice(p.Name()); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
+var cleanupOnce sync.Once
 
-func scanSysModaliases(path string, info os.FileInfo, err error) error {
-	if err != nil {
-		return err
-	}
-	if info.IsDir() {
-		return nil
-	}
-	if info.Name() != "modalias" {
-		return nil
-	}
-
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return err
-	}
-	alias := strings.TrimSpace(string(b))
-	if alias == "" {
-		return nil
-	}
-	if err := loadModalias(alias); err != nil {
-		debug("%v", err)
-	}
-
-	return nil
+// cleanup releases initramfs resources before switching root. It runs only once as switching root
+// might be retried from the rescue shell.
+func cleanup() {
+	cleanupOnce.Do(func() {
+		// We need to close our uevent connection, otherwise it will stay open forever and mess with the new init. .
+		// See https://github.com/s-urbaniak/uevent/pull/1 and https://github.com/anatol/booster/issues/22
+		// _ = udevReader.Close()
+
+		shutdownNetwork()
+		restoreModprobeHelper()
+	})
 }
 
 func boost() error {
@@ -581,36 +655,88 @@ func boost() error {
 	if err := parseCmdline(); err != nil {
 		return err
 	}
+	measureBootInputs()
+	openWatchdog()
+
+	if err := parseNetworkCmdline(); err != nil {
+		return err
+	}
 
 	if err := configureVirtualConsole(); err != nil {
 		return err
 	}
 
+	// the kernel requests modules (e.g. crypto algorithms) through the modprobe helper
+	if err := registerModprobeHelper(); err != nil {
+		warning("unable to register modprobe helper: %v", err)
+	}
+
 	rootMounted.Add(1)
+	if hasVerityUsr() {
+		usrMounted.Add(1)
+	}
 
 	go udevListener()
 
 	_ = loadModules(config.ModulesForceLoad...)
 
-	if err := filepath.Walk("/sys/devices", scanSysModaliases); err != nil {
+	// rd.driver.pre= modules are loaded before any device is processed
+	if pre := cmdlineModules("rd.driver.pre"); len(pre) > 0 {
+		loaded := make(chan error, 1)
+		go func() { loaded <- loadModules(pre...).Wait() }()
+		select {
+		case err := <-loaded:
+			if err != nil {
+				warning("rd.driver.pre: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			warning("timeout waiting for rd.driver.pre modules %v", pre)
+		}
+	}
+
+	if err := coldplug(); err != nil {
 		return err
 	}
-	if err := scanSysBlock(); err != nil {
+
+	// rd.driver.post= modules are loaded after the devices present at boot are handled
+	_ = loadModules(cmdlineModules("rd.driver.post")...)
+
+	if err := waitForRoot(time.Duration(config.MountTimeout) * time.Second); err != nil {
 		return err
 	}
 
-	if config.MountTimeout != 0 {
-		timeout := waitTimeout(&rootMounted, time.Duration(config.MountTimeout)*time.Second)
-		if timeout {
-			return fmt.Errorf("Timeout waiting for root filesystem")
+	cleanup()
+	return switchRoot()
+}
+
+var errRootTimeout = errors.New("Timeout waiting for root filesystem")
+
+// waitForRoot waits until the root filesystem (and /usr if it is protected by dm-verity) is mounted.
+// Zero timeout means waiting forever.
+func waitForRoot(timeout time.Duration) error {
+	if timeout != 0 {
+		if waitTimeout(&rootMounted, timeout) {
+			reportRootNotFound()
+			if failed := failedModules(); len(failed) > 0 {
+				return fmt.Errorf("%w, failed to load modules: %s", errRootTimeout, strings.Join(failed, ", "))
+			}
+			return errRootTimeout
 		}
 	} else {
 		// wait for mount forever
 		rootMounted.Wait()
 	}
 
-	cleanup()
-	return switchRoot()
+	if hasVerityUsr() {
+		if timeout != 0 && waitTimeout(&usrMounted, timeout) {
+			return fmt.Errorf("Timeout waiting for /usr filesystem")
+		}
+		usrMounted.Wait()
+		if usrMountErr != nil {
+			return usrMountErr
+		}
+	}
+	return nil
 }
 
 var config InitConfig
@@ -664,6 +790,15 @@ func reboot() {
 }
 
 func main() {
+	if filepath.Base(os.Args[0]) == modprobeName {
+		// the kernel asks for a module
+		os.Exit(modprobeMain(os.Args[1:]))
+	}
+	if filepath.Base(os.Args[0]) == shutdownName {
+		// systemd-shutdown returned to the initramfs
+		shutdownMain(os.Args[1:])
+	}
+
 	readStartTime()
 
 	if err := checkIfInitrd(); err != nil {
@@ -674,10 +809,20 @@ func main() {
 	if err := boost(); err != nil {
 		// if it does then it indicates some problem
 		severe("%v", err)
+		onBootFailure(err)
 	}
+	if shellRequested() {
+		// the user asked for a shell, do not reset the computer under them
+		disarmWatchdog()
+	}
+	// a pending passphrase prompt would keep the console in raw mode and steal the shell input
+	cancelPrompts()
 	emergencyShell()
 
-	// if we are here then emergency shell did not launch
+	// busybox is not available, fall back to the built-in commands
+	rescueShell()
+
+	// if we are here then the console input is closed
 	// in this case suggest user to reboot the computer
 	reboot()
 }
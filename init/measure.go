@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Init measures the boot inputs into a dedicated TPM PCR (config.MeasurePCR) so secrets can be sealed to the initrd
+// phase of a known configuration. The measured events are the phase markers (the same strings as systemd-pcrphase uses),
+// the kernel command line, the init config and the identities of the unlocked LUKS volumes.
+// Every measurement is recorded to an event log in TCG Canonical Event Log (CEL-JSON) format for remote attestation.
+// The TPM device appears once its driver is loaded, the events measured before that are queued.
+
+const tpmDevice = "/dev/tpmrm0"
+
+var (
+	pcrLogFile = "/run/log/booster-pcr.log"
+	// how long init waits for the TPM driver at switch root if there are pending measurements
+	tpmWaitTimeout = 10 * time.Second
+)
+
+// hash algorithms of PCR banks that init can extend
+var pcrBankHashes = map[tpm2.Algorithm]string{
+	tpm2.AlgSHA1:   "sha1",
+	tpm2.AlgSHA256: "sha256",
+	tpm2.AlgSHA384: "sha384",
+	tpm2.AlgSHA512: "sha512",
+}
+
+type pcrEvent struct {
+	eventType string // e.g. phase, kernel-cmdline, config, cryptsetup
+	content   string // human readable description of the measured data
+	data      []byte
+}
+
+type pcrDigest struct {
+	HashAlg string `json:"hashAlg"`
+	Digest  string `json:"digest"`
+}
+
+type pcrLogContent struct {
+	EventType string `json:"eventType"`
+	String    string `json:"string"`
+}
+
+// pcrLogRecord is a CEL-JSON record, one per line
+type pcrLogRecord struct {
+	RecNum      int           `json:"recnum"`
+	PCR         int           `json:"pcr"`
+	Digests     []pcrDigest   `json:"digests"`
+	ContentType string        `json:"content_type"`
+	Content     pcrLogContent `json:"content"`
+}
+
+var (
+	measureMutex        sync.Mutex
+	pendingEvents       []pcrEvent
+	measuredEvents      int
+	leaveInitrdMeasured bool
+)
+
+// measure extends the PCR with the data. If the TPM is not available yet the event is measured later.
+func measure(eventType, content string, data []byte) {
+	if config.MeasurePCR == 0 {
+		return
+	}
+
+	measureMutex.Lock()
+	defer measureMutex.Unlock()
+
+	pendingEvents = append(pendingEvents, pcrEvent{eventType, content, data})
+	if err := flushMeasurementsLocked(); err != nil {
+		warning("measure %s: %v", eventType, err)
+	}
+}
+
+// measureString measures the string itself, e.g. a phase marker
+func measureString(eventType, s string) {
+	measure(eventType, s, []byte(s))
+}
+
+// measureLeaveInitrd measures the end of the initrd phase right before switching root. Secrets sealed to the initrd phase
+// must not be unsealable after that, so init waits for the TPM if the events are still pending. The phase is measured only once
+// even if switching root is retried.
+func measureLeaveInitrd() {
+	if config.MeasurePCR == 0 {
+		return
+	}
+
+	measureMutex.Lock()
+	defer measureMutex.Unlock()
+
+	if leaveInitrdMeasured {
+		return
+	}
+	leaveInitrdMeasured = true
+	pendingEvents = append(pendingEvents, pcrEvent{"phase", "leave-initrd", []byte("leave-initrd")})
+
+	deadline := time.Now().Add(tpmWaitTimeout)
+	for {
+		if err := flushMeasurementsLocked(); err != nil {
+			severe("measure: %v, PCR %d does not reflect the end of the initrd phase", err, config.MeasurePCR)
+			return
+		}
+		if len(pendingEvents) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			severe("TPM %s is not available, %d measurements including leave-initrd are not extended into PCR %d", tpmDevice, len(pendingEvents), config.MeasurePCR)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// flushMeasurements measures the queued events if the TPM is available
+func flushMeasurements() {
+	if config.MeasurePCR == 0 {
+		return
+	}
+
+	measureMutex.Lock()
+	defer measureMutex.Unlock()
+
+	if err := flushMeasurementsLocked(); err != nil {
+		warning("measure: %v", err)
+	}
+}
+
+func flushMeasurementsLocked() error {
+	if len(pendingEvents) == 0 {
+		return nil
+	}
+
+	dev, err := tpm2.OpenTPM(tpmDevice)
+	if os.IsNotExist(err) {
+		debug("TPM is not available yet, %d events are pending", len(pendingEvents))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	pcr := config.MeasurePCR
+	banks, err := tpmPCRBanks(dev, pcr)
+	if err != nil {
+		return err
+	}
+
+	for len(pendingEvents) > 0 {
+		ev := pendingEvents[0]
+		digests, err := extendPCR(dev, pcr, banks, ev.data)
+		if err != nil {
+			return fmt.Errorf("extending PCR %d: %v", pcr, err)
+		}
+		pendingEvents = pendingEvents[1:]
+		measuredEvents++
+		debug("measured %s '%s' into PCR %d", ev.eventType, ev.content, pcr)
+
+		rec := pcrLogRecord{
+			RecNum:      measuredEvents,
+			PCR:         pcr,
+			Digests:     digests,
+			ContentType: "booster",
+			Content:     pcrLogContent{ev.eventType, ev.content},
+		}
+		if err := appendPCRLog(rec); err != nil {
+			warning("unable to write %s: %v", pcrLogFile, err)
+		}
+	}
+	return nil
+}
+
+// tpmPCRBanks returns hash algorithms of the banks that have the PCR allocated
+func tpmPCRBanks(rw io.ReadWriter, pcr int) ([]tpm2.Algorithm, error) {
+	caps, _, err := tpm2.GetCapability(rw, tpm2.CapabilityPCRs, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var banks []tpm2.Algorithm
+	for _, c := range caps {
+		sel, ok := c.(tpm2.PCRSelection)
+		if !ok {
+			continue
+		}
+		if _, supported := pcrBankHashes[sel.Hash]; !supported {
+			continue
+		}
+		for _, p := range sel.PCRs {
+			if p == pcr {
+				banks = append(banks, sel.Hash)
+				break
+			}
+		}
+	}
+	if len(banks) == 0 {
+		return nil, fmt.Errorf("TPM has no supported PCR banks allocated for PCR %d", pcr)
+	}
+	return banks, nil
+}
+
+// pcrDigests computes digests of the data for every bank
+func pcrDigests(banks []tpm2.Algorithm, data []byte) ([]pcrDigest, [][]byte, error) {
+	var digests []pcrDigest
+	var raw [][]byte
+	for _, alg := range banks {
+		h, err := alg.Hash()
+		if err != nil {
+			return nil, nil, err
+		}
+		sum := hashData(h, data)
+		digests = append(digests, pcrDigest{pcrBankHashes[alg], hex.EncodeToString(sum)})
+		raw = append(raw, sum)
+	}
+	return digests, raw, nil
+}
+
+func hashData(h crypto.Hash, data []byte) []byte {
+	w := h.New()
+	w.Write(data)
+	return w.Sum(nil)
+}
+
+func extendPCR(rw io.ReadWriter, pcr int, banks []tpm2.Algorithm, data []byte) ([]pcrDigest, error) {
+	digests, raw, err := pcrDigests(banks, data)
+	if err != nil {
+		return nil, err
+	}
+	for i, alg := range banks {
+		if err := tpm2.PCRExtend(rw, tpmutil.Handle(pcr), alg, raw[i], ""); err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+func appendPCRLog(rec pcrLogRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pcrLogFile), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(pcrLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// measureBootInputs measures the initrd phase start, the kernel command line and the init config
+func measureBootInputs() {
+	if config.MeasurePCR == 0 {
+		return
+	}
+
+	measureString("phase", "enter-initrd")
+	if data, err := os.ReadFile("/proc/cmdline"); err == nil {
+		measure("kernel-cmdline", strings.TrimSpace(string(data)), data)
+	} else {
+		warning("measure: %v", err)
+	}
+	if data, err := os.ReadFile(initConfigPath); err == nil {
+		measure("config", initConfigPath, data)
+	} else {
+		warning("measure: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestPCRDigests(t *testing.T) {
+	digests, raw, err := pcrDigests([]tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256}, []byte("enter-initrd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []pcrDigest{
+		{"sha1", "b1b01d5f73f321eb70e76f8a0e241ac0a3fa4a6e"},
+		{"sha256", "51e6b92f405d1f98d96e3de343d61d420ad6923b25de21d766f9298192f14fed"},
+	}
+	if !reflect.DeepEqual(digests, expected) {
+		t.Fatalf("expected digests %+v, got %+v", expected, digests)
+	}
+	if len(raw) != 2 || len(raw[0]) != 20 || len(raw[1]) != 32 {
+		t.Fatalf("unexpected raw digests %x", raw)
+	}
+
+	if _, _, err := pcrDigests([]tpm2.Algorithm{tpm2.AlgNull}, nil); err == nil {
+		t.Fatal("expected an error for unsupported hash algorithm")
+	}
+}
+
+func TestAppendPCRLog(t *testing.T) {
+	prevLogFile := pcrLogFile
+	defer func() { pcrLogFile = prevLogFile }()
+	pcrLogFile = filepath.Join(t.TempDir(), "log", "booster-pcr.log")
+
+	digests, _, err := pcrDigests([]tpm2.Algorithm{tpm2.AlgSHA256}, []byte("leave-initrd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ev := range []string{"enter-initrd", "leave-initrd"} {
+		rec := pcrLogRecord{RecNum: i + 1, PCR: 9, Digests: digests, ContentType: "booster", Content: pcrLogContent{"phase", ev}}
+		if err := appendPCRLog(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(pcrLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"recnum":1,"pcr":9,"digests":[{"hashAlg":"sha256","digest":"` + digests[0].Digest + `"}],"content_type":"booster","content":{"eventType":"phase","string":"enter-initrd"}}
+{"recnum":2,"pcr":9,"digests":[{"hashAlg":"sha256","digest":"` + digests[0].Digest + `"}],"content_type":"booster","content":{"eventType":"phase","string":"leave-initrd"}}
+`
+	if string(data) != expected {
+		t.Fatalf("unexpected event log:\n%s\nexpected:\n%s", data, expected)
+	}
+}
+
+func TestMeasureDisabled(t *testing.T) {
+	prevConfig := config
+	defer func() {
+		config = prevConfig
+		pendingEvents = nil
+	}()
+
+	config = InitConfig{}
+	measureString("phase", "enter-initrd")
+	if len(pendingEvents) != 0 {
+		t.Fatalf("events are queued with measurements disabled: %+v", pendingEvents)
+	}
+}
+
+func TestMeasureLeaveInitrd(t *testing.T) {
+	if _, err := os.Stat(tpmDevice); err == nil {
+		t.Skip("the test must not extend PCRs of the host TPM")
+	}
+	prevConfig, prevTimeout := config, tpmWaitTimeout
+	defer func() {
+		config, tpmWaitTimeout = prevConfig, prevTimeout
+		pendingEvents = nil
+		leaveInitrdMeasured = false
+	}()
+
+	config = InitConfig{MeasurePCR: 9}
+	tpmWaitTimeout = 200 * time.Millisecond
+	start := time.Now()
+	measureLeaveInitrd()
+	if time.Since(start) < tpmWaitTimeout {
+		t.Fatal("init does not wait for the TPM")
+	}
+	// switching root is retried
+	measureLeaveInitrd()
+	if len(pendingEvents) != 1 || pendingEvents[0].content != "leave-initrd" {
+		t.Fatalf("expected leave-initrd queued once, got %+v", pendingEvents)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Modalias index. A universal image contains tens of thousands of aliases and matching every device modalias
+// against each of them is the most CPU expensive part of the coldplug. The patterns are put into a radix tree
+// that has literal edges and '*' edges, so a modalias walks only the branches it can possibly match.
+// The tree works with a simplified form of the patterns ('skeleton') that matches a superset of what the pattern
+// matches. The candidates found in the tree are matched with path.Match, so the glob semantics stay exactly the same.
+
+type aliasNode struct {
+	label    string       // literal bytes consumed when entering this node
+	children []*aliasNode // literal edges, the labels start with distinct bytes
+	star     *aliasNode   // '*' edge
+	patterns []int        // indexes in 'aliases' of the patterns whose skeleton ends here
+
+	// a leaf holds patterns that share the same skeleton remainder, the subtree is expanded only when
+	// a pattern with a different remainder arrives. It keeps the tree small as most patterns are unique.
+	leaf bool
+	rest string
+}
+
+var aliasIndex = &aliasNode{}
+
+// aliasSkeleton converts the pattern to a string where '*' matches any sequence of bytes and all other bytes are literals.
+// '?', character classes and escapes are rare in modules.alias, a pattern is truncated with '*' at the first of them.
+func aliasSkeleton(pattern string) string {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*', '?', '[', '\\':
+			if !strings.HasSuffix(sb.String(), "*") {
+				sb.WriteByte('*')
+			}
+			if c != '*' {
+				return sb.String()
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func newAliasLeaf(label, rest string, patterns []int) *aliasNode {
+	return &aliasNode{label: label, leaf: true, rest: rest, patterns: patterns}
+}
+
+// insert adds patterns with skeleton s, the node's label is already consumed
+func (n *aliasNode) insert(s string, patterns ...int) {
+	for {
+		if n.leaf {
+			if n.rest == s {
+				n.patterns = append(n.patterns, patterns...)
+				return
+			}
+			// expand the leaf one level and then insert the new skeleton into the internal node
+			rest, leafPatterns := n.rest, n.patterns
+			n.leaf, n.rest, n.patterns = false, "", nil
+			n.insert(rest, leafPatterns...)
+			continue
+		}
+
+		if s == "" {
+			n.patterns = append(n.patterns, patterns...)
+			return
+		}
+
+		if s[0] == '*' {
+			if n.star == nil {
+				n.star = newAliasLeaf("", s[1:], patterns)
+				return
+			}
+			n, s = n.star, s[1:]
+			continue
+		}
+
+		literal := s
+		if i := strings.IndexByte(s, '*'); i != -1 {
+			literal = s[:i]
+		}
+
+		child := n.child(s[0])
+		if child == nil {
+			n.children = append(n.children, newAliasLeaf(literal, s[len(literal):], patterns))
+			return
+		}
+
+		common := commonPrefixLen(literal, child.label)
+		if common < len(child.label) {
+			// split the edge at the first mismatching byte
+			split := &aliasNode{label: child.label[:common], children: []*aliasNode{child}}
+			n.replaceChild(child, split)
+			child.label = child.label[common:]
+			child = split
+		}
+		n, s = child, s[common:]
+	}
+}
+
+func (n *aliasNode) child(c byte) *aliasNode {
+	for _, ch := range n.children {
+		if ch.label[0] == c {
+			return ch
+		}
+	}
+	return nil
+}
+
+func (n *aliasNode) replaceChild(from, to *aliasNode) {
+	for i, ch := range n.children {
+		if ch == from {
+			n.children[i] = to
+			return
+		}
+	}
+}
+
+type aliasVisit struct {
+	node   *aliasNode
+	offset int
+}
+
+// candidates returns indexes of the patterns that might match the alias, in the 'aliases' order
+func (n *aliasNode) candidates(alias string) []int {
+	var result []int
+	visited := make(map[aliasVisit]bool)
+
+	var visit func(n *aliasNode, offset int)
+	visit = func(n *aliasNode, offset int) {
+		v := aliasVisit{n, offset}
+		if n.leaf {
+			v.offset = 0 // the leaf patterns are checked as a whole
+		}
+		if visited[v] {
+			return
+		}
+		visited[v] = true
+
+		if n.leaf {
+			result = append(result, n.patterns...)
+			return
+		}
+
+		s := alias[offset:]
+		if s == "" {
+			result = append(result, n.patterns...)
+		}
+		if n.star != nil {
+			for i := offset; i <= len(alias); i++ {
+				visit(n.star, i)
+			}
+		}
+		if s != "" {
+			if child := n.child(s[0]); child != nil && strings.HasPrefix(s, child.label) {
+				visit(child, offset+len(child.label))
+			}
+		}
+	}
+	visit(n, 0)
+
+	sort.Ints(result)
+	return result
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// buildAliasIndex indexes all the patterns from 'aliases'. Malformed patterns are reported and skipped.
+func buildAliasIndex() {
+	aliasIndex = &aliasNode{}
+	for i, a := range aliases {
+		if _, err := path.Match(a.pattern, ""); err != nil {
+			warning("invalid modalias pattern %s for module %s: %v", a.pattern, a.module, err)
+			continue
+		}
+		aliasIndex.insert(aliasSkeleton(a.pattern), i)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// matchAliasLinear is the reference implementation that matches the alias against every pattern
+func matchAliasLinear(alias string) []string {
+	var result []string
+	for _, a := range aliases {
+		if match, _ := path.Match(a.pattern, alias); match {
+			result = append(result, a.module)
+		}
+	}
+	return result
+}
+
+func setAliases(tb testing.TB, list []alias) {
+	tb.Helper()
+	prev := aliases
+	aliases = list
+	buildAliasIndex()
+	tb.Cleanup(func() {
+		aliases = prev
+		buildAliasIndex()
+	})
+}
+
+func TestAliasSkeleton(t *testing.T) {
+	check := func(pattern, expected string) {
+		if skeleton := aliasSkeleton(pattern); skeleton != expected {
+			t.Fatalf("aliasSkeleton(%q) = %q, expected %q", pattern, skeleton, expected)
+		}
+	}
+
+	check("pci:v00008086d000015B8sv*sd*bc*sc*i*", "pci:v00008086d000015B8sv*sd*bc*sc*i*")
+	check("acpi*:PNP0C0A:*", "acpi*:PNP0C0A:*")
+	check("*", "*")
+	check("a**b", "a*b")
+	check("platform:regulatory", "platform:regulatory")
+	check("of:N?T*", "of:N*")
+	check("hid:b0003g[0-9]*", "hid:b0003g*")
+	check(`usb:v\*p*`, "usb:v*")
+	check("*?", "*")
+}
+
+func TestMatchAlias(t *testing.T) {
+	setAliases(t, []alias{
+		{"pci:v00008086d000015B8sv*sd*bc*sc*i*", "e1000e"},
+		{"pci:v00008086d*sv*sd*bc0Csc03i30*", "xhci_pci"},
+		{"pci:v*d*sv*sd*bc0Csc03i30*", "xhci_pci"},
+		{"pci:v*d*sv*sd*bc01sc08i02*", "nvme"},
+		{"acpi*:PNP0C0A:*", "battery"},
+		{"platform:regulatory", "cfg80211"},
+		{"platform:regulatory2", "other"},
+		{"plat*", "glob_all_platform"},
+		{"*", "any"},
+		{"usb:v1D6Bp0003d*", "hub"},
+		{"usb:v1D6Bp000[1-3]d*", "hub_range"},
+		{"usb:v1D6Bp000?d*", "hub_any"},
+		{`usb:v\*p*`, "escaped"},
+		{"virtio:d00000001v*", "virtio_net"},
+		{"virtio:d00000002v*", "virtio_blk"},
+		{"of:N*T*Cvendor,dev1", "of1"},
+		{"of:N*T*Cvendor,dev1C*", "of1c"},
+		{"of:N*T*Cvendor,dev2", "of2"},
+		{"a*b*c", "abc"},
+		{"a*b*c", "abc2"},
+		{"a*bc", "abc3"},
+		{"[", "invalid"},
+	})
+
+	for _, a := range []string{
+		"pci:v00008086d000015B8sv000017AAsd00002292bc02sc00i00",
+		"pci:v00008086d0000A36Dsv000017AAsd0000312Abc0Csc03i30",
+		"pci:v0000144Dd0000A808sv0000144Dsd0000A801bc01sc08i02",
+		"acpi:PNP0C0A:PNP0C0A:",
+		"acpi:PNP0C0B:",
+		"platform:regulatory",
+		"platform:regulatory2",
+		"platform:regulator",
+		"usb:v1D6Bp0003d0515dc09dsc00dp03ic09isc00ip00in00",
+		"usb:v1D6Bp0002d0515dc09dsc00dp01ic09isc00ip00in00",
+		"usb:v1D6Bp0004d0515",
+		"usb:v*p0001",
+		"virtio:d00000001v00001AF4",
+		"virtio:d00000003v00001AF4",
+		"of:NfooT(null)Cvendor,dev1",
+		"of:NfooT(null)Cvendor,dev1Cvendor,dev2",
+		"of:NfooT(null)Cvendor,dev3",
+		"abbcbc",
+		"abc",
+		"ac",
+		"",
+		"p",
+	} {
+		got, err := matchAlias(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := matchAliasLinear(a)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("matchAlias(%q) = %v, expected %v", a, got, expected)
+		}
+	}
+}
+
+func TestMatchAliasRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const alphabet = "ab:*?["
+
+	randomString := func(chars string) string {
+		b := make([]byte, rnd.Intn(8))
+		for i := range b {
+			b[i] = chars[rnd.Intn(len(chars))]
+		}
+		return string(b)
+	}
+
+	var list []alias
+	for i := 0; i < 500; i++ {
+		pattern := randomString(alphabet)
+		if rnd.Intn(3) == 0 {
+			pattern += "[ab]" + randomString(alphabet[:3])
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			continue
+		}
+		list = append(list, alias{pattern, fmt.Sprintf("mod%d", i)})
+	}
+	setAliases(t, list)
+
+	for i := 0; i < 5000; i++ {
+		a := randomString(alphabet[:3])
+		got, err := matchAlias(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := matchAliasLinear(a)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("matchAlias(%q) = %v, expected %v", a, got, expected)
+		}
+	}
+}
+
+// generateAliases generates a set of patterns and device modaliases that resembles modules.alias of a universal image
+func generateAliases() ([]alias, []string) {
+	rnd := rand.New(rand.NewSource(1))
+	var list []alias
+	var devices []string
+
+	for i := 0; i < 25000; i++ {
+		vendor, device := rnd.Intn(0x10000), rnd.Intn(0x10000)
+		mod := fmt.Sprintf("pci_mod%d", i%1500)
+		list = append(list, alias{fmt.Sprintf("pci:v%08Xd%08Xsv*sd*bc*sc*i*", vendor, device), mod})
+		if i%20 == 0 {
+			devices = append(devices, fmt.Sprintf("pci:v%08Xd%08Xsv000017AAsd00002292bc02sc00i00", vendor, device))
+		}
+	}
+	for i := 0; i < 15000; i++ {
+		vendor, product := rnd.Intn(0x10000), rnd.Intn(0x10000)
+		mod := fmt.Sprintf("usb_mod%d", i%1000)
+		list = append(list, alias{fmt.Sprintf("usb:v%04Xp%04Xd*dc*dsc*dp*ic*isc*ip*in*", vendor, product), mod})
+		if i%20 == 0 {
+			devices = append(devices, fmt.Sprintf("usb:v%04Xp%04Xd0100dc00dsc00dp00ic03isc01ip01in00", vendor, product))
+		}
+	}
+	for i := 0; i < 3000; i++ {
+		list = append(list, alias{fmt.Sprintf("acpi*:PNP%04X:*", i), fmt.Sprintf("acpi_mod%d", i)})
+		list = append(list, alias{fmt.Sprintf("platform:device%d", i), fmt.Sprintf("platform_mod%d", i)})
+		list = append(list, alias{fmt.Sprintf("of:N*T*Cvendor,device%d", i), fmt.Sprintf("of_mod%d", i)})
+	}
+	for i := 0; i < 200; i++ {
+		list = append(list, alias{fmt.Sprintf("pci:v*d*sv*sd*bc%02Xsc%02Xi*", i/16, i%16), fmt.Sprintf("class_mod%d", i)})
+		list = append(list, alias{fmt.Sprintf("input:b*v*p*e*-e*%d,*", i), fmt.Sprintf("input_mod%d", i)})
+	}
+	for i := 0; i < 300; i++ {
+		devices = append(devices, fmt.Sprintf("acpi:PNP%04X:", i*7))
+		devices = append(devices, fmt.Sprintf("platform:device%d", i*11))
+		devices = append(devices, fmt.Sprintf("input:b0011v0001p0001eAB41-e0,1,4,11,14,k71,72,r%d,am4,lsfw", i))
+		devices = append(devices, fmt.Sprintf("cpu:type:x86,ven0000fam0006mod%04X:feature:,0000,0001", i))
+	}
+
+	rnd.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+	return list, devices
+}
+
+func TestMatchAliasGenerated(t *testing.T) {
+	list, devices := generateAliases()
+	setAliases(t, list)
+
+	// the linear matching is slow, check a part of the devices only
+	for i := 0; i < len(devices); i += 10 {
+		d := devices[i]
+		got, err := matchAlias(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := matchAliasLinear(d); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("matchAlias(%q) = %v, expected %v", d, got, expected)
+		}
+	}
+}
+
+// BenchmarkColdplugAliases matches modaliases of all the devices of a machine against aliases of a universal image
+func BenchmarkColdplugAliases(b *testing.B) {
+	list, devices := generateAliases()
+	setAliases(b, list)
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, d := range devices {
+				_, _ = matchAlias(d)
+			}
+		}
+	})
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, d := range devices {
+				_ = matchAliasLinear(d)
+			}
+		}
+	})
+	b.Run("build", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buildAliasIndex()
+		}
+	})
+}
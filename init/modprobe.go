@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The init binary acts as modprobe if it is started with this name. The kernel runs the usermode helper
+// from /proc/sys/kernel/modprobe when it needs a module on demand, e.g. a crypto algorithm ('crypto-xts(aes)'),
+// a filesystem ('fs-ext4') or a network protocol family ('net-pf-10'). There is no modprobe in the image,
+// so init registers itself as the helper for the time it runs.
+
+const (
+	kernelModprobeFile = "/proc/sys/kernel/modprobe"
+	modprobeHelperPath = "/usr/lib/booster/modprobe" // a symlink to /init
+	modprobeName       = "modprobe"
+)
+
+var defaultModprobePath string // the helper path set before init registered itself
+
+// registerModprobeHelper makes the kernel use init as the modprobe helper
+func registerModprobeHelper() error {
+	data, err := os.ReadFile(kernelModprobeFile)
+	if err != nil {
+		return err
+	}
+	defaultModprobePath = strings.TrimSpace(string(data))
+
+	if err := os.MkdirAll("/usr/lib/booster", 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink("/init", modprobeHelperPath); err != nil && !os.IsExist(err) {
+		return err
+	}
+	debug("registering %s as modprobe helper", modprobeHelperPath)
+	return os.WriteFile(kernelModprobeFile, []byte(modprobeHelperPath), 0644)
+}
+
+// restoreModprobeHelper sets the helper path back before switching to the root filesystem.
+// The initramfs content is removed at switch root and the helper is not going to be available anymore.
+func restoreModprobeHelper() {
+	if defaultModprobePath == "" {
+		return
+	}
+	if err := os.WriteFile(kernelModprobeFile, []byte(defaultModprobePath), 0644); err != nil {
+		warning("unable to restore %s: %v", kernelModprobeFile, err)
+	}
+}
+
+// parseModprobeArgs parses modprobe command line. The kernel calls it as 'modprobe -q -- $NAME'.
+func parseModprobeArgs(args []string) (names []string, quiet bool, err error) {
+	for i, a := range args {
+		if a == "--" {
+			names = append(names, args[i+1:]...)
+			break
+		}
+		if strings.HasPrefix(a, "-") {
+			switch a {
+			case "-q", "--quiet":
+				quiet = true
+			case "-b", "--use-blacklist":
+				// the blacklist is always applied to aliases
+			default:
+				return nil, false, fmt.Errorf("unsupported option %s", a)
+			}
+			continue
+		}
+		names = append(names, a)
+	}
+	if len(names) == 0 {
+		return nil, false, fmt.Errorf("no module name specified")
+	}
+	return names, quiet, nil
+}
+
+// resolveModprobeName returns modules for the name, it can be either a module name or an alias
+func resolveModprobeName(name string) ([]string, error) {
+	mod := normalizeModuleName(name)
+	if _, err := os.Stat(imageModulesDir + mod + ".ko"); err == nil {
+		return []string{mod}, nil
+	}
+
+	if len(aliases) == 0 {
+		if err := readAliases(); err != nil {
+			return nil, err
+		}
+	}
+	return modaliasModules(name)
+}
+
+// modprobeMain is the entry point when init is started as modprobe, it returns the process exit code
+func modprobeMain(args []string) int {
+	kmsg, _ = os.OpenFile("/dev/kmsg", unix.O_WRONLY, 0600)
+
+	names, quiet, err := parseModprobeArgs(args)
+	if err != nil {
+		severe("modprobe: %v", err)
+		return 1
+	}
+	if quiet {
+		verbosityLevel = levelSevere
+	}
+
+	if err := readConfig(); err != nil {
+		severe("modprobe: %v", err)
+		return 1
+	}
+	// the helper needs module params and the blacklist only, the rest of the boot params belongs to init
+	if err := readCmdline(); err != nil {
+		severe("modprobe: %v", err)
+		return 1
+	}
+	parseModuleBlacklist()
+
+	var toLoad []string
+	for _, name := range names {
+		mods, err := resolveModprobeName(name)
+		if err != nil {
+			severe("modprobe: %v", err)
+			return 1
+		}
+		if len(mods) == 0 {
+			if quiet {
+				debug("modprobe: module %s not found in the image", name)
+			} else {
+				severe("modprobe: module %s not found in the image", name)
+			}
+			return 1
+		}
+		debug("modprobe: %s resolved to %v", name, mods)
+		toLoad = append(toLoad, mods...)
+	}
+
+	if err := loadModules(toLoad...).Wait(); err != nil {
+		severe("modprobe: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseModprobeArgs(t *testing.T) {
+	check := func(args []string, expectedNames []string, expectedQuiet bool) {
+		names, quiet, err := parseModprobeArgs(args)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		if !reflect.DeepEqual(names, expectedNames) || quiet != expectedQuiet {
+			t.Fatalf("%v: expected %v quiet=%v, got %v quiet=%v", args, expectedNames, expectedQuiet, names, quiet)
+		}
+	}
+
+	check([]string{"-q", "--", "crypto-xts(aes)"}, []string{"crypto-xts(aes)"}, true)
+	check([]string{"-q", "--", "-weird-name"}, []string{"-weird-name"}, true)
+	check([]string{"fs-ext4"}, []string{"fs-ext4"}, false)
+	check([]string{"-b", "net-pf-10", "dm-crypt"}, []string{"net-pf-10", "dm-crypt"}, false)
+
+	for _, args := range [][]string{{}, {"-q"}, {"-q", "--"}, {"-r", "ext4"}} {
+		if _, _, err := parseModprobeArgs(args); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestResolveModprobeName(t *testing.T) {
+	setAliases(t, []alias{
+		{"crypto-xts", "xts"},
+		{"crypto-xts(aes)", "aesni_intel"},
+		{"crypto-aes", "aes_generic"},
+		{"fs-ext4", "ext4"},
+		{"net-pf-10", "ipv6"},
+		{"net-pf-10", "blacklisted"},
+	})
+	aliasBlacklistedModules["blacklisted"] = true
+	defer delete(aliasBlacklistedModules, "blacklisted")
+
+	check := func(name string, expected []string) {
+		mods, err := resolveModprobeName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mods, expected) {
+			t.Fatalf("resolveModprobeName(%s) = %v, expected %v", name, mods, expected)
+		}
+	}
+
+	check("crypto-xts(aes)", []string{"aesni_intel"})
+	check("fs-ext4", []string{"ext4"})
+	check("net-pf-10", []string{"ipv6"})
+	check("fs-unknown", nil)
+}
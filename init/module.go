@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -15,19 +18,86 @@ const imageModulesDir = "/usr/lib/modules/"
 
 type alias struct{ pattern, module string } // module alias info
 
+// errModuleBlacklisted is returned for the modules that are skipped on user request, these are not boot failures
+var errModuleBlacklisted = errors.New("blacklisted")
+
 var (
-	loadedModules  = make(map[string]bool)
-	loadingModules = make(map[string][]*sync.WaitGroup)
-	modulesMutex   sync.Mutex
+	moduleLoads  = make(map[string]*moduleFuture) // modules that are loaded, being loaded or failed to load
+	modulesMutex sync.Mutex
+
+	// modules that are never loaded, set with module_blacklist=, modprobe.blacklist= and rd.driver.blacklist= boot params
+	blacklistedModules = make(map[string]bool)
+	// modules that are not loaded for matching aliases, set with 'blacklist' lines in modprobe.d
+	aliasBlacklistedModules = make(map[string]bool)
 )
 
-func loadModalias(alias string) error {
+// cmdlineModules returns module names from a boot param that contains a comma-separated list. The param can be specified multiple times.
+func cmdlineModules(param string) []string {
+	var result []string
+	for _, v := range cmdlineValues(param) {
+		for _, m := range strings.Split(v, ",") {
+			if m != "" {
+				result = append(result, normalizeModuleName(m))
+			}
+		}
+	}
+	return result
+}
+
+func parseModuleBlacklist() {
+	for _, param := range []string{"module_blacklist", "modprobe.blacklist", "rd.driver.blacklist"} {
+		for _, m := range cmdlineModules(param) {
+			blacklistedModules[m] = true
+		}
+	}
+	for _, m := range config.ModprobeBlacklist {
+		aliasBlacklistedModules[m] = true
+	}
+}
+
+// blacklistedDependency returns the module itself or one of its (transitive) dependencies if it is blacklisted
+func blacklistedDependency(module string, visited map[string]bool) string {
+	if blacklistedModules[module] {
+		return module
+	}
+	if visited[module] {
+		return ""
+	}
+	visited[module] = true
+	for _, dep := range config.ModuleDependencies[module] {
+		if b := blacklistedDependency(dep, visited); b != "" {
+			return b
+		}
+	}
+	return ""
+}
+
+// modaliasModules returns modules that match the alias, blacklisted modules are skipped
+func modaliasModules(alias string) ([]string, error) {
 	mods, err := matchAlias(alias)
 	if err != nil {
-		return fmt.Errorf("unable to match modalias %s: %v", alias, err)
+		return nil, fmt.Errorf("unable to match modalias %s: %v", alias, err)
+	}
+
+	var result []string
+	for _, m := range mods {
+		if aliasBlacklistedModules[m] || blacklistedModules[m] {
+			debug("module %s is blacklisted, skipping it for alias %s", m, alias)
+			continue
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+func loadModalias(alias string) error {
+	mods, err := modaliasModules(alias)
+	if err != nil {
+		return err
 	}
 	if len(mods) == 0 {
 		debug("no match found for alias %s", alias)
+		diagAddUnmatchedModalias(alias)
 		return nil
 	}
 	_ = loadModules(mods...)
@@ -49,68 +119,149 @@ func readAliases() error {
 		parts := strings.Split(line, " ")
 		aliases = append(aliases, alias{parts[0], parts[1]})
 	}
+	if err := s.Err(); err != nil {
+		return err
+	}
 
-	return s.Err()
+	buildAliasIndex()
+	return nil
 }
 
-func loadModuleUnlocked(wg *sync.WaitGroup, modules ...string) {
-	loadModule := func(mod string, depsWg *sync.WaitGroup) {
-		depsWg.Wait()
-		if err := finitModule(mod); err != nil {
-			severe("%v", err)
-			return
-		}
+// moduleFuture is the result of a module loading. It is resolved once the module is loaded or the loading failed.
+type moduleFuture struct {
+	name       string
+	done       chan struct{}
+	err        error
+	missingDep bool // the module failed because of an unresolved symbol, a later attempt might succeed
+}
 
-		if concurrentModuleLoading {
-			modulesMutex.Lock()
-			defer modulesMutex.Unlock()
-		}
+func newModuleFuture(name string) *moduleFuture {
+	return &moduleFuture{name: name, done: make(chan struct{})}
+}
+
+func (f *moduleFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+func (f *moduleFuture) resolved() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *moduleFuture) wait() error {
+	<-f.done
+	return f.err
+}
 
-		for _, w := range loadingModules[mod] {
-			// signal waiters that the module is loaded
-			w.Done()
+type moduleFutures []*moduleFuture
+
+// Wait blocks until all the modules are processed and returns the first error
+func (fs moduleFutures) Wait() error {
+	var firstErr error
+	for _, f := range fs {
+		if err := f.wait(); err != nil && firstErr == nil {
+			firstErr = err
 		}
-		delete(loadingModules, mod)
-		loadedModules[mod] = true
+	}
+	return firstErr
+}
+
+const moduleLoadRetries = 3
+
+var (
+	moduleRetryDelay = 200 * time.Millisecond
+	loadModuleFile   = finitModule // replaced in tests
+)
 
-		// post deps
-		var postDepsWg sync.WaitGroup
-		if deps, ok := config.ModuleDependencies[mod]; ok {
-			loadModuleUnlocked(&postDepsWg, deps...)
+// loadModuleWithRetry loads the module file. A module fails with ENOENT if one of the symbols it needs is not available
+// yet, e.g. a module that provides it is being loaded concurrently, such modules are tried again a few times.
+func loadModuleWithRetry(module string) error {
+	for attempt := 0; ; attempt++ {
+		err := loadModuleFile(module)
+		if err == nil || errors.Is(err, unix.EEXIST) {
+			return nil // EEXIST means the module is already loaded
 		}
+		if !errors.Is(err, unix.ENOENT) || attempt == moduleLoadRetries {
+			return err
+		}
+		debug("%v, retrying", err)
+		time.Sleep(moduleRetryDelay << attempt)
 	}
+}
 
-	for _, module := range modules {
-		if _, ok := loadedModules[module]; ok {
-			continue // the module is already loaded
+func loadModuleUnlocked(module string) *moduleFuture {
+	if f, ok := moduleLoads[module]; ok {
+		if !f.resolved() || f.err == nil || !f.missingDep {
+			return f
 		}
+		debug("loading module %s again", module)
+	}
 
-		_, alreadyLoading := loadingModules[module]
-		wg.Add(1)
-		loadingModules[module] = append(loadingModules[module], wg)
+	f := newModuleFuture(module)
+	moduleLoads[module] = f
 
-		if alreadyLoading {
-			// we already incremented 'wg' counter
-			// now wait till the module is loaded
-			continue
+	if b := blacklistedDependency(module, make(map[string]bool)); b == module {
+		debug("module %s is blacklisted, skipping it", module)
+		f.resolve(fmt.Errorf("module %s is %w", module, errModuleBlacklisted))
+		return f
+	} else if b != "" {
+		f.resolve(fmt.Errorf("module %s is not loaded as its dependency %s is %w", module, b, errModuleBlacklisted))
+		warning("%v", f.err)
+		return f
+	}
+
+	var deps moduleFutures
+	for _, d := range config.ModuleDependencies[module] {
+		deps = append(deps, loadModuleUnlocked(d))
+	}
+
+	load := func() {
+		// dependents of a failed module fail right away without trying to load it
+		if err := deps.Wait(); err != nil {
+			f.resolve(fmt.Errorf("module %s is not loaded as its dependency failed: %v", module, err))
+			warning("%v", f.err)
+			return
 		}
 
-		var depsWg sync.WaitGroup
-		if deps, ok := config.ModuleDependencies[module]; ok {
-			loadModuleUnlocked(&depsWg, deps...)
+		err := loadModuleWithRetry(module)
+		if err != nil {
+			severe("%v", err)
+			f.missingDep = errors.Is(err, unix.ENOENT)
+			f.resolve(err)
+			return
 		}
 
-		if concurrentModuleLoading {
-			go loadModule(module, &depsWg)
-		} else {
-			loadModule(module, &depsWg)
+		// post dependencies are started before the module is reported as loaded, nobody waits for them
+		if postDeps := config.ModulePostDependencies[module]; len(postDeps) > 0 {
+			if concurrentModuleLoading {
+				_ = loadModules(postDeps...)
+			} else {
+				for _, d := range postDeps {
+					loadModuleUnlocked(d)
+				}
+			}
 		}
+		f.resolve(nil)
+	}
+
+	if concurrentModuleLoading {
+		go load()
+	} else {
+		load()
 	}
+	return f
 }
 
 func finitModule(module string) error {
 	f, err := os.Open(imageModulesDir + "/" + module + ".ko")
-	if err != nil {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("module %s is not found in the image", module)
+	} else if err != nil {
 		return err
 	}
 	defer f.Close()
@@ -131,26 +282,45 @@ func finitModule(module string) error {
 		debug("loading module %s params=\"%s\"", module, params)
 	}
 	if err := unix.FinitModule(int(f.Fd()), params, 0); err != nil {
-		return fmt.Errorf("finit(%v): %v", module, err)
+		return fmt.Errorf("finit(%v): %w", module, err)
 	}
+	petWatchdog()
 
 	return nil
 }
 
-func loadModules(modules ...string) *sync.WaitGroup {
-	var wg sync.WaitGroup
+// loadModules starts loading of the modules and their dependencies. The result can be used to wait for the modules.
+func loadModules(modules ...string) moduleFutures {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
 
+	var result moduleFutures
+	for _, m := range modules {
+		result = append(result, loadModuleUnlocked(m))
+	}
+	return result
+}
+
+// failedModules returns names of the modules that failed to load, blacklisted modules are not reported
+func failedModules() []string {
 	modulesMutex.Lock()
 	defer modulesMutex.Unlock()
 
-	loadModuleUnlocked(&wg, modules...)
-	return &wg
+	var result []string
+	for name, f := range moduleLoads {
+		if f.resolved() && f.err != nil && !errors.Is(f.err, errModuleBlacklisted) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
 }
 
 // returns all module names that match given alias
 func matchAlias(alias string) ([]string, error) {
 	var result []string
-	for _, a := range aliases {
+	for _, i := range aliasIndex.candidates(alias) {
+		a := aliases[i]
 		match, err := path.Match(a.pattern, alias)
 		if err != nil {
 			return nil, err
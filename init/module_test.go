@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestModuleBlacklist(t *testing.T) {
+	prevCmdline, prevConfig := cmdlineList, config
+	defer func() {
+		cmdlineList, config = prevCmdline, prevConfig
+		blacklistedModules = make(map[string]bool)
+		aliasBlacklistedModules = make(map[string]bool)
+	}()
+
+	cmdlineList = map[string][]string{
+		"module_blacklist":    {"nouveau"},
+		"modprobe.blacklist":  {"pcspkr,snd-hda-intel"},
+		"rd.driver.blacklist": {"floppy", "usb_storage,"},
+		"rd.driver.pre":       {"dm-crypt,vfat"},
+	}
+	config = InitConfig{
+		ModuleDependencies: map[string][]string{
+			"uas":        {"usb_storage", "scsi_mod"},
+			"sd_mod":     {"scsi_mod"},
+			"drm_helper": {"nouveau"},
+			"loop_a":     {"loop_b"},
+			"loop_b":     {"loop_a"},
+		},
+		ModprobeBlacklist: []string{"iTCO_wdt"},
+	}
+	parseModuleBlacklist()
+
+	expected := map[string]bool{"nouveau": true, "pcspkr": true, "snd_hda_intel": true, "floppy": true, "usb_storage": true}
+	if !reflect.DeepEqual(blacklistedModules, expected) {
+		t.Fatalf("blacklisted modules: expected %v, got %v", expected, blacklistedModules)
+	}
+	if !aliasBlacklistedModules["iTCO_wdt"] || len(aliasBlacklistedModules) != 1 {
+		t.Fatalf("unexpected alias blacklist %v", aliasBlacklistedModules)
+	}
+
+	if pre := cmdlineModules("rd.driver.pre"); !reflect.DeepEqual(pre, []string{"dm_crypt", "vfat"}) {
+		t.Fatalf("unexpected rd.driver.pre modules %v", pre)
+	}
+	if post := cmdlineModules("rd.driver.post"); post != nil {
+		t.Fatalf("unexpected rd.driver.post modules %v", post)
+	}
+
+	check := func(module, expected string) {
+		if b := blacklistedDependency(module, make(map[string]bool)); b != expected {
+			t.Fatalf("blacklistedDependency(%s) = '%s', expected '%s'", module, b, expected)
+		}
+	}
+	check("floppy", "floppy")
+	check("uas", "usb_storage")
+	check("sd_mod", "")
+	check("drm_helper", "nouveau")
+	check("loop_a", "")
+	check("iTCO_wdt", "") // modprobe.d blacklist affects alias matching only
+}
+
+func TestModuleFutures(t *testing.T) {
+	prevConfig, prevLoader, prevDelay, prevConcurrent := config, loadModuleFile, moduleRetryDelay, concurrentModuleLoading
+	defer func() {
+		config, loadModuleFile, moduleRetryDelay, concurrentModuleLoading = prevConfig, prevLoader, prevDelay, prevConcurrent
+		moduleLoads = make(map[string]*moduleFuture)
+	}()
+
+	config = InitConfig{
+		ModuleDependencies: map[string][]string{
+			"ext4":     {"jbd2", "mbcache"},
+			"broken_a": {"broken"},
+			"broken_b": {"broken_a"},
+			"late":     {"provider"},
+			"usbhid":   {"hid"},
+		},
+		ModulePostDependencies: map[string][]string{
+			"ext4": {"crc32c"},
+		},
+	}
+	moduleRetryDelay = time.Millisecond
+
+	for _, concurrent := range []bool{true, false} {
+		concurrentModuleLoading = concurrent
+		moduleLoads = make(map[string]*moduleFuture)
+
+		var mu sync.Mutex
+		attempts := make(map[string]int)
+		loadModuleFile = func(module string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts[module]++
+
+			switch module {
+			case "broken":
+				return fmt.Errorf("finit(%s): %w", module, unix.EINVAL)
+			case "mbcache":
+				return fmt.Errorf("finit(%s): %w", module, unix.EEXIST)
+			case "flaky":
+				// fails with unresolved symbols the first time
+				if attempts[module] == 1 {
+					return fmt.Errorf("finit(%s): %w", module, unix.ENOENT)
+				}
+			case "late":
+				// its dependency is not available until the 5th attempt
+				if attempts[module] < 5 {
+					return fmt.Errorf("finit(%s): %w", module, unix.ENOENT)
+				}
+			}
+			return nil
+		}
+
+		if err := loadModules("ext4").Wait(); err != nil {
+			t.Fatalf("concurrent=%v: ext4: %v", concurrent, err)
+		}
+		if err := loadModules("flaky").Wait(); err != nil {
+			t.Fatalf("concurrent=%v: flaky: %v", concurrent, err)
+		}
+
+		err := loadModules("broken_b").Wait()
+		if err == nil || !strings.Contains(err.Error(), "broken_b") || !strings.Contains(err.Error(), "invalid argument") {
+			t.Fatalf("concurrent=%v: unexpected broken_b error %v", concurrent, err)
+		}
+		if attempts["broken_a"] != 0 || attempts["broken_b"] != 0 {
+			t.Fatalf("concurrent=%v: dependents of a failed module must not be loaded", concurrent)
+		}
+
+		// 'late' fails after all retries, but it is loaded when requested again
+		if err := loadModules("late").Wait(); !errors.Is(err, unix.ENOENT) {
+			t.Fatalf("concurrent=%v: expected ENOENT for late module, got %v", concurrent, err)
+		}
+		if err := loadModules("late").Wait(); err != nil {
+			t.Fatalf("concurrent=%v: late: %v", concurrent, err)
+		}
+
+		// post dependencies are loaded in background
+		if err := loadModules("crc32c").Wait(); err != nil {
+			t.Fatalf("concurrent=%v: crc32c: %v", concurrent, err)
+		}
+
+		// blacklisted modules and their dependents are skipped but not reported as failed
+		blacklistedModules = map[string]bool{"hid": true}
+		if err := loadModules("usbhid").Wait(); !errors.Is(err, errModuleBlacklisted) {
+			t.Fatalf("concurrent=%v: expected usbhid to be skipped, got %v", concurrent, err)
+		}
+		blacklistedModules = make(map[string]bool)
+		if attempts["hid"] != 0 || attempts["usbhid"] != 0 {
+			t.Fatalf("concurrent=%v: blacklisted modules must not be loaded", concurrent)
+		}
+
+		expected := []string{"broken", "broken_a", "broken_b"}
+		if failed := failedModules(); !reflect.DeepEqual(failed, expected) {
+			t.Fatalf("concurrent=%v: failed modules expected %v, got %v", concurrent, expected, failed)
+		}
+		if attempts["jbd2"] != 1 || attempts["mbcache"] != 1 || attempts["crc32c"] != 1 || attempts["flaky"] != 2 {
+			t.Fatalf("concurrent=%v: unexpected load attempts %v", concurrent, attempts)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ifaceNetConfig is a network configuration for interfaces that match it.
+// It is either the config from booster.yaml or a stanza specified with ip= boot param.
+type ifaceNetConfig struct {
+	InitNetworkConfig
+	ifname   string           // interface name, empty matches any interface
+	hwAddr   net.HardwareAddr // interface MAC address, empty matches any interface
+	mtu      int
+	hostname string
+}
+
+// netIface is a network interface that appeared at boot
+type netIface struct {
+	names  []string         // kernel name followed by predictable names
+	hwAddr net.HardwareAddr // nil for virtual links declared in the config
+}
+
+func (c *ifaceNetConfig) matches(iface *netIface) bool {
+	if c.ifname != "" && !stringListContains(c.ifname, iface.names) {
+		return false
+	}
+	// virtual links have no hardware address (nil), so MAC filters never match them while name patterns do
+	if c.hwAddr != nil && !bytes.Equal(c.hwAddr, iface.hwAddr) {
+		return false
+	}
+	if len(c.Interfaces) > 0 && !iface.matchesAny(c.Interfaces) {
+		return false
+	}
+	return true
+}
+
+// matchesAny checks whether the interface matches one of the patterns. A pattern is either a MAC address
+// or an interface name that can contain shell-style wildcards, e.g. 'enp*'.
+func (iface *netIface) matchesAny(patterns []string) bool {
+	for _, p := range patterns {
+		if hwAddr, err := net.ParseMAC(p); err == nil {
+			if bytes.Equal(hwAddr, iface.hwAddr) {
+				return true
+			}
+			continue
+		}
+		for _, name := range iface.names {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	// effective network configuration, interface specific stanzas go first
+	networkConfigs []*ifaceNetConfig
+	// DNS servers specified with nameserver= boot param
+	cmdlineNameservers []net.IP
+)
+
+func networkEnabled() bool {
+	return len(networkConfigs) > 0
+}
+
+// findNetworkConfig returns configuration for the given interface or nil if the interface should not be activated
+func findNetworkConfig(iface *netIface) *ifaceNetConfig {
+	for _, c := range networkConfigs {
+		if c.matches(iface) {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseNetworkCmdline merges dracut-style network boot params (ip=, nameserver=, rd.neednet=, vlan=, bond=, bridge=) on top of
+// network config from booster.yaml. See 'man dracut.cmdline' for the params description.
+func parseNetworkCmdline() error {
+	var generic *ifaceNetConfig
+	if config.Network != nil {
+		generic = &ifaceNetConfig{InitNetworkConfig: *config.Network}
+	}
+
+	var specific []*ifaceNetConfig
+	for _, param := range cmdlineValues("ip") {
+		c, err := parseIpParam(param)
+		if err != nil {
+			return fmt.Errorf("ip=%s: %v", param, err)
+		}
+
+		if config.Network != nil && c.DNSServers == "" {
+			c.DNSServers = config.Network.DNSServers
+		}
+
+		if c.ifname == "" && c.hwAddr == nil {
+			// a generic stanza overrides address configuration from booster.yaml but preserves the list of active interfaces
+			if config.Network != nil {
+				c.Interfaces = config.Network.Interfaces
+			}
+			generic = c
+		} else {
+			specific = append(specific, c)
+		}
+	}
+
+	for _, ns := range cmdlineValues("nameserver") {
+		ip := net.ParseIP(stripBrackets(ns))
+		if ip == nil {
+			return fmt.Errorf("nameserver=%s: unable to parse IP address", ns)
+		}
+		cmdlineNameservers = append(cmdlineNameservers, ip)
+	}
+
+	if generic == nil && len(specific) == 0 && cmdlineValue("rd.neednet") == "1" {
+		// network is requested but nothing is configured, use DHCP at all interfaces like dracut does
+		generic = &ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Dhcp: true}}
+	}
+
+	networkConfigs = specific
+	if generic != nil {
+		networkConfigs = append(networkConfigs, generic)
+	}
+
+	return parseVirtualLinksCmdline()
+}
+
+// ip= autoconfiguration methods supported by booster
+var autoconfMethods = map[string]func(c *InitNetworkConfig){
+	"dhcp":        func(c *InitNetworkConfig) { c.Dhcp = true },
+	"on":          func(c *InitNetworkConfig) { c.Dhcp = true },
+	"any":         func(c *InitNetworkConfig) { c.Dhcp = true },
+	"single-dhcp": func(c *InitNetworkConfig) { c.Dhcp = true },
+	"dhcp6":       func(c *InitNetworkConfig) { c.Dhcp6 = true },
+	"auto6":       func(c *InitNetworkConfig) { c.Slaac = true },
+	"either6":     func(c *InitNetworkConfig) { c.Slaac = true }, // slaac mode switches to DHCPv6 if router asks for it
+	"link6":       func(c *InitNetworkConfig) {},                 // bring the link up without address configuration
+	"none":        func(c *InitNetworkConfig) {},
+	"off":         func(c *InitNetworkConfig) {},
+}
+
+func isAutoconf(methods string) bool {
+	if methods == "" {
+		return false
+	}
+	for _, m := range strings.Split(methods, ",") {
+		if _, ok := autoconfMethods[m]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func applyAutoconf(c *InitNetworkConfig, methods string) {
+	for _, m := range strings.Split(methods, ",") {
+		autoconfMethods[m](c)
+	}
+}
+
+// splitIpParam splits ip= param into colon-separated fields. IPv6 addresses are enclosed with brackets
+// and their colons are not considered separators.
+func splitIpParam(param string) []string {
+	var fields []string
+	var inBrackets bool
+	start := 0
+	for i, ch := range param {
+		switch ch {
+		case '[':
+			inBrackets = true
+		case ']':
+			inBrackets = false
+		case ':':
+			if !inBrackets {
+				fields = append(fields, param[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, param[start:])
+}
+
+func stripBrackets(s string) string {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseIpParam parses one of the following forms of ip= boot param
+//
+//	ip=<autoconf>
+//	ip=<interface>:<autoconf>[:[<mtu>][:<macaddr>]]
+//	ip=<client-IP>:[<peer>]:<gateway-IP>:<netmask>:<client_hostname>:<interface>:<autoconf>[:[<mtu>][:<macaddr>]]
+//	ip=<client-IP>:[<peer>]:<gateway-IP>:<netmask>:<client_hostname>:<interface>:<autoconf>[:[<dns1>][:<dns2>]]
+func parseIpParam(param string) (*ifaceNetConfig, error) {
+	fields := splitIpParam(param)
+	c := &ifaceNetConfig{}
+
+	var rest []string // optional fields after <autoconf>
+	switch {
+	case len(fields) == 1:
+		if !isAutoconf(fields[0]) {
+			return nil, fmt.Errorf("unknown autoconfiguration method %s", fields[0])
+		}
+		applyAutoconf(&c.InitNetworkConfig, fields[0])
+		return c, nil
+	case len(fields) >= 7 && isAutoconf(fields[6]):
+		if err := c.setStaticAddress(fields[0], fields[2], fields[3]); err != nil {
+			return nil, err
+		}
+		c.hostname = fields[4]
+		c.ifname = fields[5]
+		applyAutoconf(&c.InitNetworkConfig, fields[6])
+		rest = fields[7:]
+
+		if len(rest) > 0 && rest[0] != "" && net.ParseIP(stripBrackets(rest[0])) != nil {
+			// <dns1>[:<dns2>] form
+			if len(rest) > 2 {
+				return nil, fmt.Errorf("too many fields")
+			}
+			var servers []string
+			for _, s := range rest {
+				ip := net.ParseIP(stripBrackets(s))
+				if ip == nil {
+					return nil, fmt.Errorf("unable to parse DNS server address %s", s)
+				}
+				servers = append(servers, ip.String())
+			}
+			c.DNSServers = strings.Join(servers, ",")
+			return c, nil
+		}
+	case len(fields) >= 2 && isAutoconf(fields[1]):
+		c.ifname = fields[0]
+		applyAutoconf(&c.InitNetworkConfig, fields[1])
+		rest = fields[2:]
+	default:
+		return nil, fmt.Errorf("unable to parse the param")
+	}
+
+	if len(rest) > 0 && rest[0] != "" {
+		mtu, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid MTU %s", rest[0])
+		}
+		c.mtu = mtu
+	}
+	if len(rest) > 1 {
+		// MAC address contains colons so join the rest of the fields back
+		mac, err := net.ParseMAC(strings.Join(rest[1:], ":"))
+		if err != nil {
+			return nil, err
+		}
+		c.hwAddr = mac
+	}
+
+	return c, nil
+}
+
+// setStaticAddress applies <client-IP>, <gateway-IP> and <netmask> fields of ip= boot param
+func (c *ifaceNetConfig) setStaticAddress(clientIp, gatewayIp, netmask string) error {
+	if clientIp == "" {
+		return nil
+	}
+
+	ip := net.ParseIP(stripBrackets(clientIp))
+	if ip == nil {
+		return fmt.Errorf("unable to parse client IP address %s", clientIp)
+	}
+	var gw net.IP
+	if gatewayIp != "" {
+		gw = net.ParseIP(stripBrackets(gatewayIp))
+		if gw == nil {
+			return fmt.Errorf("unable to parse gateway IP address %s", gatewayIp)
+		}
+	}
+
+	isV4 := ip.To4() != nil
+	bits := 128
+	if isV4 {
+		bits = 32
+	}
+
+	prefixLen := bits
+	if netmask != "" {
+		if l, err := strconv.Atoi(netmask); err == nil {
+			prefixLen = l
+		} else if m := net.ParseIP(netmask).To4(); m != nil && isV4 {
+			prefixLen, _ = net.IPMask(m).Size()
+		} else {
+			return fmt.Errorf("unable to parse netmask %s", netmask)
+		}
+		if prefixLen <= 0 || prefixLen > bits {
+			return fmt.Errorf("invalid netmask %s", netmask)
+		}
+	}
+
+	addr := fmt.Sprintf("%s/%d", ip, prefixLen)
+	if isV4 {
+		c.Ip = addr
+		if gw != nil {
+			c.Gateway = gw.String()
+		}
+	} else {
+		c.Ip6 = addr
+		if gw != nil {
+			c.Gateway6 = gw.String()
+		}
+	}
+	return nil
+}
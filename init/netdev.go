@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	// virtual links declared either in booster.yaml or with vlan=, bond=, bridge= boot params
+	netVlans   []NetVlan
+	netBonds   []NetBond
+	netBridges []NetBridge
+
+	createdLinks []string // virtual links created by booster, in the order of creation
+	netdevMutex  sync.Mutex
+)
+
+// parseVirtualLinksCmdline merges virtual links from booster.yaml with the ones specified with dracut-style
+// vlan=, bond= and bridge= boot params. A boot param overrides a config link with the same name.
+func parseVirtualLinksCmdline() error {
+	if config.Network != nil {
+		netVlans = append(netVlans, config.Network.Vlans...)
+		netBonds = append(netBonds, config.Network.Bonds...)
+		netBridges = append(netBridges, config.Network.Bridges...)
+	}
+
+	for _, param := range cmdlineValues("vlan") {
+		v, err := parseVlanParam(param)
+		if err != nil {
+			return fmt.Errorf("vlan=%s: %v", param, err)
+		}
+		netVlans = removeVlan(netVlans, v.Name)
+		netVlans = append(netVlans, *v)
+	}
+
+	for _, param := range paramsWithDefault("bond") {
+		b, err := parseBondParam(param)
+		if err != nil {
+			return fmt.Errorf("bond=%s: %v", param, err)
+		}
+		netBonds = removeBond(netBonds, b.Name)
+		netBonds = append(netBonds, *b)
+	}
+
+	for _, param := range paramsWithDefault("bridge") {
+		b, err := parseBridgeParam(param)
+		if err != nil {
+			return fmt.Errorf("bridge=%s: %v", param, err)
+		}
+		netBridges = removeBridge(netBridges, b.Name)
+		netBridges = append(netBridges, *b)
+	}
+
+	return nil
+}
+
+// paramsWithDefault returns values of the boot param. A param without value (e.g. 'bond') is returned as an empty string.
+func paramsWithDefault(key string) []string {
+	if params := cmdlineValues(key); params != nil {
+		return params
+	}
+	if _, ok := cmdlineParam(key); ok {
+		return []string{""}
+	}
+	return nil
+}
+
+func removeVlan(list []NetVlan, name string) []NetVlan {
+	var result []NetVlan
+	for _, v := range list {
+		if v.Name != name {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func removeBond(list []NetBond, name string) []NetBond {
+	var result []NetBond
+	for _, b := range list {
+		if b.Name != name {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+func removeBridge(list []NetBridge, name string) []NetBridge {
+	var result []NetBridge
+	for _, b := range list {
+		if b.Name != name {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// parseVlanParam parses vlan=<vlanname>:<phys_device> boot param. VLAN id is taken from the name that
+// follows one of the forms: vlan0005, vlan5, eth0.0005, eth0.5
+func parseVlanParam(param string) (*NetVlan, error) {
+	fields := strings.Split(param, ":")
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return nil, fmt.Errorf("expected format is <vlanname>:<phys_device>")
+	}
+
+	name := fields[0]
+	var idStr string
+	if idx := strings.LastIndexByte(name, '.'); idx != -1 {
+		idStr = name[idx+1:]
+	} else if strings.HasPrefix(name, "vlan") {
+		idStr = strings.TrimPrefix(name, "vlan")
+	} else {
+		return nil, fmt.Errorf("unable to get VLAN id from interface name %s", name)
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id < 1 || id > 4094 {
+		return nil, fmt.Errorf("invalid VLAN id %s", idStr)
+	}
+
+	return &NetVlan{Name: name, Parent: fields[1], Id: id}, nil
+}
+
+// parseBondParam parses bond=<bondname>[:<bondslaves>:[:<options>[:<mtu>]]] boot param.
+// Default values are the same as in dracut: bond0 over eth0,eth1 in balance-rr mode.
+func parseBondParam(param string) (*NetBond, error) {
+	b := &NetBond{Name: "bond0", Mode: "balance-rr", Members: []string{"eth0", "eth1"}}
+	if param == "" {
+		return b, nil
+	}
+
+	fields := strings.Split(param, ":")
+	if len(fields) > 4 {
+		return nil, fmt.Errorf("too many fields")
+	}
+	if fields[0] != "" {
+		b.Name = fields[0]
+	}
+	if len(fields) > 1 && fields[1] != "" {
+		b.Members = strings.Split(fields[1], ",")
+	}
+	if len(fields) > 2 && fields[2] != "" {
+		for _, opt := range strings.Split(fields[2], ",") {
+			key, val := opt, ""
+			if idx := strings.IndexByte(opt, '='); idx != -1 {
+				key, val = opt[:idx], opt[idx+1:]
+			}
+			switch key {
+			case "mode":
+				b.Mode = val
+			case "miimon":
+				miimon, err := strconv.Atoi(val)
+				if err != nil {
+					return nil, fmt.Errorf("invalid miimon value %s", val)
+				}
+				b.Miimon = miimon
+			default:
+				return nil, fmt.Errorf("unsupported bond option %s", key)
+			}
+		}
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		mtu, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid MTU %s", fields[3])
+		}
+		b.Mtu = mtu
+	}
+
+	return b, nil
+}
+
+// parseBridgeParam parses bridge=<bridgename>:<ethnames> boot param. Default value is br0:eth0.
+func parseBridgeParam(param string) (*NetBridge, error) {
+	b := &NetBridge{Name: "br0", Members: []string{"eth0"}}
+	if param == "" {
+		return b, nil
+	}
+
+	fields := strings.Split(param, ":")
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return nil, fmt.Errorf("expected format is <bridgename>:<ethnames>")
+	}
+	b.Name = fields[0]
+	b.Members = strings.Split(fields[1], ",")
+	return b, nil
+}
+
+// isVirtualLink checks whether the interface is a VLAN, bond or bridge declared in the config
+func isVirtualLink(ifname string) bool {
+	for _, v := range netVlans {
+		if v.Name == ifname {
+			return true
+		}
+	}
+	for _, b := range netBonds {
+		if b.Name == ifname {
+			return true
+		}
+	}
+	for _, b := range netBridges {
+		if b.Name == ifname {
+			return true
+		}
+	}
+	return false
+}
+
+// linkMaster returns name of the bond or bridge that has the interface as its member
+func linkMaster(ifname string) string {
+	for _, b := range netBonds {
+		if stringListContains(ifname, b.Members) {
+			return b.Name
+		}
+	}
+	for _, b := range netBridges {
+		if stringListContains(ifname, b.Members) {
+			return b.Name
+		}
+	}
+	return ""
+}
+
+// isLowerLink checks whether the interface is a member of a bond/bridge or a parent of a VLAN.
+// Such interfaces are only brought up, the addresses are configured at the upper link.
+func isLowerLink(ifname string) bool {
+	if linkMaster(ifname) != "" {
+		return true
+	}
+	for _, v := range netVlans {
+		if v.Parent == ifname {
+			return true
+		}
+	}
+	return false
+}
+
+// setupLowerLink attaches the interface to its master and creates VLANs on top of it.
+// The newly created virtual links generate their own uevents and get configured by handleNetworkUevent.
+func setupLowerLink(ifname string) error {
+	netdevMutex.Lock()
+	defer netdevMutex.Unlock()
+
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	if master := linkMaster(ifname); master != "" {
+		m, err := ensureVirtualLink(master)
+		if err != nil {
+			return fmt.Errorf("%s: %v", master, err)
+		}
+		// bonding driver requires a link to be down before enslaving it
+		if err := netlink.LinkSetDown(link); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMasterByIndex(link, m.Attrs().Index); err != nil {
+			return fmt.Errorf("unable to add %s to %s: %v", ifname, master, err)
+		}
+		debug("interface %s is added to %s", ifname, master)
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+	addInitializedIfname(ifname)
+
+	for _, v := range netVlans {
+		if v.Parent != ifname {
+			continue
+		}
+		if _, err := ensureVirtualLink(v.Name); err != nil {
+			return fmt.Errorf("%s: %v", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ensureVirtualLink returns the virtual link with the given name, the link is created if it does not exist yet
+func ensureVirtualLink(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		return link, nil
+	}
+	var notFound netlink.LinkNotFoundError
+	if !errors.As(err, &notFound) {
+		return nil, err
+	}
+
+	link, module, err := newVirtualLink(name)
+	if err != nil {
+		return nil, err
+	}
+	loadNetdevModule(module)
+
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("unable to create %s link: %v", link.Type(), err)
+	}
+	createdLinks = append(createdLinks, name)
+	debug("created %s link %s", link.Type(), name)
+
+	return netlink.LinkByName(name)
+}
+
+// newVirtualLink converts the declared virtual link config to its netlink representation.
+// It also returns the name of the kernel module that implements the link type.
+func newVirtualLink(name string) (netlink.Link, string, error) {
+	for _, v := range netVlans {
+		if v.Name != name {
+			continue
+		}
+		parent, err := netlink.LinkByName(v.Parent)
+		if err != nil {
+			return nil, "", err
+		}
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		attrs.ParentIndex = parent.Attrs().Index
+		return &netlink.Vlan{LinkAttrs: attrs, VlanId: v.Id}, "8021q", nil
+	}
+
+	for _, b := range netBonds {
+		if b.Name != name {
+			continue
+		}
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		attrs.MTU = b.Mtu
+		bond := netlink.NewLinkBond(attrs)
+		if b.Mode != "" {
+			bond.Mode = netlink.StringToBondMode(b.Mode)
+			if bond.Mode == netlink.BOND_MODE_UNKNOWN {
+				return nil, "", fmt.Errorf("unknown bond mode %s", b.Mode)
+			}
+		}
+		if b.Miimon != 0 {
+			bond.Miimon = b.Miimon
+		}
+		return bond, "bonding", nil
+	}
+
+	for _, b := range netBridges {
+		if b.Name != name {
+			continue
+		}
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		return &netlink.Bridge{LinkAttrs: attrs}, "bridge", nil
+	}
+
+	return nil, "", fmt.Errorf("virtual link %s is not declared", name)
+}
+
+// loadNetdevModule loads the kernel module that implements a virtual link type.
+// The generator adds these modules to the image when network is configured, if the module file is missing
+// then the functionality is compiled into the kernel.
+func loadNetdevModule(module string) {
+	if _, err := os.Stat(imageModulesDir + module + ".ko"); err != nil {
+		return
+	}
+	if err := loadModules(module).Wait(); err != nil {
+		warning("%v", err)
+	}
+}
+
+// deleteVirtualLinks removes links created by booster so the booted system can set them up from scratch
+func deleteVirtualLinks() {
+	netdevMutex.Lock()
+	defer netdevMutex.Unlock()
+
+	// delete in the reverse order so VLANs go before their parent bonds
+	for i := len(createdLinks) - 1; i >= 0; i-- {
+		link, err := netlink.LinkByName(createdLinks[i])
+		if err != nil {
+			continue
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			warning("unable to delete link %s: %v", createdLinks[i], err)
+		}
+	}
+	createdLinks = nil
+}
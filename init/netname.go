@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Predictable network interface names computed the same way as systemd's net_id udev builtin does it.
+// Booster does not rename interfaces, the names are used to match interfaces against the network config only.
+// See https://www.freedesktop.org/software/systemd/man/systemd.net-naming-scheme.html
+
+var netSysfsDir = "/sys/class/net"
+
+const onboardIndexMax = 16*1024 - 1
+
+// predictableNames returns names of the interface in the order: onboard (eno), slot (ens), path (enp) and MAC (enx) based.
+// Names that cannot be computed for the device are skipped.
+func predictableNames(ifname string) []string {
+	dir := filepath.Join(netSysfsDir, ifname)
+
+	prefix := netNamePrefix(dir)
+	if prefix == "" {
+		return nil
+	}
+
+	// stacked devices (e.g. VLANs) share the parent's hardware and do not get names
+	ifindex, _ := readSysfsInt(dir, "ifindex")
+	if iflink, err := readSysfsInt(dir, "iflink"); err == nil && iflink != ifindex {
+		return nil
+	}
+
+	var names []string
+	if device, err := filepath.EvalSymlinks(filepath.Join(dir, "device")); err == nil {
+		if pci := findParentWithSubsystem(device, "pci"); pci != "" {
+			names = append(names, pciNetNames(prefix, dir, device, pci)...)
+		}
+	}
+	if mac := macNetName(prefix, dir); mac != "" {
+		names = append(names, mac)
+	}
+	return names
+}
+
+// netNamePrefix returns the two-letter prefix for the interface type or an empty string if the type is not supported
+func netNamePrefix(dir string) string {
+	typ, err := readSysfsInt(dir, "type")
+	if err != nil {
+		return ""
+	}
+
+	switch typ {
+	case 1: // ARPHRD_ETHER
+		switch ueventVar(dir, "DEVTYPE") {
+		case "wlan":
+			return "wl"
+		case "wwan":
+			return "ww"
+		default:
+			return "en"
+		}
+	case 32: // ARPHRD_INFINIBAND
+		return "ib"
+	case 256: // ARPHRD_SLIP
+		return "sl"
+	default:
+		return ""
+	}
+}
+
+// pciNetNames computes onboard, slot and path names for a PCI network device
+func pciNetNames(prefix, dir, device, pci string) []string {
+	var domain, bus, slot, function int
+	if _, err := fmt.Sscanf(filepath.Base(pci), "%x:%x:%x.%x", &domain, &bus, &slot, &function); err != nil {
+		return nil
+	}
+
+	port := netPortSuffix(dir)
+
+	var funcSuffix string
+	if function > 0 || isPciMultifunction(pci) {
+		funcSuffix = fmt.Sprintf("f%d", function)
+	}
+
+	var domainPrefix string
+	if domain > 0 {
+		domainPrefix = fmt.Sprintf("P%d", domain)
+	}
+
+	usb := usbNetSuffix(device, pci)
+
+	var names []string
+
+	// onboard devices with index provided by firmware
+	index, err := readSysfsInt(pci, "acpi_index")
+	if err != nil {
+		index, err = readSysfsInt(pci, "index")
+	}
+	if err == nil && index > 0 && index <= onboardIndexMax && usb == "" {
+		names = append(names, fmt.Sprintf("%so%d%s", prefix, index, port))
+	}
+
+	// hotplug slot
+	if hotplugSlot := pciHotplugSlot(pci, domain, bus, slot); hotplugSlot != "" {
+		names = append(names, fmt.Sprintf("%s%ss%s%s%s%s", prefix, domainPrefix, hotplugSlot, funcSuffix, port, usb))
+	}
+
+	// PCI geographical location
+	names = append(names, fmt.Sprintf("%s%sp%ds%d%s%s%s", prefix, domainPrefix, bus, slot, funcSuffix, port, usb))
+
+	return names
+}
+
+// netPortSuffix returns 'n<phys_port_name>' or 'd<dev_port>' suffix for devices with multiple ports
+func netPortSuffix(dir string) string {
+	if name, err := os.ReadFile(filepath.Join(dir, "phys_port_name")); err == nil {
+		if n := strings.TrimSpace(string(name)); n != "" {
+			return "n" + n
+		}
+	}
+	if devPort, err := readSysfsInt(dir, "dev_port"); err == nil && devPort > 0 {
+		return fmt.Sprintf("d%d", devPort)
+	}
+	return ""
+}
+
+// isPciMultifunction checks the multi-function bit of the PCI header type
+func isPciMultifunction(pci string) bool {
+	config, err := os.ReadFile(filepath.Join(pci, "config"))
+	if err != nil || len(config) < 0x0f {
+		return false
+	}
+	return config[0x0e]&0x80 != 0
+}
+
+// pciHotplugSlot finds the slot name that has the device's address at /sys/bus/pci/slots
+func pciHotplugSlot(pci string, domain, bus, slot int) string {
+	slots := filepath.Join(pci, "subsystem", "slots")
+	entries, err := os.ReadDir(slots)
+	if err != nil {
+		return ""
+	}
+
+	want := fmt.Sprintf("%04x:%02x:%02x", domain, bus, slot)
+	for _, e := range entries {
+		address, err := os.ReadFile(filepath.Join(slots, e.Name(), "address"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(address)) == want {
+			return e.Name()
+		}
+	}
+	return ""
+}
+
+// usbNetSuffix returns 'u<port>[c<config>][i<interface>]' suffix if the network device is attached over USB
+func usbNetSuffix(device, pci string) string {
+	usbIntf := findParentWithSubsystem(device, "usb")
+	if usbIntf == "" || !strings.HasPrefix(usbIntf, pci) {
+		return ""
+	}
+
+	// USB interface directory is named <bus>-<port>[.<port>...]:<config>.<interface>
+	name := filepath.Base(usbIntf)
+	dash := strings.IndexByte(name, '-')
+	colon := strings.IndexByte(name, ':')
+	if dash == -1 || colon < dash {
+		return ""
+	}
+	ports := name[dash+1 : colon]
+	dot := strings.IndexByte(name[colon:], '.')
+	if dot == -1 {
+		return ""
+	}
+	config := name[colon+1 : colon+dot]
+	intf := name[colon+dot+1:]
+
+	suffix := "u" + strings.ReplaceAll(ports, ".", "u")
+	if config != "1" {
+		suffix += "c" + config
+	}
+	if intf != "0" {
+		suffix += "i" + intf
+	}
+	return suffix
+}
+
+// macNetName returns 'x<MAC>' name for interfaces with a permanent MAC address
+func macNetName(prefix, dir string) string {
+	if assignType, err := readSysfsInt(dir, "addr_assign_type"); err != nil || assignType != 0 {
+		return ""
+	}
+	address, err := os.ReadFile(filepath.Join(dir, "address"))
+	if err != nil {
+		return ""
+	}
+	mac := strings.ReplaceAll(strings.TrimSpace(string(address)), ":", "")
+	if mac == "" || strings.Trim(mac, "0") == "" {
+		return ""
+	}
+	return prefix + "x" + mac
+}
+
+// findParentWithSubsystem walks up the sysfs devices tree and returns the closest device that belongs to the subsystem
+func findParentWithSubsystem(device, subsystem string) string {
+	for dir := device; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		link, err := os.Readlink(filepath.Join(dir, "subsystem"))
+		if err != nil {
+			continue
+		}
+		if filepath.Base(link) != subsystem {
+			continue
+		}
+		if subsystem == "usb" && !strings.Contains(filepath.Base(dir), ":") {
+			continue // a USB device, we need its interface
+		}
+		return dir
+	}
+	return ""
+}
+
+func readSysfsInt(dir, attr string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// ueventVar returns the value of a variable from the device's uevent file
+func ueventVar(dir, key string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "uevent"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, key+"=") {
+			return line[len(key)+1:]
+		}
+	}
+	return ""
+}
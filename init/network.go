@@ -6,74 +6,38 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/insomniacslk/dhcp/dhcpv4"
-	"github.com/insomniacslk/dhcp/dhcpv4/client4"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 )
 
-func runDhcp(ifname string) error {
-	dhcp := client4.NewClient()
-	var conversation []*dhcpv4.DHCPv4
-	for i := 0; i < 40; i++ {
-		var err error
-		conversation, err = dhcp.Exchange(ifname)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Second)
-	}
-	var ack *dhcpv4.DHCPv4
-	for _, m := range conversation {
-		switch m.MessageType() {
-		case dhcpv4.MessageTypeAck:
-			ack = m
-		}
-	}
-	if ack == nil {
-		return fmt.Errorf("DHCP: no ACK received")
-	}
-
-	link, err := netlink.LinkByName(ifname)
-	if err != nil {
-		return err
-	}
-
-	addr := netlink.Addr{IPNet: &net.IPNet{
-		IP:   ack.YourIPAddr,
-		Mask: ack.SubnetMask(),
-	}}
-	if err := netlink.AddrAdd(link, &addr); err != nil {
-		return err
-	}
+// stopDhcpRenewal stops the lease renewal goroutines, it is safe to call it multiple times
+func stopDhcpRenewal() {
+	dhcpStopOnce.Do(func() { close(dhcpStop) })
+}
 
-	gateway := dhcpv4.GetIP(dhcpv4.OptionRouter, ack.Options)
-	if gateway != nil {
-		defaultRoute := netlink.Route{Gw: gateway}
-		if err := netlink.RouteAdd(&defaultRoute); err != nil {
-			return err
-		}
-	}
+func shutdownNetwork() {
+	stopDhcpRenewal()
 
-	dnsServers := dhcpv4.GetIPs(dhcpv4.OptionDomainNameServer, ack.Options)
-	if dnsServers != nil {
-		if err := writeResolvConf(dnsServers); err != nil {
-			return err
+	if keepNetwork() {
+		if err := writeNetworkdState(); err != nil {
+			warning("unable to write systemd-networkd state: %v", err)
 		}
+		return
 	}
 
-	return nil
-}
-
-func shutdownNetwork() {
-	for _, ifname := range initializedIfnames {
+	shutdownWireguard()
+	for _, ifname := range listInitializedIfnames() {
 		link, err := netlink.LinkByName(ifname)
 		if err != nil {
 			continue
 		}
 
+		// stop the kernel from re-adding SLAAC addresses while we clean up
+		stopIPv6Autoconf(ifname)
+
 		addrs, _ := netlink.AddrList(link, netlink.FAMILY_ALL)
 		for _, a := range addrs {
 			_ = netlink.AddrDel(link, &a)
@@ -85,17 +49,52 @@ func shutdownNetwork() {
 		}
 
 		_ = netlink.LinkSetDown(link)
+		restoreIPv6Sysctls(ifname)
 	}
+
+	deleteVirtualLinks()
 }
 
-var initializedIfnames []string
+var (
+	initializedIfnames      []string // links brought up by booster, including bond/bridge members and VLAN parents
+	initializedIfnamesMutex sync.Mutex
+)
 
-func initializeNetworkInterface(ifname string) error {
+func addInitializedIfname(ifname string) {
+	initializedIfnamesMutex.Lock()
+	defer initializedIfnamesMutex.Unlock()
+	initializedIfnames = append(initializedIfnames, ifname)
+}
+
+// listInitializedIfnames returns a copy of the initialized links list, the interfaces are set up concurrently
+func listInitializedIfnames() []string {
+	initializedIfnamesMutex.Lock()
+	defer initializedIfnamesMutex.Unlock()
+	return append([]string(nil), initializedIfnames...)
+}
+
+func initializeNetworkInterface(ifname string, c *ifaceNetConfig) error {
 	link, err := netlink.LinkByName(ifname)
 	if err != nil {
 		return err
 	}
 
+	if c.mtu != 0 {
+		if err := netlink.LinkSetMTU(link, c.mtu); err != nil {
+			return err
+		}
+	}
+	if c.hostname != "" {
+		if err := unix.Sethostname([]byte(c.hostname)); err != nil {
+			return err
+		}
+	}
+	if len(cmdlineNameservers) > 0 {
+		if err := writeResolvConf(cmdlineNameservers, nil); err != nil {
+			return err
+		}
+	}
+
 	ch := make(chan netlink.LinkUpdate)
 	done := make(chan struct{})
 	defer close(done)
@@ -106,7 +105,8 @@ func initializeNetworkInterface(ifname string) error {
 	if err := netlink.LinkSetUp(link); err != nil {
 		return err
 	}
-	initializedIfnames = append(initializedIfnames, ifname)
+	addInitializedIfname(ifname)
+	saveConfiguredIface(ifname, c)
 
 	timeout := time.After(20 * time.Second)
 linkReadinessLoop:
@@ -121,61 +121,131 @@ linkReadinessLoop:
 		}
 	}
 
-	c := config.Network
+	// IPv4 and IPv6 are configured independently, a slow DHCP server for one family should not block another one
+	results := make(chan familyResult, 2)
+	go func() { results <- familyResult{c.Dhcp || c.Ip != "", initializeIPv4(link, c)} }()
+	go func() {
+		results <- familyResult{c.Ip6 != "" || c.Slaac || c.Dhcp6, initializeIPv6(link, &c.InitNetworkConfig)}
+	}()
+	return addressFamiliesError(ifname, []familyResult{<-results, <-results})
+}
+
+type familyResult struct {
+	configured bool // the address family has configuration
+	err        error
+}
+
+// addressFamiliesError returns an error only if the interface got no address at all. If another address family
+// is configured then the failures are just logged, e.g. WireGuard can still run over the working family.
+func addressFamiliesError(ifname string, results []familyResult) error {
+	var errs []error
+	usable := false
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, r.err)
+		} else if r.configured {
+			usable = true
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if usable {
+		for _, err := range errs {
+			warning("%s: %v", ifname, err)
+		}
+		return nil
+	}
+	// report all the errors but the last one here and return the last one
+	for _, err := range errs[:len(errs)-1] {
+		warning("%s: %v", ifname, err)
+	}
+	return errs[len(errs)-1]
+}
+
+func initializeIPv4(link netlink.Link, c *ifaceNetConfig) error {
 	if c.Dhcp {
-		if err := runDhcp(ifname); err != nil {
+		return runDhcp(link, c)
+	}
+
+	// static address
+	if c.Ip != "" {
+		addr, err := netlink.ParseAddr(c.Ip)
+		if err != nil {
 			return err
 		}
-	} else {
-		// static address
-		if c.Ip != "" {
-			addr, err := netlink.ParseAddr(c.Ip)
-			if err != nil {
-				return err
-			}
-			if err := netlink.AddrAdd(link, addr); err != nil {
-				return err
-			}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
 		}
+	}
 
-		if c.Gateway != "" {
-			gw := net.ParseIP(c.Gateway)
-			if gw == nil {
-				return fmt.Errorf("network.gateway: unable to parse ip address %s", c.Gateway)
-			}
-			defaultRoute := netlink.Route{Gw: gw}
-			if err := netlink.RouteAdd(&defaultRoute); err != nil {
-				return err
-			}
+	if c.Gateway != "" {
+		gw := net.ParseIP(c.Gateway)
+		if gw == nil {
+			return fmt.Errorf("network.gateway: unable to parse ip address %s", c.Gateway)
 		}
-
-		if c.DNSServers != "" {
-			servers := strings.Split(c.DNSServers, ",")
-			ips := make([]net.IP, 0)
-			for _, s := range servers {
-				ip := net.ParseIP(s)
-				if ip == nil {
-					return fmt.Errorf("Unable to parse IP address for DNS server: %v", s)
-				}
-				ips = append(ips, ip)
-			}
-			if err := writeResolvConf(ips); err != nil {
-				return err
-			}
+		defaultRoute := netlink.Route{Gw: gw}
+		if err := netlink.RouteAdd(&defaultRoute); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	return writeStaticResolvConf(&c.InitNetworkConfig)
 }
 
-func writeResolvConf(servers []net.IP) error {
+// writeStaticResolvConf adds DNS servers specified in the config
+func writeStaticResolvConf(c *InitNetworkConfig) error {
+	if c.DNSServers == "" {
+		return nil
+	}
+
+	servers := strings.Split(c.DNSServers, ",")
+	ips := make([]net.IP, 0)
+	for _, s := range servers {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("Unable to parse IP address for DNS server: %v", s)
+		}
+		ips = append(ips, ip)
+	}
+	return writeResolvConf(ips, nil)
+}
+
+var (
+	resolvers      []net.IP // DNS servers collected from all configured interfaces and address families
+	searchDomains  []string
+	resolversMutex sync.Mutex
+)
+
+// writeResolvConf adds the servers and search domains to the known ones and regenerates /etc/resolv.conf
+func writeResolvConf(servers []net.IP, search []string) error {
+	resolversMutex.Lock()
+	defer resolversMutex.Unlock()
+
+	for _, s := range servers {
+		if !ipListContains(s, resolvers) {
+			resolvers = append(resolvers, s)
+		}
+	}
+	for _, d := range search {
+		if !stringListContains(d, searchDomains) {
+			searchDomains = append(searchDomains, d)
+		}
+	}
+
 	var resolvConf bytes.Buffer
-	for _, ip := range servers {
+	for _, ip := range resolvers {
 		resolvConf.WriteString("nameserver ")
 		resolvConf.WriteString(ip.String())
 		resolvConf.WriteByte('\n')
 	}
-	resolvConf.WriteString("search .\n")
+	if len(searchDomains) > 0 {
+		resolvConf.WriteString("search ")
+		resolvConf.WriteString(strings.Join(searchDomains, " "))
+		resolvConf.WriteByte('\n')
+	} else {
+		resolvConf.WriteString("search .\n")
+	}
 
 	return os.WriteFile("/etc/resolv.conf", resolvConf.Bytes(), 0644)
 }
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const ipv6ConfDir = "/proc/sys/net/ipv6/conf/"
+
+var (
+	// original values of per-interface IPv6 sysctls changed by init, restored at shutdown
+	savedIPv6Sysctls      = make(map[string]map[string]string)
+	savedIPv6SysctlsMutex sync.Mutex
+)
+
+func setIPv6Sysctl(ifname, key, value string) error {
+	file := ipv6ConfDir + ifname + "/" + key
+	orig, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	savedIPv6SysctlsMutex.Lock()
+	if savedIPv6Sysctls[ifname] == nil {
+		savedIPv6Sysctls[ifname] = make(map[string]string)
+	}
+	if _, ok := savedIPv6Sysctls[ifname][key]; !ok {
+		savedIPv6Sysctls[ifname][key] = strings.TrimSpace(string(orig))
+	}
+	savedIPv6SysctlsMutex.Unlock()
+
+	return os.WriteFile(file, []byte(value), 0644)
+}
+
+// stopIPv6Autoconf disables router advertisement processing at the interface
+func stopIPv6Autoconf(ifname string) {
+	_ = setIPv6Sysctl(ifname, "accept_ra", "0")
+	_ = setIPv6Sysctl(ifname, "autoconf", "0")
+}
+
+// restoreIPv6Sysctls brings IPv6 interface settings back to the state we found them
+// so the main system network manager starts from the kernel defaults.
+func restoreIPv6Sysctls(ifname string) {
+	savedIPv6SysctlsMutex.Lock()
+	defer savedIPv6SysctlsMutex.Unlock()
+
+	for key, value := range savedIPv6Sysctls[ifname] {
+		_ = os.WriteFile(ipv6ConfDir+ifname+"/"+key, []byte(value), 0644)
+	}
+	delete(savedIPv6Sysctls, ifname)
+}
+
+func initializeIPv6(link netlink.Link, c *InitNetworkConfig) error {
+	switch {
+	case c.Ip6 != "":
+		return initializeStaticIPv6(link, c)
+	case c.Slaac:
+		return runSlaac(link)
+	case c.Dhcp6:
+		// the default route still comes from router advertisements but addresses are assigned by the DHCPv6 server only
+		if err := setIPv6Sysctl(link.Attrs().Name, "autoconf", "0"); err != nil {
+			return err
+		}
+		if _, err := waitForIPv6Address(link, net.IP.IsLinkLocalUnicast, 10*time.Second); err != nil {
+			return err
+		}
+		return runDhcp6(link, true)
+	default:
+		return nil
+	}
+}
+
+func initializeStaticIPv6(link netlink.Link, c *InitNetworkConfig) error {
+	ifname := link.Attrs().Name
+
+	addr, err := netlink.ParseAddr(c.Ip6)
+	if err != nil {
+		return err
+	}
+	if addr.IP.To4() != nil {
+		return fmt.Errorf("network.ip6: %s is not an IPv6 address", c.Ip6)
+	}
+
+	// static configuration should not be mixed with the autoconfigured one
+	stopIPv6Autoconf(ifname)
+
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return err
+	}
+
+	if c.Gateway6 != "" {
+		gw := net.ParseIP(c.Gateway6)
+		if gw == nil || gw.To4() != nil {
+			return fmt.Errorf("network.gateway6: unable to parse ipv6 address %s", c.Gateway6)
+		}
+		// link index is required as the gateway is often a link-local address
+		defaultRoute := netlink.Route{LinkIndex: link.Attrs().Index, Gw: gw}
+		if err := netlink.RouteAdd(&defaultRoute); err != nil {
+			return err
+		}
+	}
+
+	return writeStaticResolvConf(c)
+}
+
+func isGlobalIPv6(ip net.IP) bool {
+	return ip.IsGlobalUnicast()
+}
+
+// waitForIPv6Address waits until the link gets an IPv6 address that passed duplicate address detection
+// and satisfies the given filter.
+func waitForIPv6Address(link netlink.Link, filter func(ip net.IP) bool, timeout time.Duration) (net.IP, error) {
+	ch := make(chan netlink.AddrUpdate)
+	done := make(chan struct{})
+	defer close(done)
+	if err := netlink.AddrSubscribe(ch, done); err != nil {
+		return nil, err
+	}
+
+	ready := func(ip net.IP, flags int) bool {
+		return ip.To4() == nil && filter(ip) && flags&(unix.IFA_F_TENTATIVE|unix.IFA_F_DADFAILED) == 0
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ready(a.IP, a.Flags) {
+			return a.IP, nil
+		}
+	}
+
+	expired := time.After(timeout)
+	for {
+		select {
+		case u := <-ch:
+			if u.LinkIndex == link.Attrs().Index && u.NewAddr && ready(u.LinkAddress.IP, u.Flags) {
+				return u.LinkAddress.IP, nil
+			}
+		case <-expired:
+			return nil, fmt.Errorf("%s: timeout waiting for IPv6 address", link.Attrs().Name)
+		}
+	}
+}
+
+// routerAdvertisement contains the parts of ICMPv6 router advertisement (RFC 4861) booster is interested in
+type routerAdvertisement struct {
+	managed        bool // 'M' flag, addresses are available via DHCPv6
+	other          bool // 'O' flag, other configuration (e.g. DNS) is available via DHCPv6
+	routerLifetime time.Duration
+	prefixes       []*net.IPNet // prefixes usable for stateless autoconfiguration
+	dnsServers     []net.IP     // RDNSS option (RFC 8106)
+	searchDomains  []string     // DNSSL option (RFC 8106)
+}
+
+const (
+	ndOptPrefixInfo = 3
+	ndOptRDNSS      = 25
+	ndOptDNSSL      = 31
+)
+
+// parseRouterAdvertisement parses ICMPv6 router advertisement message (starting with ICMP header)
+func parseRouterAdvertisement(b []byte) (*routerAdvertisement, error) {
+	const headerLen = 16
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("router advertisement is too short")
+	}
+	if b[0] != byte(ipv6.ICMPTypeRouterAdvertisement) {
+		return nil, fmt.Errorf("not a router advertisement message: type %d", b[0])
+	}
+
+	ra := &routerAdvertisement{
+		managed:        b[5]&0x80 != 0,
+		other:          b[5]&0x40 != 0,
+		routerLifetime: time.Duration(binary.BigEndian.Uint16(b[6:8])) * time.Second,
+	}
+
+	opts := b[headerLen:]
+	for len(opts) > 0 {
+		if len(opts) < 2 {
+			return nil, fmt.Errorf("truncated router advertisement option")
+		}
+		optType, optLen := opts[0], int(opts[1])*8
+		if optLen == 0 || optLen > len(opts) {
+			return nil, fmt.Errorf("invalid router advertisement option length %d", optLen)
+		}
+		data := opts[:optLen]
+		opts = opts[optLen:]
+
+		switch optType {
+		case ndOptPrefixInfo:
+			if optLen != 32 {
+				return nil, fmt.Errorf("invalid prefix information option length %d", optLen)
+			}
+			prefixLen := int(data[2])
+			autonomous := data[3]&0x40 != 0
+			if !autonomous || prefixLen > 128 {
+				continue
+			}
+			prefix := net.IP(append([]byte(nil), data[16:32]...))
+			ra.prefixes = append(ra.prefixes, &net.IPNet{IP: prefix, Mask: net.CIDRMask(prefixLen, 128)})
+		case ndOptRDNSS:
+			for a := data[8:]; len(a) >= net.IPv6len; a = a[net.IPv6len:] {
+				ra.dnsServers = append(ra.dnsServers, net.IP(append([]byte(nil), a[:net.IPv6len]...)))
+			}
+		case ndOptDNSSL:
+			ra.searchDomains = append(ra.searchDomains, parseDNSLabels(data[8:])...)
+		}
+	}
+
+	return ra, nil
+}
+
+// parseDNSLabels parses a list of uncompressed domain names in DNS wire format
+func parseDNSLabels(b []byte) []string {
+	var result []string
+	var labels []string
+	for len(b) > 0 {
+		l := int(b[0])
+		b = b[1:]
+		if l == 0 {
+			if len(labels) == 0 {
+				break // padding
+			}
+			result = append(result, strings.Join(labels, "."))
+			labels = nil
+			continue
+		}
+		if l > len(b) {
+			break
+		}
+		labels = append(labels, string(b[:l]))
+		b = b[l:]
+	}
+	return result
+}
+
+// solicitRouter sends router solicitations to the link and waits for an advertisement
+func solicitRouter(link netlink.Link) (*routerAdvertisement, error) {
+	const (
+		// from RFC 4861
+		maxRtrSolicitations     = 3
+		rtrSolicitationInterval = 4 * time.Second
+	)
+
+	ifname := link.Attrs().Name
+	iface, err := net.InterfaceByIndex(link.Attrs().Index)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	pc := conn.IPv6PacketConn()
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterAdvertisement)
+	if err := pc.SetICMPFilter(&filter); err != nil {
+		return nil, err
+	}
+	if err := pc.SetControlMessage(ipv6.FlagInterface|ipv6.FlagHopLimit, true); err != nil {
+		return nil, err
+	}
+	// neighbor discovery messages must have hop limit 255
+	if err := pc.SetMulticastHopLimit(255); err != nil {
+		return nil, err
+	}
+	if err := pc.SetMulticastInterface(iface); err != nil {
+		return nil, err
+	}
+
+	rs := []byte{byte(ipv6.ICMPTypeRouterSolicitation), 0, 0, 0, 0, 0, 0, 0} // checksum is computed by kernel
+	if len(iface.HardwareAddr) == 6 {
+		// source link-layer address option
+		rs = append(rs, 1, 1)
+		rs = append(rs, iface.HardwareAddr...)
+	}
+	allRouters := &net.IPAddr{IP: net.ParseIP("ff02::2"), Zone: ifname}
+
+	buf := make([]byte, 1500)
+	for i := 0; i < maxRtrSolicitations; i++ {
+		debug("%s: sending router solicitation", ifname)
+		if _, err := pc.WriteTo(rs, nil, allRouters); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(rtrSolicitationInterval)
+		if err := pc.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, cm, src, err := pc.ReadFrom(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if cm == nil || cm.IfIndex != iface.Index || cm.HopLimit != 255 {
+				continue
+			}
+			ra, err := parseRouterAdvertisement(buf[:n])
+			if err != nil {
+				debug("%s: invalid router advertisement from %v: %v", ifname, src, err)
+				continue
+			}
+			debug("%s: router advertisement from %v: %+v", ifname, src, *ra)
+			return ra, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: no IPv6 router found", ifname)
+}
+
+// runSlaac configures the interface using router advertisements: the kernel performs
+// stateless address autoconfiguration and installs the default route, booster handles
+// DNS options and DHCPv6 if the router asks for it.
+func runSlaac(link netlink.Link) error {
+	ifname := link.Attrs().Name
+	if err := setIPv6Sysctl(ifname, "accept_ra", "1"); err != nil {
+		return err
+	}
+	if err := setIPv6Sysctl(ifname, "autoconf", "1"); err != nil {
+		return err
+	}
+
+	// router solicitations are sent from the link-local address
+	if _, err := waitForIPv6Address(link, net.IP.IsLinkLocalUnicast, 10*time.Second); err != nil {
+		return err
+	}
+
+	ra, err := solicitRouter(link)
+	if err != nil {
+		return err
+	}
+
+	if len(ra.prefixes) > 0 {
+		ip, err := waitForIPv6Address(link, isGlobalIPv6, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		debug("%s: autoconfigured address %v", ifname, ip)
+	}
+
+	if len(ra.dnsServers) > 0 || len(ra.searchDomains) > 0 {
+		if err := writeResolvConf(ra.dnsServers, ra.searchDomains); err != nil {
+			return err
+		}
+	}
+
+	if ra.managed {
+		return runDhcp6(link, true)
+	} else if ra.other {
+		return runDhcp6(link, false)
+	}
+	return nil
+}
+
+// runDhcp6 runs DHCPv6 client at the interface. If stateful is false then only
+// the other configuration (DNS) is requested (RFC 8415 Information-request).
+func runDhcp6(link netlink.Link, stateful bool) error {
+	ifname := link.Attrs().Name
+	client, err := nclient6.New(ifname, nclient6.WithTimeout(time.Second), nclient6.WithRetry(1))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	exchange := func() (*dhcpv6.Message, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if stateful {
+			return client.RapidSolicit(ctx)
+		}
+
+		req, err := dhcpv6.NewMessage()
+		if err != nil {
+			return nil, err
+		}
+		req.MessageType = dhcpv6.MessageTypeInformationRequest
+		req.AddOption(dhcpv6.OptClientID(dhcpv6.Duid{
+			Type:          dhcpv6.DUID_LLT,
+			HwType:        iana.HWTypeEthernet,
+			Time:          dhcpv6.GetTime(),
+			LinkLayerAddr: link.Attrs().HardwareAddr,
+		}))
+		req.AddOption(dhcpv6.OptRequestedOption(dhcpv6.OptionDNSRecursiveNameServer, dhcpv6.OptionDomainSearchList))
+		req.AddOption(dhcpv6.OptElapsedTime(0))
+		return client.SendAndRead(ctx, nclient6.AllDHCPRelayAgentsAndServers, req, nclient6.IsMessageType(dhcpv6.MessageTypeReply))
+	}
+
+	var reply *dhcpv6.Message
+	for i := 0; i < 40; i++ {
+		reply, err = exchange()
+		if err == nil {
+			break
+		}
+		debug("DHCPv6 %s: %v", ifname, err)
+		time.Sleep(time.Second)
+	}
+	if reply == nil {
+		return fmt.Errorf("DHCPv6: no reply received")
+	}
+	if status := reply.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+		return fmt.Errorf("DHCPv6: %v", status)
+	}
+
+	if stateful {
+		ia := reply.Options.OneIANA()
+		if ia == nil || len(ia.Options.Addresses()) == 0 {
+			return fmt.Errorf("DHCPv6: no address received")
+		}
+		for _, a := range ia.Options.Addresses() {
+			// on-link prefix comes from router advertisement, the leased address itself is a single host
+			addr := netlink.Addr{
+				IPNet:       &net.IPNet{IP: a.IPv6Addr, Mask: net.CIDRMask(128, 128)},
+				PreferedLft: int(a.PreferredLifetime.Seconds()),
+				ValidLft:    int(a.ValidLifetime.Seconds()),
+			}
+			debug("DHCPv6 %s: leased address %v", ifname, a.IPv6Addr)
+			if err := netlink.AddrAdd(link, &addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	var search []string
+	if labels := reply.Options.DomainSearchList(); labels != nil {
+		search = labels.Labels
+	}
+	if dnsServers := reply.Options.DNS(); dnsServers != nil || search != nil {
+		if err := writeResolvConf(dnsServers, search); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
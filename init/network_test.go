@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRouterAdvertisement(t *testing.T) {
+	ra := []byte{
+		134, 0, 0, 0, // type, code, checksum
+		64, 0xc0, 0x07, 0x08, // hop limit, M+O flags, router lifetime 1800
+		0, 0, 0, 0, 0, 0, 0, 0, // reachable time, retrans timer
+
+		// prefix information 2001:db8:1::/64, on-link and autonomous
+		3, 4, 64, 0xc0,
+		0, 0, 0x0e, 0x10, 0, 0, 0x07, 0x08, 0, 0, 0, 0,
+		0x20, 0x01, 0x0d, 0xb8, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+
+		// prefix information 2001:db8:2::/64, on-link only
+		3, 4, 64, 0x80,
+		0, 0, 0x0e, 0x10, 0, 0, 0x07, 0x08, 0, 0, 0, 0,
+		0x20, 0x01, 0x0d, 0xb8, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+
+		// RDNSS 2001:db8::53
+		25, 3, 0, 0, 0, 0, 0x0e, 0x10,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x53,
+
+		// DNSSL example.com
+		31, 3, 0, 0, 0, 0, 0x0e, 0x10,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 0, 0,
+	}
+
+	got, err := parseRouterAdvertisement(ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	expected := &routerAdvertisement{
+		managed:        true,
+		other:          true,
+		routerLifetime: 1800 * time.Second,
+		prefixes:       []*net.IPNet{prefix},
+		dnsServers:     []net.IP{net.ParseIP("2001:db8::53")},
+		searchDomains:  []string{"example.com"},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %+v, got %+v", *expected, *got)
+	}
+
+	if _, err := parseRouterAdvertisement(ra[:20]); err == nil {
+		t.Fatal("expected an error for a truncated message")
+	}
+}
+
+func TestParseIpParam(t *testing.T) {
+	check := func(param string, expected *ifaceNetConfig) {
+		c, err := parseIpParam(param)
+		if err != nil {
+			t.Fatalf("ip=%s: %v", param, err)
+		}
+		if !reflect.DeepEqual(expected, c) {
+			t.Fatalf("ip=%s: expected %+v, got %+v", param, *expected, *c)
+		}
+	}
+
+	check("dhcp", &ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Dhcp: true}})
+	check("dhcp,dhcp6", &ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Dhcp: true, Dhcp6: true}})
+	check("eth0:auto6", &ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Slaac: true}, ifname: "eth0"})
+	check("eth0:dhcp:9000:52:54:00:12:34:56", &ifaceNetConfig{
+		InitNetworkConfig: InitNetworkConfig{Dhcp: true},
+		ifname:            "eth0",
+		mtu:               9000,
+		hwAddr:            net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56},
+	})
+	check("10.0.2.15::10.0.2.2:255.255.255.0:myhost:eth0:none", &ifaceNetConfig{
+		InitNetworkConfig: InitNetworkConfig{Ip: "10.0.2.15/24", Gateway: "10.0.2.2"},
+		ifname:            "eth0",
+		hostname:          "myhost",
+	})
+	check("10.0.2.15::10.0.2.2:16::eth1:off:10.0.2.3:8.8.8.8", &ifaceNetConfig{
+		InitNetworkConfig: InitNetworkConfig{Ip: "10.0.2.15/16", Gateway: "10.0.2.2", DNSServers: "10.0.2.3,8.8.8.8"},
+		ifname:            "eth1",
+	})
+	check("[2001:db8::15]::[fe80::1]:64::eth0:none:1400", &ifaceNetConfig{
+		InitNetworkConfig: InitNetworkConfig{Ip6: "2001:db8::15/64", Gateway6: "fe80::1"},
+		ifname:            "eth0",
+		mtu:               1400,
+	})
+
+	invalid := func(param string) {
+		if _, err := parseIpParam(param); err == nil {
+			t.Fatalf("ip=%s: expected to fail but it did not", param)
+		}
+	}
+	invalid("foobar")
+	invalid("eth0:foobar")
+	invalid("10.0.2.15::10.0.2.2:255.0.255.0::eth0:none")
+	invalid("10.0.2.15::10.0.2.2:33::eth0:none")
+	invalid("eth0:dhcp:mtu")
+}
+
+func TestSplitIpParam(t *testing.T) {
+	expected := []string{"[2001:db8::15]", "", "[fe80::1]", "64", "", "eth0", "none"}
+	got := splitIpParam("[2001:db8::15]::[fe80::1]:64::eth0:none")
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestParseVlanParam(t *testing.T) {
+	check := func(param string, expected NetVlan) {
+		got, err := parseVlanParam(param)
+		if err != nil {
+			t.Fatalf("vlan=%s: %v", param, err)
+		}
+		if !reflect.DeepEqual(expected, *got) {
+			t.Fatalf("vlan=%s: expected %+v, got %+v", param, expected, *got)
+		}
+	}
+	check("vlan0005:eth0", NetVlan{Name: "vlan0005", Parent: "eth0", Id: 5})
+	check("vlan100:bond0", NetVlan{Name: "vlan100", Parent: "bond0", Id: 100})
+	check("eth0.0005:eth0", NetVlan{Name: "eth0.0005", Parent: "eth0", Id: 5})
+	check("eth0.42:eth0", NetVlan{Name: "eth0.42", Parent: "eth0", Id: 42})
+
+	invalid := func(param string) {
+		if _, err := parseVlanParam(param); err == nil {
+			t.Fatalf("vlan=%s: expected to fail but it did not", param)
+		}
+	}
+	invalid("eth0")
+	invalid("foo:eth0")
+	invalid("eth0.5000:eth0")
+	invalid("vlan:eth0")
+}
+
+func TestParseBondParam(t *testing.T) {
+	check := func(param string, expected NetBond) {
+		got, err := parseBondParam(param)
+		if err != nil {
+			t.Fatalf("bond=%s: %v", param, err)
+		}
+		if !reflect.DeepEqual(expected, *got) {
+			t.Fatalf("bond=%s: expected %+v, got %+v", param, expected, *got)
+		}
+	}
+	check("", NetBond{Name: "bond0", Mode: "balance-rr", Members: []string{"eth0", "eth1"}})
+	check("bond1", NetBond{Name: "bond1", Mode: "balance-rr", Members: []string{"eth0", "eth1"}})
+	check("bond0:eth2,eth3:mode=802.3ad,miimon=100:9000", NetBond{Name: "bond0", Mode: "802.3ad", Members: []string{"eth2", "eth3"}, Miimon: 100, Mtu: 9000})
+	check("bond0:eth2::1500", NetBond{Name: "bond0", Mode: "balance-rr", Members: []string{"eth2"}, Mtu: 1500})
+
+	invalid := func(param string) {
+		if _, err := parseBondParam(param); err == nil {
+			t.Fatalf("bond=%s: expected to fail but it did not", param)
+		}
+	}
+	invalid("bond0:eth0:miimon=foo")
+	invalid("bond0:eth0:xmit_hash_policy=layer2")
+	invalid("bond0:eth0::mtu")
+	invalid("bond0:eth0:mode=802.3ad:1500:foo")
+}
+
+func TestParseBridgeParam(t *testing.T) {
+	check := func(param string, expected NetBridge) {
+		got, err := parseBridgeParam(param)
+		if err != nil {
+			t.Fatalf("bridge=%s: %v", param, err)
+		}
+		if !reflect.DeepEqual(expected, *got) {
+			t.Fatalf("bridge=%s: expected %+v, got %+v", param, expected, *got)
+		}
+	}
+	check("", NetBridge{Name: "br0", Members: []string{"eth0"}})
+	check("br1:eth0,eth1", NetBridge{Name: "br1", Members: []string{"eth0", "eth1"}})
+
+	if _, err := parseBridgeParam("br0"); err == nil {
+		t.Fatal("bridge=br0: expected to fail but it did not")
+	}
+}
+
+func TestInitializedIfnames(t *testing.T) {
+	defer func() { initializedIfnames = nil }()
+	initializedIfnames = nil
+
+	// physical interfaces and lower links are brought up concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addInitializedIfname(fmt.Sprintf("eth%d", i))
+		}(i)
+	}
+	wg.Wait()
+	if n := len(listInitializedIfnames()); n != 10 {
+		t.Fatalf("expected 10 initialized interfaces, got %d", n)
+	}
+}
+
+func TestDhcpBackoff(t *testing.T) {
+	for attempt, base := range []time.Duration{1, 2, 4, 8, 16, 32, 32, 32} {
+		base *= time.Second
+		for i := 0; i < 20; i++ {
+			d := dhcpBackoff(attempt)
+			if d < base*3/4 || d >= base*5/4 {
+				t.Fatalf("attempt %d: backoff %v is out of range [%v, %v)", attempt, d, base*3/4, base*5/4)
+			}
+		}
+	}
+}
+
+func TestDhcpClasslessRoutes(t *testing.T) {
+	// 10.1.0.0/16 via 10.0.2.2 and 192.168.5.0/24 on-link
+	routes := []byte{16, 10, 1, 10, 0, 2, 2, 24, 192, 168, 5, 0, 0, 0, 0}
+	expected := []string{"route to 10.1.0.0/16 via 10.0.2.2", "route to 192.168.5.0/24 via 0.0.0.0"}
+
+	for _, code := range []dhcpv4.OptionCode{dhcpv4.OptionClasslessStaticRoute, dhcpv4.GenericOptionCode(optionMSStaticRoute)} {
+		ack, err := dhcpv4.New(dhcpv4.WithGeneric(code, routes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dhcpClasslessRoutes(ack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotStr []string
+		for _, r := range got {
+			gotStr = append(gotStr, r.String())
+		}
+		if !reflect.DeepEqual(expected, gotStr) {
+			t.Fatalf("option %d: expected %q, got %q", code.Code(), expected, gotStr)
+		}
+	}
+
+	ack, err := dhcpv4.New(dhcpv4.WithGeneric(dhcpv4.OptionClasslessStaticRoute, []byte{33, 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dhcpClasslessRoutes(ack); err == nil {
+		t.Fatal("expected invalid routes option to fail")
+	}
+}
+
+func TestDhcpInterfaceMTU(t *testing.T) {
+	check := func(value []byte, expected int) {
+		ack, err := dhcpv4.New(dhcpv4.WithGeneric(dhcpv4.OptionInterfaceMTU, value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dhcpInterfaceMTU(ack); got != expected {
+			t.Fatalf("option value %v: expected MTU %d, got %d", value, expected, got)
+		}
+	}
+	check([]byte{0x23, 0x28}, 9000)
+	check([]byte{0, 10}, 0)
+	check([]byte{1}, 0)
+}
+
+// fakeNetDevice creates sysfs entries for a network interface attached to the given device directory
+func fakeNetDevice(t *testing.T, sysfs, ifname, device string, attrs map[string]string) {
+	dir := filepath.Join(sysfs, "class", "net", ifname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range attrs {
+		if err := os.WriteFile(filepath.Join(dir, k), []byte(v+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if device != "" {
+		if err := os.Symlink(filepath.Join(sysfs, "devices", device), filepath.Join(dir, "device")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fakeSysfsDevice(t *testing.T, sysfs, device, subsystem string, attrs map[string]string) {
+	dir := filepath.Join(sysfs, "devices", device)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(sysfs, "bus", subsystem), filepath.Join(dir, "subsystem")); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range attrs {
+		if err := os.WriteFile(filepath.Join(dir, k), []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPredictableNames(t *testing.T) {
+	sysfs := t.TempDir()
+	defer func(dir string) { netSysfsDir = dir }(netSysfsDir)
+	netSysfsDir = filepath.Join(sysfs, "class", "net")
+
+	ether := map[string]string{"type": "1", "ifindex": "2", "iflink": "2", "addr_assign_type": "0", "address": "52:54:00:12:34:56"}
+
+	// virtio NIC at 0000:00:03.0
+	fakeSysfsDevice(t, sysfs, "pci0000:00/0000:00:03.0", "pci", nil)
+	fakeSysfsDevice(t, sysfs, "pci0000:00/0000:00:03.0/virtio0", "virtio", nil)
+	fakeNetDevice(t, sysfs, "eth0", "pci0000:00/0000:00:03.0/virtio0", ether)
+
+	// onboard NIC with firmware index in a hotplug slot
+	multifunction := make([]byte, 64)
+	multifunction[0x0e] = 0x80
+	fakeSysfsDevice(t, sysfs, "pci0000:00/0000:00:1f.6", "pci", map[string]string{"acpi_index": "1\n", "config": string(multifunction)})
+	if err := os.MkdirAll(filepath.Join(sysfs, "bus", "pci", "slots", "4"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sysfs, "bus", "pci", "slots", "4", "address"), []byte("0000:00:1f\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fakeNetDevice(t, sysfs, "eth1", "pci0000:00/0000:00:1f.6", map[string]string{"type": "1", "ifindex": "3", "iflink": "3", "dev_port": "1", "addr_assign_type": "3", "address": "52:54:00:12:34:57"})
+
+	// USB ethernet adapter
+	fakeSysfsDevice(t, sysfs, "pci0000:00/0000:00:14.0", "pci", nil)
+	fakeSysfsDevice(t, sysfs, "pci0000:00/0000:00:14.0/usb1/1-2", "usb", nil)
+	fakeSysfsDevice(t, sysfs, "pci0000:00/0000:00:14.0/usb1/1-2/1-2.1", "usb", nil)
+	fakeSysfsDevice(t, sysfs, "pci0000:00/0000:00:14.0/usb1/1-2/1-2.1/1-2.1:2.1", "usb", nil)
+	fakeNetDevice(t, sysfs, "eth2", "pci0000:00/0000:00:14.0/usb1/1-2/1-2.1/1-2.1:2.1", ether)
+
+	// wireless NIC in a non-zero PCI domain
+	fakeSysfsDevice(t, sysfs, "pci0001:00/0001:02:00.0", "pci", nil)
+	fakeNetDevice(t, sysfs, "wlan0", "pci0001:00/0001:02:00.0", map[string]string{"type": "1", "ifindex": "5", "iflink": "5", "uevent": "DEVTYPE=wlan\nINTERFACE=wlan0\n"})
+
+	// VLAN on top of eth0
+	fakeNetDevice(t, sysfs, "eth0.5", "", map[string]string{"type": "1", "ifindex": "6", "iflink": "2", "addr_assign_type": "0", "address": "52:54:00:12:34:56"})
+
+	check := func(ifname string, expected []string) {
+		got := predictableNames(ifname)
+		if !reflect.DeepEqual(expected, got) {
+			t.Fatalf("%s: expected names %q, got %q", ifname, expected, got)
+		}
+	}
+	check("eth0", []string{"enp0s3", "enx525400123456"})
+	check("eth1", []string{"eno1d1", "ens4f6d1", "enp0s31f6d1"})
+	check("eth2", []string{"enp0s20u2u1c2i1", "enx525400123456"})
+	check("wlan0", []string{"wlP1p2s0"})
+	check("eth0.5", nil)
+}
+
+func TestNetworkConfigMatches(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	iface := &netIface{names: []string{"eth0", "enp0s3", "enx525400123456"}, hwAddr: mac}
+
+	check := func(c *ifaceNetConfig, expected bool) {
+		if got := c.matches(iface); got != expected {
+			t.Fatalf("config %+v: expected match %v, got %v", c, expected, got)
+		}
+	}
+	check(&ifaceNetConfig{}, true)
+	check(&ifaceNetConfig{ifname: "eth0"}, true)
+	check(&ifaceNetConfig{ifname: "enp0s3"}, true)
+	check(&ifaceNetConfig{ifname: "eth1"}, false)
+	check(&ifaceNetConfig{hwAddr: mac}, true)
+	check(&ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Interfaces: []string{"52-54-00-12-34-56"}}}, true)
+	check(&ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Interfaces: []string{"52:54:00:12:34:57", "enp*"}}}, true)
+	check(&ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Interfaces: []string{"wl*", "enp1s0"}}}, false)
+	check(&ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Interfaces: []string{"52:54:00:12:34:57"}}}, false)
+
+	// a virtual link has no MAC address
+	iface = &netIface{names: []string{"bond0"}}
+	check(&ifaceNetConfig{}, true)
+	check(&ifaceNetConfig{ifname: "bond0"}, true)
+	check(&ifaceNetConfig{ifname: "eth0"}, false)
+	check(&ifaceNetConfig{hwAddr: mac}, false)
+	check(&ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Interfaces: []string{"enp*"}}}, false)
+	check(&ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Interfaces: []string{"52:54:00:12:34:56", "bond*"}}}, true)
+	check(&ifaceNetConfig{InitNetworkConfig: InitNetworkConfig{Interfaces: []string{"52:54:00:12:34:56"}}}, false)
+}
+
+func TestAddressFamiliesError(t *testing.T) {
+	dhcpErr := fmt.Errorf("dhcp: timeout")
+	check := func(results []familyResult, expected error) {
+		t.Helper()
+		if err := addressFamiliesError("eth0", results); err != expected {
+			t.Fatalf("%+v: expected %v, got %v", results, expected, err)
+		}
+	}
+	check([]familyResult{{true, nil}, {false, nil}}, nil)
+	// IPv6 works, the interface is still usable
+	check([]familyResult{{true, dhcpErr}, {true, nil}}, nil)
+	// IPv6 is not configured, the interface has no address
+	check([]familyResult{{true, dhcpErr}, {false, nil}}, dhcpErr)
+	check([]familyResult{{true, fmt.Errorf("slaac: timeout")}, {true, dhcpErr}}, dhcpErr)
+}
+
+func TestWireguardSockaddr(t *testing.T) {
+	got := sockaddr(&net.UDPAddr{IP: net.IPv4(10, 0, 2, 2), Port: 51820})
+	expected := make([]byte, 16)
+	nl.NativeEndian().PutUint16(expected, unix.AF_INET)
+	copy(expected[2:], []byte{0xca, 0x6c, 10, 0, 2, 2})
+	if !bytes.Equal(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	got = sockaddr(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820})
+	if len(got) != 28 || got[2] != 0xca || got[3] != 0x6c || !net.IP(got[8:24]).Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("invalid IPv6 sockaddr %v", got)
+	}
+}
+
+func TestWireguardDeviceAttrs(t *testing.T) {
+	key := make([]byte, 32)
+	pub := base64.StdEncoding.EncodeToString(key)
+	c := &WireguardConfig{
+		ListenPort: 51820,
+		Peers: []WireguardPeer{{
+			PublicKey:  pub,
+			Endpoint:   "10.0.2.2:51820",
+			AllowedIPs: []string{"10.100.0.0/24", "fd00::/64"},
+		}},
+	}
+	attrs, err := wireguardDeviceAttrs("wg0", key, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ifname, private key, flags, listen port, peers
+	if len(attrs) != 5 {
+		t.Fatalf("expected 5 attributes, got %d", len(attrs))
+	}
+
+	c.Peers[0].PublicKey = "Zm9v" // too short
+	if _, err := wireguardDeviceAttrs("wg0", key, c); err == nil {
+		t.Fatal("expected invalid public key to fail")
+	}
+	c.Peers[0].PublicKey = pub
+	c.Peers[0].AllowedIPs = []string{"10.100.0.1"}
+	if _, err := wireguardDeviceAttrs("wg0", key, c); err == nil {
+		t.Fatal("expected allowed ip without prefix length to fail")
+	}
+}
+
+func TestStopDhcpRenewal(t *testing.T) {
+	// cleanup might run again if switching root fails and the boot is continued from the rescue shell
+	stopDhcpRenewal()
+	stopDhcpRenewal()
+	select {
+	case <-dhcpStop:
+	default:
+		t.Fatal("renewal stop channel is not closed")
+	}
+}
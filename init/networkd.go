@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/vishvananda/netlink"
+)
+
+// Network state handover to systemd-networkd. If network.keep is enabled then init leaves the interfaces configured
+// at switch root and describes them with networkd configs so the main system adopts the addresses instead of
+// tearing them down. It is required for root filesystems that live on network (NFS, iSCSI, NBD, ...).
+
+const (
+	networkdLeasesDir  = "/run/systemd/netif/leases"
+	networkdConfigsDir = "/run/systemd/network"
+)
+
+var (
+	configuredIfaces  = make(map[string]*ifaceNetConfig) // interfaces with address configuration
+	dhcpLeases        = make(map[string]*dhcpv4.DHCPv4)  // the last DHCPv4 ACK received at an interface
+	networkStateMutex sync.Mutex
+)
+
+func keepNetwork() bool {
+	return config.Network != nil && config.Network.Keep
+}
+
+func saveConfiguredIface(ifname string, c *ifaceNetConfig) {
+	networkStateMutex.Lock()
+	defer networkStateMutex.Unlock()
+	configuredIfaces[ifname] = c
+}
+
+func saveDhcpLease(ifname string, ack *dhcpv4.DHCPv4) {
+	networkStateMutex.Lock()
+	defer networkStateMutex.Unlock()
+	dhcpLeases[ifname] = ack
+}
+
+// writeNetworkdState writes networkd configs for all interfaces initialized by booster and their DHCP leases
+func writeNetworkdState() error {
+	networkStateMutex.Lock()
+	defer networkStateMutex.Unlock()
+
+	if err := os.MkdirAll(networkdLeasesDir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(networkdConfigsDir, 0755); err != nil {
+		return err
+	}
+
+	for _, ifname := range listInitializedIfnames() {
+		var content []byte
+		if c, ok := configuredIfaces[ifname]; ok {
+			content = networkdConfig(ifname, c)
+		} else {
+			content = networkdLowerLinkConfig(ifname)
+		}
+		file := filepath.Join(networkdConfigsDir, "10-booster-"+ifname+".network")
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	// networkd ignores VLAN=, Bond= and Bridge= assignments to links it has no .netdev for
+	netdevMutex.Lock()
+	defer netdevMutex.Unlock()
+	for _, name := range createdLinks {
+		content := networkdNetdevConfig(name)
+		if content == nil {
+			continue
+		}
+		file := filepath.Join(networkdConfigsDir, "10-booster-"+name+".netdev")
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	for ifname, ack := range dhcpLeases {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(networkdLeasesDir, fmt.Sprint(link.Attrs().Index))
+		if err := os.WriteFile(file, formatDhcpLease(ack), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// networkdConfig generates a *.network file that matches the configuration used by booster
+func networkdConfig(ifname string, c *ifaceNetConfig) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# generated by booster, the interface was configured at early userspace\n")
+	fmt.Fprintf(&buf, "[Match]\nName=%s\n", ifname)
+
+	if c.mtu != 0 {
+		fmt.Fprintf(&buf, "\n[Link]\nMTUBytes=%d\n", c.mtu)
+	}
+
+	buf.WriteString("\n[Network]\n")
+	switch {
+	case c.Dhcp && c.Dhcp6:
+		buf.WriteString("DHCP=yes\n")
+	case c.Dhcp:
+		buf.WriteString("DHCP=ipv4\n")
+	case c.Dhcp6:
+		buf.WriteString("DHCP=ipv6\n")
+	}
+	if c.Slaac {
+		buf.WriteString("IPv6AcceptRA=yes\n")
+	}
+	for _, a := range []string{c.Ip, c.Ip6} {
+		if a != "" {
+			fmt.Fprintf(&buf, "Address=%s\n", a)
+		}
+	}
+	for _, gw := range []string{c.Gateway, c.Gateway6} {
+		if gw != "" {
+			fmt.Fprintf(&buf, "Gateway=%s\n", gw)
+		}
+	}
+	if c.DNSServers != "" {
+		for _, s := range strings.Split(c.DNSServers, ",") {
+			fmt.Fprintf(&buf, "DNS=%s\n", s)
+		}
+	}
+	for _, s := range cmdlineNameservers {
+		fmt.Fprintf(&buf, "DNS=%s\n", s)
+	}
+	for _, v := range netVlans {
+		if v.Parent == ifname {
+			fmt.Fprintf(&buf, "VLAN=%s\n", v.Name)
+		}
+	}
+	buf.WriteString("KeepConfiguration=yes\n")
+
+	return buf.Bytes()
+}
+
+// networkdLowerLinkConfig generates a *.network file for bond/bridge members and VLAN parents
+func networkdLowerLinkConfig(ifname string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# generated by booster, the interface was configured at early userspace\n")
+	fmt.Fprintf(&buf, "[Match]\nName=%s\n", ifname)
+
+	buf.WriteString("\n[Network]\n")
+	if master := linkMaster(ifname); master != "" {
+		kind := "Bridge"
+		for _, b := range netBonds {
+			if b.Name == master {
+				kind = "Bond"
+			}
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", kind, master)
+	}
+	for _, v := range netVlans {
+		if v.Parent == ifname {
+			fmt.Fprintf(&buf, "VLAN=%s\n", v.Name)
+		}
+	}
+	buf.WriteString("LinkLocalAddressing=no\n")
+	buf.WriteString("KeepConfiguration=yes\n")
+
+	return buf.Bytes()
+}
+
+// networkdNetdevConfig generates a *.netdev file for the virtual link created by booster, nil if the link is not declared
+func networkdNetdevConfig(name string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# generated by booster, the link was created at early userspace\n")
+
+	for _, v := range netVlans {
+		if v.Name == name {
+			fmt.Fprintf(&buf, "[NetDev]\nName=%s\nKind=vlan\n", name)
+			fmt.Fprintf(&buf, "\n[VLAN]\nId=%d\n", v.Id)
+			return buf.Bytes()
+		}
+	}
+	for _, b := range netBonds {
+		if b.Name == name {
+			fmt.Fprintf(&buf, "[NetDev]\nName=%s\nKind=bond\n", name)
+			if b.Mtu != 0 {
+				fmt.Fprintf(&buf, "MTUBytes=%d\n", b.Mtu)
+			}
+			buf.WriteString("\n[Bond]\n")
+			if b.Mode != "" {
+				fmt.Fprintf(&buf, "Mode=%s\n", b.Mode)
+			}
+			if b.Miimon != 0 {
+				fmt.Fprintf(&buf, "MIIMonitorSec=%dms\n", b.Miimon)
+			}
+			return buf.Bytes()
+		}
+	}
+	for _, b := range netBridges {
+		if b.Name == name {
+			fmt.Fprintf(&buf, "[NetDev]\nName=%s\nKind=bridge\n", name)
+			return buf.Bytes()
+		}
+	}
+	return nil
+}
+
+// formatDhcpLease serializes the lease in the format of systemd-networkd lease files
+func formatDhcpLease(ack *dhcpv4.DHCPv4) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# This is private data. Do not parse.\n")
+	fmt.Fprintf(&buf, "ADDRESS=%s\n", ack.YourIPAddr)
+	if mask := ack.SubnetMask(); mask != nil {
+		fmt.Fprintf(&buf, "NETMASK=%s\n", netmaskString(mask))
+	}
+	if routers := ack.Router(); len(routers) > 0 {
+		fmt.Fprintf(&buf, "ROUTER=%s\n", joinIPs(routers))
+	}
+	if server := ack.ServerIdentifier(); server != nil {
+		fmt.Fprintf(&buf, "SERVER_ADDRESS=%s\n", server)
+	}
+	lifetime := ack.IPAddressLeaseTime(0)
+	if lifetime != 0 {
+		fmt.Fprintf(&buf, "T1=%d\n", int(ack.IPAddressRenewalTime(lifetime/2)/time.Second))
+		fmt.Fprintf(&buf, "T2=%d\n", int(ack.IPAddressRebindingTime(lifetime*7/8)/time.Second))
+		fmt.Fprintf(&buf, "LIFETIME=%d\n", int(lifetime/time.Second))
+	}
+	if dns := ack.DNS(); len(dns) > 0 {
+		fmt.Fprintf(&buf, "DNS=%s\n", joinIPs(dns))
+	}
+	if domain := ack.DomainName(); domain != "" {
+		fmt.Fprintf(&buf, "DOMAINNAME=%s\n", domain)
+	}
+	if hostname := ack.HostName(); hostname != "" {
+		fmt.Fprintf(&buf, "HOSTNAME=%s\n", hostname)
+	}
+	return buf.Bytes()
+}
+
+func netmaskString(mask net.IPMask) string {
+	return net.IP(mask).String()
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, " ")
+}
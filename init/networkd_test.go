@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestNetworkdConfig(t *testing.T) {
+	c := &ifaceNetConfig{
+		InitNetworkConfig: InitNetworkConfig{Dhcp: true, Ip6: "2001:db8::15/64", Gateway6: "fe80::1", DNSServers: "10.0.2.3"},
+		mtu:               9000,
+	}
+	expected := `# generated by booster, the interface was configured at early userspace
+[Match]
+Name=eth0
+
+[Link]
+MTUBytes=9000
+
+[Network]
+DHCP=ipv4
+Address=2001:db8::15/64
+Gateway=fe80::1
+DNS=10.0.2.3
+KeepConfiguration=yes
+`
+	if got := string(networkdConfig("eth0", c)); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestNetworkdNetdevConfig(t *testing.T) {
+	prevVlans, prevBonds, prevBridges := netVlans, netBonds, netBridges
+	defer func() { netVlans, netBonds, netBridges = prevVlans, prevBonds, prevBridges }()
+
+	netVlans = []NetVlan{{Name: "vlan100", Parent: "bond0", Id: 100}}
+	netBonds = []NetBond{{Name: "bond0", Mode: "802.3ad", Members: []string{"eth0", "eth1"}, Miimon: 100, Mtu: 9000}}
+	netBridges = []NetBridge{{Name: "br0", Members: []string{"eth2"}}}
+
+	check := func(name, expected string) {
+		t.Helper()
+		if got := string(networkdNetdevConfig(name)); got != expected {
+			t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+		}
+	}
+	check("vlan100", `# generated by booster, the link was created at early userspace
+[NetDev]
+Name=vlan100
+Kind=vlan
+
+[VLAN]
+Id=100
+`)
+	check("bond0", `# generated by booster, the link was created at early userspace
+[NetDev]
+Name=bond0
+Kind=bond
+MTUBytes=9000
+
+[Bond]
+Mode=802.3ad
+MIIMonitorSec=100ms
+`)
+	check("br0", `# generated by booster, the link was created at early userspace
+[NetDev]
+Name=br0
+Kind=bridge
+`)
+	check("eth0", "")
+}
+
+func TestFormatDhcpLease(t *testing.T) {
+	ack, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithYourIP(net.IPv4(10, 0, 2, 15)),
+		dhcpv4.WithNetmask(net.CIDRMask(24, 32)),
+		dhcpv4.WithLeaseTime(3600),
+		dhcpv4.WithOption(dhcpv4.OptRouter(net.IPv4(10, 0, 2, 2))),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 2, 2))),
+		dhcpv4.WithOption(dhcpv4.OptDNS(net.IPv4(10, 0, 2, 3), net.IPv4(8, 8, 8, 8))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# This is private data. Do not parse.
+ADDRESS=10.0.2.15
+NETMASK=255.255.255.0
+ROUTER=10.0.2.2
+SERVER_ADDRESS=10.0.2.2
+T1=1800
+T2=3150
+LIFETIME=3600
+DNS=10.0.2.3 8.8.8.8
+`
+	if got := string(formatDhcpLease(ack)); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
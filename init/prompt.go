@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Password prompts from concurrently unlocked devices are serialized by the prompt manager: the requests are queued and
+// shown one at a time. Every prompt is mirrored on all consoles specified with console= boot param (e.g. a server might
+// have a serial console only while /dev/console points to VGA) and the first answer wins.
+
+// errPromptSkipped is returned if the answer is not needed anymore when the prompt turn comes
+var errPromptSkipped = errors.New("prompt is skipped")
+
+type promptRequest struct {
+	ctx     context.Context
+	message string
+	echo    string      // passwordEchoNo, passwordEchoMasked or passwordEchoYes
+	skip    func() bool // called right before the prompt is shown, returns true if the answer is not needed anymore
+	result  chan promptResult
+}
+
+type promptResult struct {
+	answer []byte
+	err    error
+}
+
+var (
+	promptQueue       = make(chan *promptRequest)
+	promptManagerOnce sync.Once
+
+	// outstandingPrompts is cancelled by cancelPrompts, the prompts asked after that get a new context
+	outstandingPrompts, cancelOutstandingPrompts = context.WithCancel(context.Background())
+	outstandingPromptsMutex                      sync.Mutex
+	// promptShown is held while a prompt owns the consoles
+	promptShown sync.Mutex
+)
+
+// askPassword shows the message on the consoles and reads a password. It waits until prompts requested earlier
+// are answered. If ctx is cancelled then the prompt is withdrawn. If user skips the prompt then errPasswordSkipped is returned.
+func askPassword(ctx context.Context, message, echo string, skip func() bool) ([]byte, error) {
+	promptManagerOnce.Do(func() {
+		go promptManager()
+	})
+
+	outstandingPromptsMutex.Lock()
+	outstanding := outstandingPrompts
+	outstandingPromptsMutex.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-outstanding.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req := &promptRequest{ctx: ctx, message: message, echo: echo, skip: skip, result: make(chan promptResult, 1)}
+	select {
+	case promptQueue <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	res := <-req.result
+	return res.answer, res.err
+}
+
+func promptManager() {
+	for req := range promptQueue {
+		promptShown.Lock()
+		req.result <- showPrompt(req)
+		promptShown.Unlock()
+	}
+}
+
+// cancelPrompts withdraws the shown and queued prompts and waits until the consoles get their terminal settings back.
+// It is called before a shell starts reading the console.
+func cancelPrompts() {
+	outstandingPromptsMutex.Lock()
+	cancelOutstandingPrompts()
+	outstandingPrompts, cancelOutstandingPrompts = context.WithCancel(context.Background())
+	outstandingPromptsMutex.Unlock()
+
+	// readPassword restores the terminal settings before the prompt releases the consoles
+	promptShown.Lock()
+	promptShown.Unlock()
+}
+
+// promptConsoles returns device paths of the consoles specified with console= boot params
+func promptConsoles() []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, c := range cmdlineValues("console") {
+		// console=ttyS0,115200n8
+		name := strings.Split(c, ",")[0]
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, "/dev/"+name)
+	}
+	if len(result) == 0 {
+		result = []string{"/dev/console"}
+	}
+	return result
+}
+
+func openPromptConsoles() []*os.File {
+	var consoles []*os.File
+	for _, path := range promptConsoles() {
+		f, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+		if err != nil {
+			debug("unable to open console %s: %v", path, err)
+			continue
+		}
+		consoles = append(consoles, f)
+	}
+	return consoles
+}
+
+func showPrompt(req *promptRequest) promptResult {
+	if err := req.ctx.Err(); err != nil {
+		return promptResult{err: err}
+	}
+	if req.skip != nil && req.skip() {
+		return promptResult{err: errPromptSkipped}
+	}
+
+	consoles := openPromptConsoles()
+	if len(consoles) == 0 {
+		return promptResult{err: fmt.Errorf("no console available to ask for a password")}
+	}
+
+	ctx, cancel := context.WithCancel(req.ctx)
+	defer cancel()
+
+	answers := make(chan promptResult, len(consoles))
+	for _, c := range consoles {
+		go func(c *os.File) {
+			defer c.Close()
+
+			for _, h := range keyboardHints(c) {
+				_, _ = fmt.Fprintln(c, h)
+			}
+			password, err := readPassword(ctx, c, req.message, req.echo)
+			if ctx.Err() != nil {
+				// the answer came from another console, or the request is cancelled
+				MemZeroBytes(password)
+				_, _ = fmt.Fprint(c, "\r\033[K")
+				answers <- promptResult{err: ctx.Err()}
+				return
+			}
+			_, _ = fmt.Fprintln(c)
+			answers <- promptResult{password, err}
+		}(c)
+	}
+
+	var result *promptResult
+	var lastErr error
+	for range consoles {
+		a := <-answers
+		if a.err != nil && a.err != errPasswordSkipped {
+			if a.err != context.Canceled {
+				lastErr = a.err
+			}
+			continue
+		}
+		if result != nil {
+			// two consoles answered at the same time
+			MemZeroBytes(a.answer)
+			continue
+		}
+		result = &a
+		cancel()
+	}
+
+	if result != nil {
+		return *result
+	}
+	if err := req.ctx.Err(); err != nil {
+		return promptResult{err: err}
+	}
+	return promptResult{err: lastErr}
+}
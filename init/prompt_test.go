@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPromptConsoles(t *testing.T) {
+	prevCmdline := cmdlineList
+	defer func() { cmdlineList = prevCmdline }()
+
+	cmdlineList = map[string][]string{}
+	if c := promptConsoles(); !reflect.DeepEqual(c, []string{"/dev/console"}) {
+		t.Fatalf("unexpected consoles %v", c)
+	}
+
+	cmdlineList = map[string][]string{"console": {"tty0", "ttyS0,115200n8", "ttyS0,9600", ""}}
+	if c := promptConsoles(); !reflect.DeepEqual(c, []string{"/dev/tty0", "/dev/ttyS0"}) {
+		t.Fatalf("unexpected consoles %v", c)
+	}
+}
+
+// openPty opens a pseudoterminal and returns its master file and the slave name relative to /dev
+func openPty(t *testing.T) (*os.File, string) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { master.Close() })
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Skip(err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Skip(err)
+	}
+	name := "pts/" + strconv.Itoa(n)
+	// keep the terminal open between prompts, otherwise reading the master returns EIO
+	slave, err := os.OpenFile("/dev/"+name, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { slave.Close() })
+	return master, name
+}
+
+// expectOutput reads the terminal output until it contains the string
+func expectOutput(t *testing.T, r *bufio.Reader, s string) {
+	t.Helper()
+	var out []byte
+	for !strings.Contains(string(out), s) {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("expected %q in output %q: %v", s, out, err)
+		}
+		out = append(out, b)
+	}
+}
+
+func TestAskPassword(t *testing.T) {
+	prevCmdline := cmdlineList
+	defer func() { cmdlineList = prevCmdline }()
+
+	master1, pts1 := openPty(t)
+	master2, pts2 := openPty(t)
+	cmdlineList = map[string][]string{"console": {pts1, pts2}}
+	out1, out2 := bufio.NewReader(master1), bufio.NewReader(master2)
+
+	// the prompt is mirrored on both consoles and the answer from the second one wins
+	answer := make(chan string, 1)
+	go func() {
+		password, err := askPassword(context.Background(), "Enter passphrase for cryptroot:", passwordEchoNo, nil)
+		if err != nil {
+			answer <- err.Error()
+			return
+		}
+		answer <- string(password)
+	}()
+	expectOutput(t, out1, "Enter passphrase for cryptroot:")
+	expectOutput(t, out2, "Enter passphrase for cryptroot:")
+	if _, err := master2.WriteString("1234\n"); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-answer; a != "1234" {
+		t.Fatalf("expected password 1234, got %s", a)
+	}
+	// the prompt is withdrawn from the first console
+	expectOutput(t, out1, "\r\033[K")
+
+	// the second prompt is skipped as the answer is not needed anymore
+	if _, err := askPassword(context.Background(), "Enter passphrase for home:", passwordEchoNo, func() bool { return true }); err != errPromptSkipped {
+		t.Fatalf("expected the prompt to be skipped, got %v", err)
+	}
+
+	// a cancelled request is withdrawn
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := askPassword(ctx, "Enter passphrase for swap:", passwordEchoNo, nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected the prompt to be cancelled, got %v", err)
+	}
+	expectOutput(t, out1, "Enter passphrase for swap:\r\033[K")
+
+	// Ctrl-C at any console skips the prompt
+	skipped := make(chan error, 1)
+	go func() {
+		_, err := askPassword(context.Background(), "Enter passphrase for data:", passwordEchoMasked, nil)
+		skipped <- err
+	}()
+	expectOutput(t, out1, "Enter passphrase for data:")
+	if _, err := master1.WriteString("12\x03"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-skipped; err != errPasswordSkipped {
+		t.Fatalf("expected the prompt to be skipped by user, got %v", err)
+	}
+
+	// a shell withdraws the pending prompt and gets the console back in the canonical mode
+	pending := make(chan error, 1)
+	go func() {
+		_, err := askPassword(context.Background(), "Enter passphrase for root:", passwordEchoNo, nil)
+		pending <- err
+	}()
+	expectOutput(t, out1, "Enter passphrase for root:")
+	cancelPrompts()
+	if err := <-pending; err != context.Canceled {
+		t.Fatalf("expected the prompt to be cancelled, got %v", err)
+	}
+	pts, err := os.Open("/dev/" + pts1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pts.Close()
+	termios, err := unix.IoctlGetTermios(int(pts.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&(unix.ECHO|unix.ICANON) != unix.ECHO|unix.ICANON {
+		t.Fatal("terminal settings are not restored after the prompt is cancelled")
+	}
+
+	// the prompts asked later are shown as usual
+	go func() {
+		password, _ := askPassword(context.Background(), "Enter passphrase for cryptroot:", passwordEchoNo, nil)
+		answer <- string(password)
+	}()
+	expectOutput(t, out1, "Enter passphrase for cryptroot:")
+	if _, err := master1.WriteString("5678\n"); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-answer; a != "5678" {
+		t.Fatalf("expected password 5678, got %s", a)
+	}
+}
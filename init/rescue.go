@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// If the boot fails and the image does not contain busybox then init starts a minimal built-in rescue shell.
+// It provides enough commands to inspect the system, fix the boot params (e.g. a mistyped root=), unlock or
+// mount devices by hand and then continue the boot without rebuilding the image.
+
+// rescueMountTimeout is used by 'continue' command if the config asks to wait for the root forever
+const rescueMountTimeout = 10 * time.Second
+
+var errRescueContinue = errors.New("continue boot")
+
+type rescueCommand struct {
+	usage string
+	help  string
+	run   func(w io.Writer, args []string) error
+}
+
+var rescueCommands map[string]*rescueCommand
+
+func init() {
+	rescueCommands = map[string]*rescueCommand{
+		"help":     {"help", "show this help", rescueHelp},
+		"ls":       {"ls [PATH...]", "list directory content", rescueLs},
+		"cat":      {"cat FILE...", "print file content", rescueCat},
+		"dmesg":    {"dmesg", "print the kernel log", rescueDmesg},
+		"blkid":    {"blkid [DEVICE...]", "print block devices type, UUID and label", rescueBlkid},
+		"lsmod":    {"lsmod", "list loaded kernel modules", rescueLsmod},
+		"modprobe": {"modprobe MODULE...", "load kernel modules from the image", rescueModprobe},
+		"mount":    {"mount [-t TYPE] [-o OPTIONS] DEVICE DIR", "mount a filesystem, print mounts if no args given", rescueMount},
+		"umount":   {"umount DIR...", "unmount filesystems", rescueUmount},
+		"unlock":   {"unlock DEVICE [NAME]", "unlock a LUKS device as /dev/mapper/NAME", rescueUnlock},
+		"cmdline":  {"cmdline [KEY=VALUE...]", "print boot params or override them, e.g. cmdline root=UUID=<uuid>", rescueCmdline},
+		"continue": {"continue", "rescan devices with the current boot params and continue the boot", func(io.Writer, []string) error { return errRescueContinue }},
+		"reboot":   {"reboot", "reboot the computer", func(io.Writer, []string) error { return rescueReboot(unix.LINUX_REBOOT_CMD_RESTART) }},
+		"poweroff": {"poweroff", "power off the computer", func(io.Writer, []string) error { return rescueReboot(unix.LINUX_REBOOT_CMD_POWER_OFF) }},
+	}
+}
+
+// rescueShell reads commands from the console. It returns if the input is closed.
+func rescueShell() {
+	fmt.Println("Starting the rescue shell, type 'help' to list available commands")
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("booster# ")
+		if !in.Scan() {
+			return
+		}
+		// the watchdog stays armed unless the shell is requested explicitly, user input keeps it alive
+		petWatchdog()
+		err := runRescueCommand(os.Stdout, in.Text())
+		if err == errRescueContinue {
+			err = continueBoot()
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func runRescueCommand(w io.Writer, line string) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+	cmd, ok := rescueCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("%s: command not found, type 'help' to list available commands", args[0])
+	}
+	if err := cmd.run(w, args[1:]); err != nil {
+		if err == errRescueContinue {
+			return err
+		}
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	return nil
+}
+
+// continueBoot matches the devices against the current boot params again and switches to the root filesystem
+func continueBoot() error {
+	if isMountpoint(newRoot) {
+		// the root filesystem is mounted by hand with 'mount DEVICE /booster.root'
+		markRootMounted()
+	} else {
+		rescanBlockDevices()
+	}
+
+	timeout := time.Duration(config.MountTimeout) * time.Second
+	if timeout == 0 {
+		timeout = rescueMountTimeout
+	}
+	if err := waitForRoot(timeout); err != nil {
+		return err
+	}
+	cleanup()
+	return switchRoot()
+}
+
+// rescanBlockDevices runs block devices that have been seen during the boot through root= and rd.luks.* matching again
+func rescanBlockDevices() {
+	if isMountpoint(newRoot) {
+		return
+	}
+
+	diagMutex.Lock()
+	var devices []*diagBlockDevice
+	for _, d := range diagBlockDevices {
+		status, isLuks := diagLuksStatus[d.path]
+		if d.info == nil || (isLuks && (strings.HasPrefix(status, "waiting") || strings.HasPrefix(status, "unlocked"))) {
+			continue
+		}
+		devices = append(devices, d)
+	}
+	diagMutex.Unlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].path < devices[j].path })
+
+	for _, d := range devices {
+		if err := matchBlockDevice(d.path, d.info); err != nil {
+			warning("%s: %v", d.path, err)
+		}
+	}
+}
+
+// isMountpoint reports whether a filesystem is mounted at the directory
+func isMountpoint(dir string) bool {
+	var st, parent unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return false
+	}
+	if err := unix.Stat(filepath.Dir(dir), &parent); err != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+func rescueHelp(w io.Writer, _ []string) error {
+	names := make([]string, 0, len(rescueCommands))
+	for n := range rescueCommands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		c := rescueCommands[n]
+		_, _ = fmt.Fprintf(w, "  %-42s %s\n", c.usage, c.help)
+	}
+	return nil
+}
+
+func rescueLs(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	for _, p := range args {
+		st, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if !st.IsDir() {
+			printFileInfo(w, filepath.Dir(p), st)
+			continue
+		}
+		if len(args) > 1 {
+			_, _ = fmt.Fprintf(w, "%s:\n", p)
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			printFileInfo(w, p, info)
+		}
+	}
+	return nil
+}
+
+func printFileInfo(w io.Writer, dir string, info os.FileInfo) {
+	name := info.Name()
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(filepath.Join(dir, name)); err == nil {
+			name += " -> " + target
+		}
+	}
+	_, _ = fmt.Fprintf(w, "%s %10d %s\n", info.Mode(), info.Size(), name)
+}
+
+func rescueCat(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no files specified")
+	}
+	for _, p := range args {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rescueDmesg(w io.Writer, _ []string) error {
+	size, err := unix.Klogctl(unix.SYSLOG_ACTION_SIZE_BUFFER, nil)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	n, err := unix.Klogctl(unix.SYSLOG_ACTION_READ_ALL, buf)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf[:n])
+	return err
+}
+
+func rescueBlkid(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		entries, err := os.ReadDir("/sys/class/block")
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			args = append(args, "/dev/"+e.Name())
+		}
+	}
+	for _, dev := range args {
+		info, err := readBlkInfo(dev)
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "%s: %v\n", dev, err)
+			continue
+		}
+		_, _ = fmt.Fprintln(w, formatBlkid(dev, info))
+	}
+	return nil
+}
+
+// formatBlkid formats the device information the same way as blkid tool does
+func formatBlkid(dev string, info *blkInfo) string {
+	s := dev + ":"
+	if len(info.uuid) != 0 {
+		s += fmt.Sprintf(" UUID=%q", info.uuid.toString())
+	}
+	if info.label != "" {
+		s += fmt.Sprintf(" LABEL=%q", info.label)
+	}
+	return s + fmt.Sprintf(" TYPE=%q", info.format)
+}
+
+func rescueLsmod(w io.Writer, _ []string) error {
+	f, err := os.Open("/proc/modules")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _ = fmt.Fprintf(w, "%-24s %8s  %s\n", "Module", "Size", "Used by")
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// ext4 753664 1 - Live 0x0000000000000000
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		usedBy := strings.TrimSuffix(strings.ReplaceAll(fields[3], "-", ""), ",")
+		_, _ = fmt.Fprintf(w, "%-24s %8s  %s %s\n", fields[0], fields[1], fields[2], usedBy)
+	}
+	return s.Err()
+}
+
+func rescueModprobe(_ io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no modules specified")
+	}
+	modules := make([]string, len(args))
+	for i, m := range args {
+		modules[i] = normalizeModuleName(m)
+	}
+	return loadModules(modules...).Wait()
+}
+
+func rescueMount(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return rescueCat(w, []string{"/proc/self/mounts"})
+	}
+
+	var fstype, options string
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-t", "-o":
+			if i+1 == len(args) {
+				return fmt.Errorf("option %s requires a value", args[i])
+			}
+			if args[i] == "-t" {
+				fstype = args[i+1]
+			} else {
+				options = args[i+1]
+			}
+			i++
+		default:
+			positional = append(positional, args[i])
+		}
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: %s", rescueCommands["mount"].usage)
+	}
+	dev, dir := positional[0], positional[1]
+
+	if fstype == "" {
+		info, err := readBlkInfo(dev)
+		if err != nil {
+			return fmt.Errorf("%s: unable to detect filesystem type, specify it with -t: %v", dev, err)
+		}
+		fstype = info.format
+	}
+	if err := loadModules(fstype).Wait(); err != nil {
+		// the filesystem might be compiled into the kernel
+		debug("%v", err)
+	}
+	flags, opts := sunderMountFlags(options)
+	return mount(dev, dir, fstype, flags, opts)
+}
+
+func rescueUmount(_ io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no directories specified")
+	}
+	for _, dir := range args {
+		if err := unix.Unmount(dir, 0); err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+func rescueUnlock(w io.Writer, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: %s", rescueCommands["unlock"].usage)
+	}
+	dev := args[0]
+	info, err := readBlkInfo(dev)
+	if err != nil {
+		return err
+	}
+	if info.format != "luks" {
+		return fmt.Errorf("%s is not a LUKS device", dev)
+	}
+	name := "luks-" + info.uuid.toString()
+	if len(args) == 2 {
+		name = args[1]
+	}
+	if err := luksOpen(dev, name); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "%s is unlocked as /dev/mapper/%s\n", dev, name)
+	return nil
+}
+
+func rescueCmdline(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		params := cmdlineSnapshot()
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if v := params[k]; v != "" {
+				_, _ = fmt.Fprintf(w, "%s=%s\n", k, v)
+			} else {
+				_, _ = fmt.Fprintln(w, k)
+			}
+		}
+		return nil
+	}
+
+	for _, a := range args {
+		key, val := a, ""
+		if idx := strings.IndexByte(a, '='); idx > -1 {
+			key, val = a[:idx], a[idx+1:]
+		}
+		setCmdlineParam(key, val)
+	}
+	return nil
+}
+
+func rescueReboot(cmd int) error {
+	unix.Sync()
+	return unix.Reboot(cmd)
+}
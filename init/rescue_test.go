@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRescueCommands(t *testing.T) {
+	var out bytes.Buffer
+	if err := runRescueCommand(&out, "  "); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRescueCommand(&out, "vi /etc/fstab"); err == nil || !strings.Contains(err.Error(), "command not found") {
+		t.Fatalf("expected unknown command error, got %v", err)
+	}
+	if err := runRescueCommand(&out, "continue"); err != errRescueContinue {
+		t.Fatalf("expected continue request, got %v", err)
+	}
+	if err := runRescueCommand(&out, "mount -t ext4 /dev/vda1"); err == nil || !strings.Contains(err.Error(), "usage:") {
+		t.Fatalf("expected usage error, got %v", err)
+	}
+
+	if err := runRescueCommand(&out, "help"); err != nil {
+		t.Fatal(err)
+	}
+	for name := range rescueCommands {
+		if !strings.Contains(out.String(), "  "+name) {
+			t.Fatalf("help does not describe %s:\n%s", name, out.String())
+		}
+	}
+}
+
+func TestRescueLsCat(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fstab"), []byte("UUID=1234 / ext4 defaults 0 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the mode is not affected by umask
+	if err := os.Chmod(filepath.Join(dir, "fstab"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("fstab", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runRescueCommand(&out, "ls "+dir); err != nil {
+		t.Fatal(err)
+	}
+	expected := "-rw-r--r--         30 fstab\nLrwxrwxrwx          5 link -> fstab\n"
+	if out.String() != expected {
+		t.Fatalf("unexpected ls output %q", out.String())
+	}
+
+	out.Reset()
+	if err := runRescueCommand(&out, "cat "+filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "UUID=1234 / ext4 defaults 0 1\n" {
+		t.Fatalf("unexpected cat output %q", out.String())
+	}
+
+	if err := runRescueCommand(&out, "cat "+filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestRescueCmdline(t *testing.T) {
+	prevCmdline, prevCmdlineList := cmdline, cmdlineList
+	defer func() { cmdline, cmdlineList = prevCmdline, prevCmdlineList }()
+
+	cmdline = map[string]string{"root": "/dev/sda2", "quiet": ""}
+	cmdlineList = map[string][]string{"root": {"/dev/sda2"}}
+
+	// device handlers read the boot params while they are modified, 'go test -race' catches unguarded access
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = cmdlineValue("root")
+			_ = cmdlineValues("root")
+		}
+	}()
+	var out bytes.Buffer
+	if err := runRescueCommand(&out, "cmdline root=UUID=7bbf9363-eb42-4476-8c1c-9f1f4d091385 rd.luks.uuid=639b8fdd booster.debug"); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if err := runRescueCommand(&out, "cmdline"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "booster.debug\nquiet\nrd.luks.uuid=639b8fdd\nroot=UUID=7bbf9363-eb42-4476-8c1c-9f1f4d091385\n"
+	if out.String() != expected {
+		t.Fatalf("unexpected cmdline output %q", out.String())
+	}
+	if !reflect.DeepEqual(cmdlineList["root"], []string{"UUID=7bbf9363-eb42-4476-8c1c-9f1f4d091385"}) {
+		t.Fatalf("unexpected root list %v", cmdlineList["root"])
+	}
+}
+
+func TestRescueModprobe(t *testing.T) {
+	prevLoader := loadModuleFile
+	defer func() {
+		loadModuleFile = prevLoader
+		moduleLoads = make(map[string]*moduleFuture)
+	}()
+	moduleLoads = make(map[string]*moduleFuture)
+
+	var loaded []string
+	var mu sync.Mutex
+	loadModuleFile = func(module string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		loaded = append(loaded, module)
+		return nil
+	}
+	if err := runRescueCommand(io.Discard, "modprobe snd-hda-intel"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, []string{"snd_hda_intel"}) {
+		t.Fatalf("expected normalized module name, loaded %v", loaded)
+	}
+}
+
+func TestFormatBlkid(t *testing.T) {
+	uuid, _ := parseUUID("7bbf9363-eb42-4476-8c1c-9f1f4d091385")
+	if s := formatBlkid("/dev/vda1", &blkInfo{"ext4", true, uuid, "root"}); s != `/dev/vda1: UUID="7bbf9363-eb42-4476-8c1c-9f1f4d091385" LABEL="root" TYPE="ext4"` {
+		t.Fatalf("unexpected blkid output %s", s)
+	}
+	if s := formatBlkid("/dev/vda", &blkInfo{format: "gpt"}); s != `/dev/vda: TYPE="gpt"` {
+		t.Fatalf("unexpected blkid output %s", s)
+	}
+}
+
+func TestIsMountpoint(t *testing.T) {
+	if !isMountpoint("/proc") {
+		t.Fatal("/proc expected to be a mountpoint")
+	}
+	if isMountpoint(t.TempDir()) {
+		t.Fatal("a temporary directory is not a mountpoint")
+	}
+}
+
+func TestMarkRootMounted(t *testing.T) {
+	// the root can be mounted both by the device handler and by hand from the rescue shell
+	rootMounted.Add(1)
+	markRootMounted()
+	markRootMounted()
+	if waitTimeout(&rootMounted, time.Second) {
+		t.Fatal("root is not marked as mounted")
+	}
+}
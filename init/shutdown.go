@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anatol/devmapper.go"
+	"golang.org/x/sys/unix"
+)
+
+// Init supports systemd shutdown-initrd protocol (see https://systemd.io/INITRD_INTERFACE/). If /run/initramfs/shutdown
+// exists then systemd-shutdown pivots into /run/initramfs, moves the old root to /oldroot and executes /shutdown.
+// The root filesystem on LUKS, LVM or network storage is still in use by the OS so it can be unmounted cleanly only
+// from outside of it. Init copies itself into /run/initramfs and acts as the shutdown helper when started as 'shutdown'.
+
+const (
+	shutdownDir    = "/run/initramfs"
+	shutdownName   = "shutdown"
+	shutdownOldDir = "/oldroot"
+)
+
+// prepareShutdownHelper copies init binary to /run/initramfs, it has to be done before the ramfs content is removed
+func prepareShutdownHelper() error {
+	content, err := os.ReadFile("/init")
+	if err != nil {
+		return err
+	}
+	// systemd-shutdown moves /dev, /proc, /sys and /run into the new root if these directories exist
+	for _, d := range []string{"dev", "proc", "sys", "run", shutdownOldDir} {
+		if err := os.MkdirAll(filepath.Join(shutdownDir, d), 0755); err != nil {
+			return err
+		}
+	}
+	debug("installing shutdown helper to %s", shutdownDir)
+	return os.WriteFile(filepath.Join(shutdownDir, shutdownName), content, 0755)
+}
+
+var shutdownVerbs = map[string]bool{"reboot": true, "poweroff": true, "halt": true, "kexec": true}
+
+// parseShutdownVerb returns the action requested by systemd-shutdown. It is called as
+// '/shutdown reboot --timeout 90000000us --log-level 6 --log-target kmsg'.
+func parseShutdownVerb(args []string) (string, error) {
+	for _, a := range args {
+		if shutdownVerbs[a] {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("no shutdown action specified in %v", args)
+}
+
+// mountsUnder returns mountpoints from /proc/self/mountinfo content that are located under dir.
+// The result is ordered so that nested mountpoints go before their parents.
+func mountsUnder(mountinfo, dir string) []string {
+	var result []string
+	for _, line := range strings.Split(mountinfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		// mountinfo escapes spaces and other special symbols with octal codes
+		mnt := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(fields[4])
+		if mnt == dir || strings.HasPrefix(mnt, dir+"/") {
+			result = append(result, mnt)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return strings.Count(result[i], "/") > strings.Count(result[j], "/")
+	})
+	return result
+}
+
+// unmountOldRoot unmounts the old root filesystem and everything mounted under it.
+// Filesystems that cannot be unmounted are remounted read-only to flush their data.
+func unmountOldRoot() error {
+	const attempts = 5
+
+	var mounts []string
+	for i := 0; i < attempts; i++ {
+		data, err := os.ReadFile("/proc/self/mountinfo")
+		if err != nil {
+			return err
+		}
+		mounts = mountsUnder(string(data), shutdownOldDir)
+		if len(mounts) == 0 {
+			return nil
+		}
+
+		progress := false
+		for _, m := range mounts {
+			if err := unix.Unmount(m, 0); err != nil {
+				debug("unmount(%s): %v", m, err)
+				continue
+			}
+			progress = true
+		}
+		if !progress {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for _, m := range mounts {
+		if err := unix.Mount("", m, "", unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			debug("remount(%s) read-only: %v", m, err)
+		}
+	}
+	return fmt.Errorf("unable to unmount %s", strings.Join(mounts, ", "))
+}
+
+// closeMapperDevices removes all device mapper devices, e.g. dm-crypt and LVM mappings.
+// Devices can be stacked on top of each other, the upper devices need to be removed first.
+func closeMapperDevices() error {
+	for {
+		devices, err := devmapper.List()
+		if err != nil {
+			return err
+		}
+		if len(devices) == 0 {
+			return nil
+		}
+
+		var failed []string
+		for _, d := range devices {
+			if err := devmapper.Remove(d.Name); err != nil {
+				debug("devmapper.Remove(%s): %v", d.Name, err)
+				failed = append(failed, d.Name)
+				continue
+			}
+			debug("device %s is closed", d.Name)
+		}
+		if len(failed) == len(devices) {
+			return fmt.Errorf("unable to close devices %s", strings.Join(failed, ", "))
+		}
+	}
+}
+
+// shutdownMain is the entry point when init is started by systemd-shutdown as /run/initramfs/shutdown
+func shutdownMain(args []string) {
+	kmsg, _ = os.OpenFile("/dev/kmsg", unix.O_WRONLY, 0600)
+
+	verb, err := parseShutdownVerb(args)
+	if err != nil {
+		severe("shutdown: %v, powering off", err)
+		verb = "poweroff"
+	}
+	debug("returned to initramfs to %s the machine", verb)
+
+	unix.Sync()
+	if err := unmountOldRoot(); err != nil {
+		warning("%v", err)
+	}
+	if err := closeMapperDevices(); err != nil {
+		warning("%v", err)
+	}
+	unix.Sync()
+
+	switch verb {
+	case "kexec":
+		if err := unix.Reboot(unix.LINUX_REBOOT_CMD_KEXEC); err != nil {
+			warning("kexec: %v, rebooting", err)
+		}
+		_ = unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART)
+	case "reboot":
+		_ = unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART)
+	case "halt":
+		_ = unix.Reboot(unix.LINUX_REBOOT_CMD_HALT)
+	default:
+		_ = unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF)
+	}
+
+	// the helper runs as PID 1, it must not exit
+	severe("shutdown: unable to %s the machine", verb)
+	for {
+		time.Sleep(time.Hour)
+	}
+}
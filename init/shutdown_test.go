@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseShutdownVerb(t *testing.T) {
+	check := func(args []string, expected string) {
+		verb, err := parseShutdownVerb(args)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		if verb != expected {
+			t.Fatalf("%v: expected %s, got %s", args, expected, verb)
+		}
+	}
+
+	check([]string{"reboot", "--timeout", "90000000us", "--log-level", "6", "--log-target", "kmsg"}, "reboot")
+	check([]string{"--log-level=info", "poweroff"}, "poweroff")
+	check([]string{"kexec"}, "kexec")
+	check([]string{"halt"}, "halt")
+
+	for _, args := range [][]string{{}, {"suspend"}, {"--timeout", "90s"}} {
+		if _, err := parseShutdownVerb(args); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestMountsUnder(t *testing.T) {
+	mountinfo := `22 1 0:21 / / rw,relatime - tmpfs rootfs rw
+25 22 0:5 / /dev rw,nosuid - devtmpfs dev rw,size=4020892k
+30 22 254:1 / /oldroot rw,relatime - ext4 /dev/mapper/root rw
+31 30 254:2 / /oldroot/home rw,relatime - ext4 /dev/mapper/vg-home rw
+32 31 0:40 / /oldroot/home/user/my\040disk rw,relatime - fuse.sshfs host: rw
+33 30 0:41 / /oldroot/boot rw,relatime - vfat /dev/vda1 rw
+34 22 0:42 / /oldrootfs rw,relatime - tmpfs tmpfs rw
+`
+	expected := []string{"/oldroot/home/user/my disk", "/oldroot/home", "/oldroot/boot", "/oldroot"}
+	if mounts := mountsUnder(mountinfo, "/oldroot"); !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("expected %v, got %v", expected, mounts)
+	}
+	if mounts := mountsUnder(mountinfo, "/nonexistent"); mounts != nil {
+		t.Fatalf("unexpected mounts %v", mounts)
+	}
+}
@@ -81,6 +81,7 @@ func udevListener() {
 			return
 		}
 		debug("udev event %+v", *ev)
+		petWatchdog()
 
 		if modalias, ok := ev.Vars["MODALIAS"]; ok {
 			err = loadModalias(modalias)
@@ -88,6 +89,11 @@ func udevListener() {
 			err = handleBlockDeviceUevent(ev)
 		} else if ev.Subsystem == "net" {
 			err = handleNetworkUevent(ev)
+		} else if ev.Subsystem == "tpmrm" && ev.Action == "add" {
+			// the TPM driver is loaded, measure the events queued before it
+			go flushMeasurements()
+		} else if ev.Subsystem == "watchdog" && ev.Action == "add" {
+			go openWatchdog()
 		}
 
 		if err != nil {
@@ -106,28 +112,50 @@ func handleNetworkUevent(ev *uevent.Uevent) error {
 		return nil
 	}
 
-	if config.Network == nil {
+	if !networkEnabled() {
 		debug("network is disabled, skipping interface %s", ifname)
 		return nil
 	}
 
-	if len(config.Network.Interfaces) > 0 {
+	if isWireguardLink(ifname) {
+		return nil // the tunnel is configured by setupWireguard
+	}
+
+	if isLowerLink(ifname) {
+		// addresses are configured at the upper link (bond, bridge or VLAN), here we only bring the link up
+		go func() {
+			if err := setupLowerLink(ifname); err != nil {
+				warning("unable to set up network interface %s: %v", ifname, err)
+			}
+		}()
+		return nil
+	}
+
+	iface := &netIface{names: []string{ifname}}
+	// virtual links have no MAC address and predictable names
+	if !isVirtualLink(ifname) {
 		i, err := net.InterfaceByName(ifname)
 		if err != nil {
 			return err
 		}
+		iface.hwAddr = i.HardwareAddr
+		iface.names = append(iface.names, predictableNames(ifname)...)
+		debug("interface %s has names %v", ifname, iface.names[1:])
+	}
 
-		if !macListContains(i.HardwareAddr, config.Network.Interfaces) {
-			debug("interface %s is not in 'active' list, skipping it", ifname)
-			return nil
-		}
+	c := findNetworkConfig(iface)
+	if c == nil {
+		debug("interface %s is not in 'active' list, skipping it", ifname)
+		return nil
 	}
 
 	go func() {
 		// run network init in a separate goroutine to avoid it blocking with clevis+tang unlocking
-		if err := initializeNetworkInterface(ifname); err != nil {
+		if err := initializeNetworkInterface(ifname, c); err != nil {
 			warning("unable to initialize network interface %s: %v\n", ifname, err)
+			return
 		}
+		startWireguard()
 	}()
 
 	return nil
@@ -186,17 +214,5 @@ func handleMapperDeviceUevent(ev *uevent.Uevent) (string, error) {
 		return "", err
 	}
 
-	return dmBlockDev, devMapperUpdateUdevDb(major, minor)
-}
-
-// devMapperUpdateUdevDb writes Udev state to the database.
-// It is an equivalent to what "db_persist" udev option does (see 'man 7 udev').
-func devMapperUpdateUdevDb(major, minor int) error {
-	if err := os.MkdirAll("/run/udev/data/", 0755); err != nil {
-		return err
-	}
-
-	dbFile := fmt.Sprintf("/run/udev/data/b%d:%d", major, minor)
-	debug("writing udev state to %s", dbFile)
-	return os.WriteFile(dbFile, []byte("E:DM_UDEV_PRIMARY_SOURCE_FLAG=1\n"), 0644)
+	return dmBlockDev, nil
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// Init writes udev database records for block devices it probes. After switch_root systemd-udevd and systemd
+// read the device properties from /run/udev/data. Without the records devices have no ID_FS_* properties and
+// systemd does not consider them ready until they are retriggered.
+// The file format matches what udev_device_update_db() from systemd writes.
+
+const (
+	udevDataDir = "/run/udev/data"
+	udevTagsDir = "/run/udev/tags"
+	udevTag     = "systemd" // 99-systemd.rules tags all block devices
+)
+
+type udevRecord struct {
+	id         string   // device id in the database, e.g. b8:1
+	kernelName string   // e.g. sda1 or dm-0
+	symlinks   []string // relative to /dev
+	properties map[string]string
+	tags       []string
+	initUsec   uint64
+}
+
+func (r *udevRecord) set(key, value string) {
+	if value != "" {
+		r.properties[key] = value
+	}
+}
+
+// encode formats the record the way udev stores it in the database
+func (r *udevRecord) encode() []byte {
+	var b bytes.Buffer
+	for _, s := range r.symlinks {
+		fmt.Fprintf(&b, "S:%s\n", s)
+	}
+	fmt.Fprintf(&b, "I:%d\n", r.initUsec)
+
+	keys := make([]string, 0, len(r.properties))
+	for k := range r.properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "E:%s=%s\n", k, r.properties[k])
+	}
+
+	for _, t := range r.tags {
+		fmt.Fprintf(&b, "G:%s\n", t)
+	}
+	for _, t := range r.tags {
+		fmt.Fprintf(&b, "Q:%s\n", t) // current tags, systemd 247+
+	}
+	b.WriteString("V:1\n")
+	return b.Bytes()
+}
+
+// udevEncode escapes the string the same way as udev does it for symlink names and *_ENC properties
+func udevEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if size > 1 && r != utf8.RuneError {
+			b.WriteString(s[i : i+size])
+			i += size
+			continue
+		}
+
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("#+-.:=@_", c) != -1 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+		i++
+	}
+	return b.String()
+}
+
+// udevSafe replaces whitespaces the same way as blkid does it for ID_FS_LABEL property
+func udevSafe(s string) string {
+	return strings.Join(strings.Fields(s), "_")
+}
+
+func (r *udevRecord) addBlkInfo(info *blkInfo) {
+	if info == nil || info.format == "" {
+		return
+	}
+
+	uuid := ""
+	if len(info.uuid) != 0 {
+		uuid = info.uuid.toString()
+	}
+
+	switch info.format {
+	case "gpt", "mbr":
+		tableType := info.format
+		if tableType == "mbr" {
+			tableType = "dos"
+		}
+		r.set("ID_PART_TABLE_TYPE", tableType)
+		r.set("ID_PART_TABLE_UUID", uuid)
+		return
+	case "luks":
+		r.set("ID_FS_TYPE", "crypto_LUKS")
+		r.set("ID_FS_USAGE", "crypto")
+	case "verity":
+		r.set("ID_FS_TYPE", "DM_verity_hash")
+		r.set("ID_FS_USAGE", "crypto")
+	default:
+		r.set("ID_FS_TYPE", info.format)
+		if info.isFs {
+			r.set("ID_FS_USAGE", "filesystem")
+		}
+	}
+
+	r.set("ID_FS_UUID", uuid)
+	r.set("ID_FS_UUID_ENC", udevEncode(uuid))
+	r.set("ID_FS_LABEL", udevSafe(info.label))
+	r.set("ID_FS_LABEL_ENC", udevEncode(info.label))
+	if uuid != "" {
+		r.symlinks = append(r.symlinks, "disk/by-uuid/"+udevEncode(uuid))
+	}
+	if info.label != "" {
+		r.symlinks = append(r.symlinks, "disk/by-label/"+udevEncode(info.label))
+	}
+}
+
+func (r *udevRecord) addPartEntry(entry *partEntry, disk string) {
+	if entry == nil {
+		return
+	}
+	r.set("ID_PART_ENTRY_SCHEME", entry.scheme)
+	r.set("ID_PART_ENTRY_NUMBER", fmt.Sprint(entry.number))
+	r.set("ID_PART_ENTRY_UUID", entry.uuid)
+	r.set("ID_PART_ENTRY_TYPE", entry.typ)
+	r.set("ID_PART_ENTRY_NAME", udevEncode(entry.name))
+	r.set("ID_PART_ENTRY_DISK", disk)
+	r.symlinks = append(r.symlinks, "disk/by-partuuid/"+entry.uuid)
+	if entry.name != "" {
+		r.symlinks = append(r.symlinks, "disk/by-partlabel/"+udevEncode(entry.name))
+	}
+}
+
+// addDeviceMapper adds properties that are set by 10-dm.rules and 13-dm-disk.rules
+func (r *udevRecord) addDeviceMapper(name, uuid string) {
+	r.set("DM_NAME", name)
+	r.set("DM_UUID", uuid)
+	r.set("DM_SUSPENDED", "0")
+	r.set("DM_UDEV_RULES_VSN", "2")
+	r.set("DM_UDEV_PRIMARY_SOURCE_FLAG", "1")
+	r.symlinks = append(r.symlinks, "mapper/"+name, "disk/by-id/dm-name-"+udevEncode(name))
+	if uuid != "" {
+		r.symlinks = append(r.symlinks, "disk/by-id/dm-uuid-"+udevEncode(uuid))
+	}
+
+	// 99-systemd.rules: a crypt device that has no recognized content yet is not ready to be used
+	if strings.HasPrefix(uuid, "CRYPT-") && r.properties["ID_FS_USAGE"] == "" && r.properties["ID_PART_TABLE_TYPE"] == "" {
+		r.set("SYSTEMD_READY", "0")
+	}
+}
+
+func readSysfsString(dir, attr string) string {
+	data, err := os.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// newUdevRecord creates the database record for a block device described by the sysfs directory 'sysDir'.
+// 'readPartition' reads the partition entry from the given parent disk.
+func newUdevRecord(sysDir string, info *blkInfo, readPartition func(disk string, number int) *partEntry) (*udevRecord, error) {
+	dir, err := filepath.EvalSymlinks(sysDir)
+	if err != nil {
+		return nil, err
+	}
+	dev := readSysfsString(dir, "dev")
+	if dev == "" {
+		return nil, fmt.Errorf("%s: unable to read device number", dir)
+	}
+
+	r := &udevRecord{
+		id:         "b" + dev,
+		kernelName: filepath.Base(dir),
+		properties: make(map[string]string),
+		tags:       []string{udevTag},
+	}
+
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err == nil {
+		r.initUsec = uint64(ts.Nano() / 1000)
+	}
+
+	r.addBlkInfo(info)
+	if number, err := readSysfsInt(dir, "partition"); err == nil {
+		disk := filepath.Dir(dir)
+		r.addPartEntry(readPartition(filepath.Base(disk), number), readSysfsString(disk, "dev"))
+	}
+	if name := readSysfsString(dir, "dm/name"); name != "" {
+		r.addDeviceMapper(name, readSysfsString(dir, "dm/uuid"))
+	}
+	if _, ok := r.properties["SYSTEMD_READY"]; !ok {
+		r.set("SYSTEMD_READY", "1")
+	}
+	return r, nil
+}
+
+// readDevicePartition returns the partition table entry for the partition block device, or nil if it is not a partition
+func readDevicePartition(devpath string) *partEntry {
+	devNo, err := deviceNo(devpath)
+	if err != nil {
+		return nil
+	}
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(devNo), unix.Minor(devNo)))
+	if err != nil {
+		return nil
+	}
+	number, err := readSysfsInt(dir, "partition")
+	if err != nil {
+		return nil
+	}
+	return readDiskPartition(filepath.Base(filepath.Dir(dir)), number)
+}
+
+// readDiskPartition reads the partition entry from the partition table of /dev/$disk
+func readDiskPartition(disk string, number int) *partEntry {
+	f, err := os.Open("/dev/" + disk)
+	if err != nil {
+		debug("unable to read partition table: %v", err)
+		return nil
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		debug("unable to get size of %s: %v", disk, err)
+		return nil
+	}
+	return readPartitionEntry(f, size, number)
+}
+
+// updateUdevDb writes the udev database record for the given block device and creates symlinks listed at the record.
+// It is an equivalent to what "db_persist" udev option does (see 'man 7 udev').
+func updateUdevDb(devpath string, info *blkInfo) error {
+	devNo, err := deviceNo(devpath)
+	if err != nil {
+		return err
+	}
+	sysDir := fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(devNo), unix.Minor(devNo))
+	r, err := newUdevRecord(sysDir, info, readDiskPartition)
+	if err != nil {
+		return err
+	}
+
+	var symlinks []string
+	for _, s := range r.symlinks {
+		link := filepath.Join("/dev", s)
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			return err
+		}
+		target, err := filepath.Rel(filepath.Dir(link), "/dev/"+r.kernelName)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, link); err != nil && !os.IsExist(err) {
+			warning("unable to create symlink %s: %v", link, err)
+			continue
+		}
+		symlinks = append(symlinks, s)
+	}
+	r.symlinks = symlinks
+
+	if err := os.MkdirAll(udevDataDir, 0755); err != nil {
+		return err
+	}
+	dbFile := filepath.Join(udevDataDir, r.id)
+	debug("writing udev state to %s", dbFile)
+	if err := os.WriteFile(dbFile, r.encode(), 0644); err != nil {
+		return err
+	}
+
+	for _, t := range r.tags {
+		dir := filepath.Join(udevTagsDir, t)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, r.id), nil, 0444); err != nil {
+			return err
+		}
+	}
+	return nil
+}
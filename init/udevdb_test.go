@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUdevEncode(t *testing.T) {
+	check := func(in, expected string) {
+		if out := udevEncode(in); out != expected {
+			t.Fatalf("udevEncode(%q) = %q, expected %q", in, out, expected)
+		}
+	}
+
+	check("717be5ba-d42d-4aaa-b846-8a23cc7471b0", "717be5ba-d42d-4aaa-b846-8a23cc7471b0")
+	check("my disk", `my\x20disk`)
+	check("a/b\\c", `a\x2fb\x5cc`)
+	check("#+-.:=@_", "#+-.:=@_")
+	check("диск", "диск")
+	check("bad\xffutf", `bad\xffutf`)
+	check("", "")
+}
+
+// createSysfsBlock creates a directory that resembles /sys/devices/.../block/$name with the given attributes
+func createSysfsBlock(t *testing.T, dir string, attrs map[string]string) {
+	t.Helper()
+	for k, v := range attrs {
+		file := filepath.Join(dir, k)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(v+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUdevRecordPartition(t *testing.T) {
+	root := t.TempDir()
+	disk := filepath.Join(root, "devices/pci0000:00/0000:00:04.0/block/vda")
+	createSysfsBlock(t, disk, map[string]string{"dev": "254:0"})
+	createSysfsBlock(t, filepath.Join(disk, "vda2"), map[string]string{"dev": "254:2", "partition": "2"})
+	link := filepath.Join(root, "dev/block/254:2")
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(disk, "vda2"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	uuid, _ := parseUUID("717be5ba-d42d-4aaa-b846-8a23cc7471b0")
+	info := &blkInfo{"ext4", true, uuid, "root fs"}
+	readPartition := func(disk string, number int) *partEntry {
+		if disk != "vda" || number != 2 {
+			t.Fatalf("unexpected partition %s #%d requested", disk, number)
+		}
+		return &partEntry{scheme: "gpt", number: 2, uuid: "a3bf4e2c-58f4-4d1b-9a8c-7b95e4a1c0d2", typ: "0fc63daf-8483-4772-8e79-3d69d8477de4"}
+	}
+
+	r, err := newUdevRecord(link, info, readPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.id != "b254:2" || r.kernelName != "vda2" {
+		t.Fatalf("unexpected record id %s, kernel name %s", r.id, r.kernelName)
+	}
+	expectedSymlinks := []string{
+		"disk/by-uuid/717be5ba-d42d-4aaa-b846-8a23cc7471b0",
+		`disk/by-label/root\x20fs`,
+		"disk/by-partuuid/a3bf4e2c-58f4-4d1b-9a8c-7b95e4a1c0d2",
+	}
+	if !reflect.DeepEqual(r.symlinks, expectedSymlinks) {
+		t.Fatalf("expected symlinks %v, got %v", expectedSymlinks, r.symlinks)
+	}
+
+	r.initUsec = 1234
+	expected := `S:disk/by-uuid/717be5ba-d42d-4aaa-b846-8a23cc7471b0
+S:disk/by-label/root\x20fs
+S:disk/by-partuuid/a3bf4e2c-58f4-4d1b-9a8c-7b95e4a1c0d2
+I:1234
+E:ID_FS_LABEL=root_fs
+E:ID_FS_LABEL_ENC=root\x20fs
+E:ID_FS_TYPE=ext4
+E:ID_FS_USAGE=filesystem
+E:ID_FS_UUID=717be5ba-d42d-4aaa-b846-8a23cc7471b0
+E:ID_FS_UUID_ENC=717be5ba-d42d-4aaa-b846-8a23cc7471b0
+E:ID_PART_ENTRY_DISK=254:0
+E:ID_PART_ENTRY_NUMBER=2
+E:ID_PART_ENTRY_SCHEME=gpt
+E:ID_PART_ENTRY_TYPE=0fc63daf-8483-4772-8e79-3d69d8477de4
+E:ID_PART_ENTRY_UUID=a3bf4e2c-58f4-4d1b-9a8c-7b95e4a1c0d2
+E:SYSTEMD_READY=1
+G:systemd
+Q:systemd
+V:1
+`
+	if out := string(r.encode()); out != expected {
+		t.Fatalf("unexpected udev record:\n%s\nexpected:\n%s", out, expected)
+	}
+}
+
+func TestUdevRecordDeviceMapper(t *testing.T) {
+	const cryptUUID = "CRYPT-LUKS2-51df71ed8e4a4a7a956db782706a52d1-cryptroot"
+
+	dir := filepath.Join(t.TempDir(), "dm-0")
+	createSysfsBlock(t, dir, map[string]string{"dev": "253:0", "dm/name": "cryptroot", "dm/uuid": cryptUUID})
+	noPartition := func(disk string, number int) *partEntry {
+		t.Fatalf("device mapper device is not a partition")
+		return nil
+	}
+
+	// the device is unlocked but has no recognized content
+	r, err := newUdevRecord(dir, nil, noPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"DM_NAME":                     "cryptroot",
+		"DM_UUID":                     cryptUUID,
+		"DM_SUSPENDED":                "0",
+		"DM_UDEV_RULES_VSN":           "2",
+		"DM_UDEV_PRIMARY_SOURCE_FLAG": "1",
+		"SYSTEMD_READY":               "0",
+	}
+	if !reflect.DeepEqual(r.properties, expected) {
+		t.Fatalf("expected properties %v, got %v", expected, r.properties)
+	}
+
+	uuid, _ := parseUUID("1884e1eb-186f-4b1b-af11-45ea80da8e3c")
+	r, err = newUdevRecord(dir, &blkInfo{"btrfs", true, uuid, ""}, noPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.properties["SYSTEMD_READY"] != "1" || r.properties["ID_FS_TYPE"] != "btrfs" || r.properties["DM_NAME"] != "cryptroot" {
+		t.Fatalf("unexpected properties %v", r.properties)
+	}
+	out := string(r.encode())
+	for _, s := range []string{"S:mapper/cryptroot\n", "S:disk/by-id/dm-name-cryptroot\n", "S:disk/by-id/dm-uuid-" + cryptUUID + "\n", "S:disk/by-uuid/1884e1eb-186f-4b1b-af11-45ea80da8e3c\n"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("udev record does not contain %q:\n%s", s, out)
+		}
+	}
+
+	if _, err := newUdevRecord(filepath.Join(dir, "nonexistent"), nil, noPartition); err == nil {
+		t.Fatal("expected an error for a nonexistent device")
+	}
+}
@@ -28,9 +28,18 @@ func fixedArrayToString(buff []byte) string {
 	return string(buff)
 }
 
-func macListContains(value net.HardwareAddr, list []net.HardwareAddr) bool {
+func ipListContains(value net.IP, list []net.IP) bool {
 	for _, v := range list {
-		if bytes.Compare(v, value) == 0 {
+		if v.Equal(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringListContains(value string, list []string) bool {
+	for _, v := range list {
+		if v == value {
 			return true
 		}
 	}
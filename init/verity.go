@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anatol/devmapper.go"
+	"golang.org/x/sys/unix"
+)
+
+// dm-verity protected root and /usr filesystems. The boot params follow systemd-veritysetup-generator semantics:
+// 'roothash=' (or 'usrhash=') enables verity, the data and hash devices are either specified with
+// 'systemd.verity_root_data=' and 'systemd.verity_root_hash=' or discovered at GPT: per the discoverable partitions
+// specification the first half of the root hash is the data partition UUID and the second half is the hash partition UUID.
+// See https://systemd.io/DISCOVERABLE_PARTITIONS/
+
+const veritySignature = "verity\x00\x00"
+
+type veritySuperblock struct {
+	version       uint32
+	hashType      uint32
+	uuid          UUID
+	algorithm     string
+	dataBlockSize uint32
+	hashBlockSize uint32
+	dataBlocks    uint64
+	salt          []byte
+}
+
+const veritySuperblockSize = 512
+
+// parseVeritySuperblock parses the superblock that veritysetup writes at the beginning of the hash device
+func parseVeritySuperblock(data []byte) (*veritySuperblock, error) {
+	// https://gitlab.com/cryptsetup/cryptsetup/-/wikis/DMVerity
+	const (
+		versionOffset       = 0x8
+		hashTypeOffset      = 0xc
+		uuidOffset          = 0x10
+		algorithmOffset     = 0x20
+		algorithmLength     = 32
+		dataBlockSizeOffset = 0x40
+		hashBlockSizeOffset = 0x44
+		dataBlocksOffset    = 0x48
+		saltSizeOffset      = 0x50
+		saltOffset          = 0x58
+		saltMaxSize         = 256
+	)
+
+	if len(data) < veritySuperblockSize || string(data[:len(veritySignature)]) != veritySignature {
+		return nil, fmt.Errorf("verity superblock signature not found")
+	}
+
+	le := binary.LittleEndian
+	sb := &veritySuperblock{
+		version:       le.Uint32(data[versionOffset:]),
+		hashType:      le.Uint32(data[hashTypeOffset:]),
+		uuid:          append(UUID{}, data[uuidOffset:uuidOffset+16]...),
+		algorithm:     fixedArrayToString(data[algorithmOffset : algorithmOffset+algorithmLength]),
+		dataBlockSize: le.Uint32(data[dataBlockSizeOffset:]),
+		hashBlockSize: le.Uint32(data[hashBlockSizeOffset:]),
+		dataBlocks:    le.Uint64(data[dataBlocksOffset:]),
+	}
+	if sb.version != 1 {
+		return nil, fmt.Errorf("unsupported verity superblock version %d", sb.version)
+	}
+	if sb.hashType > 1 {
+		return nil, fmt.Errorf("unsupported verity hash type %d", sb.hashType)
+	}
+	for _, size := range []uint32{sb.dataBlockSize, sb.hashBlockSize} {
+		if size < devmapper.SectorSize || size&(size-1) != 0 {
+			return nil, fmt.Errorf("invalid verity block size %d", size)
+		}
+	}
+	saltSize := int(le.Uint16(data[saltSizeOffset:]))
+	if saltSize > saltMaxSize {
+		return nil, fmt.Errorf("invalid verity salt size %d", saltSize)
+	}
+	sb.salt = append([]byte{}, data[saltOffset:saltOffset+saltSize]...)
+	return sb, nil
+}
+
+// GPT partition types from the discoverable partitions specification
+type verityPartitionTypes struct {
+	root, rootVerity, usr, usrVerity string
+}
+
+var discoverablePartitionTypes = map[string]verityPartitionTypes{
+	"amd64": {
+		root:       "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+		rootVerity: "2c7357ed-ebd2-46d9-aec1-23d437ec2bf5",
+		usr:        "8484680c-9521-48c6-9c11-b0720656f69e",
+		usrVerity:  "77ff5f63-e7b6-4633-acf4-1565b864c0e6",
+	},
+	"arm64": {
+		root:       "b921b045-1df0-41c3-af44-4c6f280d3fae",
+		rootVerity: "df3300ce-d69f-4c92-978c-9bfb0f38d820",
+		usr:        "b0e01050-ee5f-4390-949a-9101b17104e9",
+		usrVerity:  "6e11a4e7-fbca-4ded-b9e9-e1a512bb664e",
+	},
+}
+
+// verity options accepted by systemd.verity_*_options, they map to dm-verity optional params
+var verityOptions = map[string]string{
+	"ignore-corruption":     "ignore_corruption",
+	"restart-on-corruption": "restart_on_corruption",
+	"panic-on-corruption":   "panic_on_corruption",
+	"ignore-zero-blocks":    "ignore_zero_blocks",
+	"check-at-most-once":    "check_at_most_once",
+}
+
+type verityVolume struct {
+	name               string // device mapper name and the mountpoint, 'root' or 'usr'
+	rootHash           string
+	dataSpec, hashSpec string // explicit device specs, if empty then the devices are discovered by GPT partition type
+	dataType, hashType string
+	params             []string // dm-verity optional params
+
+	mutex            sync.Mutex
+	dataDev, hashDev string
+	opened           bool
+}
+
+var verityVolumes []*verityVolume
+
+var (
+	usrMounted  sync.WaitGroup // waits until the verity /usr is mounted
+	usrMountErr error
+)
+
+// newVerityVolume creates a volume from boot params. 'corruption' is the default corruption policy from the config.
+func newVerityVolume(name, rootHash, dataSpec, hashSpec, options, corruption string, types verityPartitionTypes) (*verityVolume, error) {
+	if _, err := hex.DecodeString(rootHash); err != nil || rootHash == "" {
+		return nil, fmt.Errorf("invalid %shash value '%s'", name, rootHash)
+	}
+	v := &verityVolume{
+		name:     name,
+		rootHash: strings.ToLower(rootHash),
+		dataSpec: dataSpec,
+		hashSpec: hashSpec,
+	}
+	if name == "root" {
+		v.dataType, v.hashType = types.root, types.rootVerity
+	} else {
+		v.dataType, v.hashType = types.usr, types.usrVerity
+	}
+	if (v.dataSpec == "" || v.hashSpec == "") && (len(v.rootHash) < 64 || v.dataType == "") {
+		return nil, fmt.Errorf("%s verity devices cannot be discovered, please specify systemd.verity_%s_data and systemd.verity_%s_hash", name, name, name)
+	}
+
+	var args []string
+	hasPolicy := false
+	for _, o := range strings.Split(options, ",") {
+		if o == "" {
+			continue
+		}
+		p, ok := verityOptions[o]
+		if !ok {
+			warning("unsupported verity option %s", o)
+			continue
+		}
+		if strings.HasSuffix(p, "_corruption") {
+			hasPolicy = true
+		}
+		args = append(args, p)
+	}
+	if !hasPolicy {
+		switch corruption {
+		case "":
+		case "restart", "panic", "ignore":
+			args = append(args, corruption+"_on_corruption")
+		default:
+			return nil, fmt.Errorf("invalid verity corruption policy %s", corruption)
+		}
+	}
+	if len(args) > 0 {
+		v.params = append([]string{strconv.Itoa(len(args))}, args...)
+	}
+	return v, nil
+}
+
+// parseVerityCmdline reads roothash= and usrhash= boot params or the hashes from the image config
+func parseVerityCmdline() error {
+	verityVolumes = nil
+	if v, ok := cmdlineParam("systemd.verity"); ok && (v == "0" || v == "no" || v == "false" || v == "off") {
+		return nil
+	}
+
+	var conf VerityConfig
+	if config.Verity != nil {
+		conf = *config.Verity
+	}
+	types := discoverablePartitionTypes[runtime.GOARCH]
+
+	for _, name := range []string{"root", "usr"} {
+		hash := cmdlineValue(name + "hash")
+		if hash == "" && name == "root" {
+			hash = conf.RootHash
+		} else if hash == "" {
+			hash = conf.UsrHash
+		}
+		if hash == "" {
+			continue
+		}
+
+		prefix := "systemd.verity_" + name + "_"
+		v, err := newVerityVolume(name, hash, cmdlineValue(prefix+"data"), cmdlineValue(prefix+"hash"), cmdlineValue(prefix+"options"), conf.OnCorruption, types)
+		if err != nil {
+			return err
+		}
+		verityVolumes = append(verityVolumes, v)
+	}
+
+	if len(verityVolumes) > 0 && verityVolumes[0].name == "root" && cmdlineValue("root") == "" {
+		setCmdlineParam("root", "/dev/mapper/root")
+	}
+	return nil
+}
+
+// uuidFromHex formats a part of the root hash as UUID
+func uuidFromHex(h string) string {
+	if len(h) != 32 {
+		return ""
+	}
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// verityDeviceMatches checks if the block device matches the spec that can be either a device path or
+// UUID=, LABEL=, PARTUUID=, PARTLABEL= tag
+func verityDeviceMatches(spec, devpath string, info *blkInfo, part *partEntry) bool {
+	if spec == devpath || blkIdMatches(spec, info) {
+		return true
+	}
+	if part == nil {
+		return false
+	}
+	if strings.HasPrefix(spec, "PARTUUID=") {
+		return strings.EqualFold(stripQuotes(strings.TrimPrefix(spec, "PARTUUID=")), part.uuid)
+	}
+	if strings.HasPrefix(spec, "PARTLABEL=") {
+		return stripQuotes(strings.TrimPrefix(spec, "PARTLABEL=")) == part.name
+	}
+	return false
+}
+
+func (v *verityVolume) isData(devpath string, info *blkInfo, part *partEntry) bool {
+	if v.dataSpec != "" {
+		return verityDeviceMatches(v.dataSpec, devpath, info, part)
+	}
+	return part != nil && part.typ == v.dataType && part.uuid == uuidFromHex(v.rootHash[:32])
+}
+
+func (v *verityVolume) isHash(devpath string, info *blkInfo, part *partEntry) bool {
+	if v.hashSpec != "" {
+		return verityDeviceMatches(v.hashSpec, devpath, info, part)
+	}
+	return part != nil && part.typ == v.hashType && part.uuid == uuidFromHex(v.rootHash[len(v.rootHash)-32:])
+}
+
+// table builds the 'verity' device mapper target for the superblock read from the hash device
+func (v *verityVolume) table(sb *veritySuperblock) devmapper.VerityTable {
+	salt := "-"
+	if len(sb.salt) > 0 {
+		salt = hex.EncodeToString(sb.salt)
+	}
+	// the hash tree starts at the block that follows the superblock
+	hashStart := (veritySuperblockSize + uint64(sb.hashBlockSize) - 1) / uint64(sb.hashBlockSize)
+
+	return devmapper.VerityTable{
+		Length:         sb.dataBlocks * uint64(sb.dataBlockSize) / devmapper.SectorSize,
+		HashType:       uint64(sb.hashType),
+		DataDevice:     v.dataDev,
+		HashDevice:     v.hashDev,
+		DataBlockSize:  uint64(sb.dataBlockSize),
+		HashBlockSize:  uint64(sb.hashBlockSize),
+		NumDataBlocks:  sb.dataBlocks,
+		HashStartBlock: hashStart,
+		Algorithm:      sb.algorithm,
+		Digest:         v.rootHash,
+		Salt:           salt,
+		Params:         v.params,
+	}
+}
+
+// open creates /dev/mapper/$name device once both data and hash devices are found
+func (v *verityVolume) open() error {
+	if err := loadModules("dm_verity").Wait(); err != nil {
+		// dm_verity might be compiled into the kernel, let the device mapper report the problem if it is really missing
+		warning("%v", err)
+	}
+
+	f, err := os.Open(v.hashDev)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := make([]byte, veritySuperblockSize)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return fmt.Errorf("%s: %v", v.hashDev, err)
+	}
+	sb, err := parseVeritySuperblock(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", v.hashDev, err)
+	}
+
+	uuid := fmt.Sprintf("CRYPT-VERITY-%s-%s", hex.EncodeToString(sb.uuid), v.name) // the same format as veritysetup uses
+	debug("creating verity device %s with data %s and hash %s", v.name, v.dataDev, v.hashDev)
+	return devmapper.CreateAndLoad(v.name, uuid, devmapper.ReadOnlyFlag, v.table(sb))
+}
+
+// handleVerityBlockDevice checks if the block device belongs to a verity volume. Data and hash devices must not be
+// used directly, thus the function returns true for them and also for the verity /usr device that gets mounted here.
+func handleVerityBlockDevice(devpath string, info *blkInfo) (bool, error) {
+	if len(verityVolumes) == 0 {
+		return false, nil
+	}
+
+	var part *partEntry
+	if !strings.HasPrefix(devpath, "/dev/mapper/") {
+		part = readDevicePartition(devpath)
+	}
+
+	for _, v := range verityVolumes {
+		if v.name == "usr" && devpath == "/dev/mapper/usr" {
+			go mountVerityUsr(devpath, info)
+			return true, nil
+		}
+
+		isData, isHash := v.isData(devpath, info, part), v.isHash(devpath, info, part)
+		if !isData && !isHash {
+			continue
+		}
+
+		v.mutex.Lock()
+		if isData {
+			v.dataDev = devpath
+		}
+		if isHash {
+			v.hashDev = devpath
+		}
+		ready := v.dataDev != "" && v.hashDev != "" && !v.opened
+		if ready {
+			v.opened = true
+		}
+		v.mutex.Unlock()
+
+		if ready {
+			if err := v.open(); err != nil {
+				return true, fmt.Errorf("verity %s: %v", v.name, err)
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// isVerityDevice checks if the device is created for a verity volume, such devices are always read-only
+func isVerityDevice(devpath string) bool {
+	for _, v := range verityVolumes {
+		if devpath == "/dev/mapper/"+v.name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasVerityUsr returns true if /usr needs to be mounted from a verity device
+func hasVerityUsr() bool {
+	for _, v := range verityVolumes {
+		if v.name == "usr" {
+			return true
+		}
+	}
+	return false
+}
+
+// mountVerityUsr mounts the /usr device after the root filesystem is mounted
+func mountVerityUsr(devpath string, info *blkInfo) {
+	defer usrMounted.Done()
+	rootMounted.Wait()
+
+	fstype := cmdlineValue("mount.usrfstype")
+	if info != nil && info.format != "" {
+		fstype = info.format
+	}
+	if fstype == "" {
+		usrMountErr = fmt.Errorf("unable to detect filesystem type for device %s and no 'mount.usrfstype' boot parameter specified", devpath)
+		return
+	}
+	if err := loadModules(fstype).Wait(); err != nil {
+		warning("%v", err)
+	}
+	usrMountErr = mount(devpath, newRoot+"/usr", fstype, unix.MS_RDONLY, "")
+}
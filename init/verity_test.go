@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/anatol/devmapper.go"
+)
+
+// veritySuperblockData creates the superblock the same way as 'veritysetup format' does it
+func veritySuperblockData(salt []byte) []byte {
+	data := make([]byte, veritySuperblockSize)
+	copy(data, veritySignature)
+	binary.LittleEndian.PutUint32(data[0x8:], 1) // version
+	binary.LittleEndian.PutUint32(data[0xc:], 1) // hash type
+	copy(data[0x10:], []byte{0x8a, 0x2e, 0x5b, 0x39, 0x6c, 0x04, 0x4b, 0x7e, 0x9c, 0x1d, 0x1f, 0x5e, 0x0a, 0x71, 0x30, 0x2c})
+	copy(data[0x20:], "sha256")
+	binary.LittleEndian.PutUint32(data[0x40:], 4096)
+	binary.LittleEndian.PutUint32(data[0x44:], 4096)
+	binary.LittleEndian.PutUint64(data[0x48:], 25600)
+	binary.LittleEndian.PutUint16(data[0x50:], uint16(len(salt)))
+	copy(data[0x58:], salt)
+	return data
+}
+
+func TestParseVeritySuperblock(t *testing.T) {
+	salt := []byte{0xde, 0xad, 0xbe, 0xef}
+	sb, err := parseVeritySuperblock(veritySuperblockData(salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.algorithm != "sha256" || sb.hashType != 1 || sb.dataBlockSize != 4096 || sb.hashBlockSize != 4096 || sb.dataBlocks != 25600 {
+		t.Fatalf("unexpected superblock %+v", sb)
+	}
+	if !reflect.DeepEqual(sb.salt, salt) || sb.uuid.toString() != "8a2e5b39-6c04-4b7e-9c1d-1f5e0a71302c" {
+		t.Fatalf("unexpected salt %x or uuid %s", sb.salt, sb.uuid.toString())
+	}
+	if info := probeVerity(bytes.NewReader(veritySuperblockData(nil))); info == nil || info.format != "verity" || info.uuid.toString() != sb.uuid.toString() {
+		t.Fatalf("unexpected blkinfo %+v", info)
+	}
+
+	invalid := veritySuperblockData(nil)
+	binary.LittleEndian.PutUint32(invalid[0x44:], 1000)
+	if _, err := parseVeritySuperblock(invalid); err == nil {
+		t.Fatal("expected an error for invalid hash block size")
+	}
+	if _, err := parseVeritySuperblock(make([]byte, veritySuperblockSize)); err == nil {
+		t.Fatal("expected an error for missing signature")
+	}
+}
+
+const testRootHash = "a3bf4e2c58f44d1b9a8c7b95e4a1c0d2c26fcabe80104bffa0668c73e76dbb32"
+
+func TestVerityVolume(t *testing.T) {
+	types := discoverablePartitionTypes["amd64"]
+
+	v, err := newVerityVolume("root", testRootHash, "", "", "restart-on-corruption,check-at-most-once,foo", "panic", types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"2", "restart_on_corruption", "check_at_most_once"}; !reflect.DeepEqual(v.params, expected) {
+		t.Fatalf("expected params %v, got %v", expected, v.params)
+	}
+
+	data := &partEntry{scheme: "gpt", number: 2, uuid: "a3bf4e2c-58f4-4d1b-9a8c-7b95e4a1c0d2", typ: types.root}
+	hash := &partEntry{scheme: "gpt", number: 3, uuid: "c26fcabe-8010-4bff-a066-8c73e76dbb32", typ: types.rootVerity}
+	other := &partEntry{scheme: "gpt", number: 4, uuid: "c26fcabe-8010-4bff-a066-8c73e76dbb32", typ: types.root}
+	if !v.isData("/dev/vda2", nil, data) || v.isHash("/dev/vda2", nil, data) {
+		t.Fatal("data partition is not discovered")
+	}
+	if !v.isHash("/dev/vda3", nil, hash) || v.isData("/dev/vda3", nil, hash) {
+		t.Fatal("hash partition is not discovered")
+	}
+	if v.isData("/dev/vda4", nil, other) || v.isHash("/dev/vda4", nil, other) || v.isData("/dev/sda", nil, nil) {
+		t.Fatal("unrelated partition matches verity volume")
+	}
+
+	v.dataDev, v.hashDev = "/dev/vda2", "/dev/vda3"
+	sb, err := parseVeritySuperblock(veritySuperblockData(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := devmapper.VerityTable{
+		Length:         25600 * 8,
+		HashType:       1,
+		DataDevice:     "/dev/vda2",
+		HashDevice:     "/dev/vda3",
+		DataBlockSize:  4096,
+		HashBlockSize:  4096,
+		NumDataBlocks:  25600,
+		HashStartBlock: 1,
+		Algorithm:      "sha256",
+		Digest:         testRootHash,
+		Salt:           "-",
+		Params:         []string{"2", "restart_on_corruption", "check_at_most_once"},
+	}
+	if table := v.table(sb); !reflect.DeepEqual(table, expected) {
+		t.Fatalf("expected table %+v, got %+v", expected, table)
+	}
+
+	// explicit device specs, the hash is too short to be used for discovery
+	uuid, _ := parseUUID("717be5ba-d42d-4aaa-b846-8a23cc7471b0")
+	v, err = newVerityVolume("usr", "abcdef0123", "UUID=717be5ba-d42d-4aaa-b846-8a23cc7471b0", "PARTLABEL=usr-verity", "", "restart", types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v.params, []string{"1", "restart_on_corruption"}) {
+		t.Fatalf("unexpected params %v", v.params)
+	}
+	if !v.isData("/dev/sdb1", &blkInfo{"ext4", true, uuid, ""}, nil) || !v.isHash("/dev/sdb2", nil, &partEntry{name: "usr-verity"}) {
+		t.Fatal("explicitly specified devices do not match")
+	}
+
+	for _, args := range [][]string{
+		{"root", "xyz", "", "", "", ""},
+		{"root", "abcdef0123", "", "", "", ""},
+		{"root", testRootHash, "", "", "", "reboot"},
+	} {
+		if _, err := newVerityVolume(args[0], args[1], args[2], args[3], args[4], args[5], types); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestParseVerityCmdline(t *testing.T) {
+	prevCmdline, prevConfig := cmdline, config
+	defer func() {
+		cmdline, config = prevCmdline, prevConfig
+		verityVolumes = nil
+	}()
+
+	cmdline = map[string]string{"systemd.verity_root_data": "/dev/vda2", "systemd.verity_root_hash": "/dev/vda3"}
+	config = InitConfig{Verity: &VerityConfig{RootHash: "abcdef0123", OnCorruption: "panic"}}
+	if err := parseVerityCmdline(); err != nil {
+		t.Fatal(err)
+	}
+	if len(verityVolumes) != 1 || verityVolumes[0].rootHash != "abcdef0123" || cmdline["root"] != "/dev/mapper/root" {
+		t.Fatalf("unexpected verity volumes %+v, root=%s", verityVolumes, cmdline["root"])
+	}
+	if !isVerityDevice("/dev/mapper/root") || isVerityDevice("/dev/vda2") || hasVerityUsr() {
+		t.Fatal("unexpected verity devices")
+	}
+
+	cmdline = map[string]string{"roothash": testRootHash, "systemd.verity": "no"}
+	if err := parseVerityCmdline(); err != nil {
+		t.Fatal(err)
+	}
+	if len(verityVolumes) != 0 || cmdline["root"] != "" {
+		t.Fatal("verity is expected to be disabled")
+	}
+}
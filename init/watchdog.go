@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A hardware watchdog resets the computer if the boot hangs, e.g. on a stuck module load or unreachable storage.
+// It is enabled with booster.watchdog=<seconds> boot param or 'watchdog' option in booster.yaml. Init opens the watchdog
+// as soon as its driver is loaded and pets it every time the boot makes progress: a uevent is handled, a module is loaded or
+// a key is typed at the console. fsck is known to be alive and pets it periodically. At switch_root the device
+// is closed without the magic character, the watchdog keeps running and systemd (RuntimeWatchdogSec=) takes it over.
+
+const watchdogKeepaliveInterval = time.Second
+
+var (
+	watchdogDevice = "/dev/watchdog"
+
+	watchdogMutex  sync.Mutex
+	watchdogFile   *os.File
+	watchdogClosed bool // the watchdog is handed over or disarmed, it must not be opened again
+)
+
+// watchdogTimeout returns the watchdog timeout in seconds, 0 means the watchdog is disabled
+func watchdogTimeout() (int, error) {
+	if v, ok := cmdlineParam("booster.watchdog"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid booster.watchdog=%s boot param, expected timeout in seconds", v)
+		}
+		return n, nil
+	}
+	return config.Watchdog, nil
+}
+
+// openWatchdog arms the watchdog if it is enabled. If the watchdog driver is not loaded yet then it is called again
+// once the device appears.
+func openWatchdog() {
+	watchdogMutex.Lock()
+	defer watchdogMutex.Unlock()
+
+	if watchdogFile != nil || watchdogClosed {
+		return
+	}
+	timeout, err := watchdogTimeout()
+	if err != nil {
+		warning("%v", err)
+		return
+	}
+	if timeout == 0 {
+		return
+	}
+
+	f, err := os.OpenFile(watchdogDevice, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		debug("watchdog device %s does not exist yet", watchdogDevice)
+		return
+	} else if err != nil {
+		warning("unable to open watchdog: %v", err)
+		return
+	}
+	fd := int(f.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.WDIOC_SETTIMEOUT, timeout); err != nil {
+		warning("unable to set watchdog timeout to %ds: %v", timeout, err)
+	}
+	// the driver might round the timeout to a supported value
+	if t, err := unix.IoctlGetInt(fd, unix.WDIOC_GETTIMEOUT); err == nil {
+		timeout = t
+	}
+	watchdogFile = f
+	debug("watchdog %s is armed with %ds timeout", watchdogDevice, timeout)
+}
+
+// petWatchdog tells the watchdog that the boot makes progress
+func petWatchdog() {
+	watchdogMutex.Lock()
+	defer watchdogMutex.Unlock()
+	petWatchdogLocked()
+}
+
+func petWatchdogLocked() {
+	if watchdogFile == nil {
+		return
+	}
+	if _, err := unix.IoctlGetInt(int(watchdogFile.Fd()), unix.WDIOC_KEEPALIVE); err != nil {
+		debug("watchdog keepalive: %v", err)
+	}
+}
+
+// keepWatchdogAlive pets the watchdog periodically until the returned function is called
+func keepWatchdogAlive() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(watchdogKeepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				petWatchdog()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// handOverWatchdog closes the device without the magic character so the watchdog keeps running after switching root.
+// The last ping gives the root filesystem init the full timeout to take the watchdog over.
+func handOverWatchdog() {
+	watchdogMutex.Lock()
+	defer watchdogMutex.Unlock()
+
+	watchdogClosed = true
+	if watchdogFile == nil {
+		return
+	}
+	petWatchdogLocked()
+	_ = watchdogFile.Close()
+	watchdogFile = nil
+	debug("watchdog is handed over to the root filesystem init")
+}
+
+// disarmWatchdog stops the watchdog before the explicitly requested shell is started
+func disarmWatchdog() {
+	watchdogMutex.Lock()
+	defer watchdogMutex.Unlock()
+
+	watchdogClosed = true
+	if watchdogFile == nil {
+		return
+	}
+	// magic close, the watchdog keeps running if the driver is built with nowayout
+	if _, err := watchdogFile.Write([]byte("V")); err != nil {
+		warning("unable to stop watchdog: %v", err)
+	}
+	_ = watchdogFile.Close()
+	watchdogFile = nil
+}
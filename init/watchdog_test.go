@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatchdogTimeout(t *testing.T) {
+	prevConfig, prevCmdline := config, cmdline
+	defer func() { config, cmdline = prevConfig, prevCmdline }()
+
+	config = InitConfig{Watchdog: 60}
+	cmdline = map[string]string{}
+	if timeout, err := watchdogTimeout(); err != nil || timeout != 60 {
+		t.Fatalf("expected timeout 60 from the config, got %d: %v", timeout, err)
+	}
+	cmdline = map[string]string{"booster.watchdog": "0"}
+	if timeout, err := watchdogTimeout(); err != nil || timeout != 0 {
+		t.Fatalf("expected the watchdog disabled with boot param, got %d: %v", timeout, err)
+	}
+	for _, v := range []string{"1m", "-5", ""} {
+		cmdline = map[string]string{"booster.watchdog": v}
+		if _, err := watchdogTimeout(); err == nil {
+			t.Fatalf("expected an error for booster.watchdog=%s", v)
+		}
+	}
+}
+
+// resetWatchdog points the watchdog to the given device and restores the previous state once the test ends
+func resetWatchdog(t *testing.T, device string) {
+	prevConfig, prevCmdline, prevDevice := config, cmdline, watchdogDevice
+	t.Cleanup(func() {
+		config, cmdline, watchdogDevice = prevConfig, prevCmdline, prevDevice
+		watchdogFile, watchdogClosed = nil, false
+	})
+	config = InitConfig{Watchdog: 30}
+	cmdline = map[string]string{}
+	watchdogDevice = device
+	watchdogFile, watchdogClosed = nil, false
+}
+
+func TestWatchdogHandOver(t *testing.T) {
+	// the device appears later
+	resetWatchdog(t, filepath.Join(t.TempDir(), "watchdog"))
+	openWatchdog()
+	petWatchdog()
+	if watchdogFile != nil {
+		t.Fatal("watchdog is opened without the device")
+	}
+
+	// a regular file does not support watchdog ioctls but accepts the magic character
+	if err := os.WriteFile(watchdogDevice, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	openWatchdog()
+	if watchdogFile == nil {
+		t.Fatal("watchdog is not opened")
+	}
+	petWatchdog()
+	handOverWatchdog()
+	if watchdogFile != nil || !watchdogClosed {
+		t.Fatal("watchdog is not closed at hand over")
+	}
+	if data, err := os.ReadFile(watchdogDevice); err != nil || len(data) != 0 {
+		t.Fatalf("watchdog is handed over with a magic close: %q %v", data, err)
+	}
+
+	// the device is not opened again after switching root
+	openWatchdog()
+	if watchdogFile != nil {
+		t.Fatal("watchdog is opened after hand over")
+	}
+}
+
+func TestWatchdogDisarm(t *testing.T) {
+	resetWatchdog(t, filepath.Join(t.TempDir(), "watchdog"))
+	if err := os.WriteFile(watchdogDevice, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	openWatchdog()
+	disarmWatchdog()
+	if data, err := os.ReadFile(watchdogDevice); err != nil || string(data) != "V" {
+		t.Fatalf("expected magic close, got %q %v", data, err)
+	}
+
+	// disabled watchdog is not opened
+	resetWatchdog(t, watchdogDevice)
+	config.Watchdog = 0
+	openWatchdog()
+	if watchdogFile != nil {
+		t.Fatal("disabled watchdog is opened")
+	}
+}
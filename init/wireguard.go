@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// WireGuard generic netlink API, see include/uapi/linux/wireguard.h
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfname     = 2
+	wgDeviceAPrivateKey = 3
+	wgDeviceAFlags      = 5
+	wgDeviceAListenPort = 6
+	wgDeviceAPeers      = 8
+
+	wgDeviceFReplacePeers = 1
+
+	wgPeerAPublicKey                   = 1
+	wgPeerAFlags                       = 3
+	wgPeerAEndpoint                    = 4
+	wgPeerAPersistentKeepaliveInterval = 5
+	wgPeerAAllowedips                  = 9
+
+	wgPeerFReplaceAllowedips = 2
+
+	wgAllowedipAFamily   = 1
+	wgAllowedipAIpaddr   = 2
+	wgAllowedipACidrMask = 3
+
+	wgKeyLen = 32
+)
+
+var (
+	wireguardOnce  sync.Once
+	wireguardReady = make(chan struct{}) // closed once the tunnel is configured
+)
+
+func wireguardEnabled() bool {
+	return config.Network != nil && config.Network.Wireguard != nil
+}
+
+func wireguardIfname() string {
+	if name := config.Network.Wireguard.Interface; name != "" {
+		return name
+	}
+	return wireguardDefaultDev
+}
+
+func isWireguardLink(ifname string) bool {
+	return wireguardEnabled() && ifname == wireguardIfname()
+}
+
+// startWireguard brings the tunnel up once the first underlying interface is configured
+func startWireguard() {
+	if !wireguardEnabled() {
+		return
+	}
+	wireguardOnce.Do(func() {
+		go func() {
+			if err := setupWireguard(config.Network.Wireguard); err != nil {
+				warning("wireguard: %v", err)
+				return
+			}
+			close(wireguardReady)
+		}()
+	})
+}
+
+// waitForWireguard blocks until the tunnel is ready. Network unlocking (e.g. clevis+tang) needs to wait for it
+// as the unlocking servers might be reachable through the tunnel only. It returns early if ctx is cancelled.
+func waitForWireguard(ctx context.Context, timeout time.Duration) {
+	if !wireguardEnabled() {
+		return
+	}
+	select {
+	case <-wireguardReady:
+	case <-ctx.Done():
+	case <-time.After(timeout):
+		warning("wireguard: tunnel is not ready after %v", timeout)
+	}
+}
+
+func setupWireguard(c *WireguardConfig) error {
+	ifname := wireguardIfname()
+
+	privateKey, err := readWireguardKeyFile(c.PrivateKeyFile)
+	if err != nil {
+		return err
+	}
+	defer MemZeroBytes(privateKey)
+
+	loadNetdevModule("wireguard")
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = ifname
+	if err := netlink.LinkAdd(&netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"}); err != nil {
+		return fmt.Errorf("unable to create link %s: %v", ifname, err)
+	}
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	msg, err := wireguardDeviceAttrs(ifname, privateKey, c)
+	if err != nil {
+		return err
+	}
+	if err := wireguardSetDevice(msg); err != nil {
+		return fmt.Errorf("unable to configure %s: %v", ifname, err)
+	}
+
+	if c.Address != "" {
+		addr, err := netlink.ParseAddr(c.Address)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+
+	// traffic to the allowed IPs goes through the tunnel
+	for _, p := range c.Peers {
+		for _, a := range p.AllowedIPs {
+			_, dst, err := net.ParseCIDR(a)
+			if err != nil {
+				return err
+			}
+			route := netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}
+			if err := netlink.RouteReplace(&route); err != nil {
+				return fmt.Errorf("unable to add route %v: %v", dst, err)
+			}
+		}
+	}
+
+	debug("wireguard tunnel %s is configured", ifname)
+	return nil
+}
+
+func readWireguardKeyFile(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer MemZeroBytes(data)
+	key, err := parseWireguardKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return key, nil
+}
+
+func parseWireguardKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	if len(key) != wgKeyLen {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	return key, nil
+}
+
+// wireguardDeviceAttrs serializes WG_CMD_SET_DEVICE attributes for the tunnel config
+func wireguardDeviceAttrs(ifname string, privateKey []byte, c *WireguardConfig) ([]*nl.RtAttr, error) {
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(wgDeviceAIfname, nl.ZeroTerminated(ifname)),
+		nl.NewRtAttr(wgDeviceAPrivateKey, privateKey),
+		nl.NewRtAttr(wgDeviceAFlags, nl.Uint32Attr(wgDeviceFReplacePeers)),
+	}
+	if c.ListenPort != 0 {
+		attrs = append(attrs, nl.NewRtAttr(wgDeviceAListenPort, nl.Uint16Attr(uint16(c.ListenPort))))
+	}
+
+	peers := nl.NewRtAttr(wgDeviceAPeers|unix.NLA_F_NESTED, nil)
+	for i, p := range c.Peers {
+		peer := peers.AddRtAttr(i|unix.NLA_F_NESTED, nil)
+
+		publicKey, err := parseWireguardKey(p.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: public key: %v", i, err)
+		}
+		peer.AddRtAttr(wgPeerAPublicKey, publicKey)
+		peer.AddRtAttr(wgPeerAFlags, nl.Uint32Attr(wgPeerFReplaceAllowedips))
+
+		if p.Endpoint != "" {
+			endpoint, err := net.ResolveUDPAddr("udp", p.Endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: endpoint: %v", i, err)
+			}
+			peer.AddRtAttr(wgPeerAEndpoint, sockaddr(endpoint))
+		}
+		if p.PersistentKeepalive != 0 {
+			peer.AddRtAttr(wgPeerAPersistentKeepaliveInterval, nl.Uint16Attr(uint16(p.PersistentKeepalive)))
+		}
+
+		allowedIPs := peer.AddRtAttr(wgPeerAAllowedips|unix.NLA_F_NESTED, nil)
+		for j, a := range p.AllowedIPs {
+			ip, ipnet, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: allowed ip: %v", i, err)
+			}
+			ones, _ := ipnet.Mask.Size()
+			family, addr := uint16(unix.AF_INET6), ip.To16()
+			if ip4 := ip.To4(); ip4 != nil {
+				family, addr = unix.AF_INET, ip4
+			}
+			allowedIP := allowedIPs.AddRtAttr(j|unix.NLA_F_NESTED, nil)
+			allowedIP.AddRtAttr(wgAllowedipAFamily, nl.Uint16Attr(family))
+			allowedIP.AddRtAttr(wgAllowedipAIpaddr, addr)
+			allowedIP.AddRtAttr(wgAllowedipACidrMask, nl.Uint8Attr(uint8(ones)))
+		}
+	}
+	return append(attrs, peers), nil
+}
+
+// sockaddr serializes the address as struct sockaddr_in or sockaddr_in6
+func sockaddr(addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		nl.NativeEndian().PutUint16(b[0:], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:], uint16(addr.Port))
+		copy(b[4:], ip4)
+		return b
+	}
+
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	nl.NativeEndian().PutUint16(b[0:], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:], uint16(addr.Port))
+	copy(b[8:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifc, err := net.InterfaceByName(addr.Zone); err == nil {
+			nl.NativeEndian().PutUint32(b[24:], uint32(ifc.Index))
+		}
+	}
+	return b
+}
+
+func wireguardSetDevice(attrs []*nl.RtAttr) error {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return err
+	}
+
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: wgCmdSetDevice, Version: wgGenlVersion})
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	_, err = req.Execute(unix.NETLINK_GENERIC, 0)
+	return err
+}
+
+// shutdownWireguard removes the tunnel, it also removes the tunnel routes
+func shutdownWireguard() {
+	if !wireguardEnabled() {
+		return
+	}
+	link, err := netlink.LinkByName(wireguardIfname())
+	if err != nil {
+		return
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		warning("unable to delete link %s: %v", wireguardIfname(), err)
+	}
+}
@@ -110,6 +110,18 @@ type NetworkConfig struct {
 	Ip         string `yaml:",omitempty"` // e.g. 10.0.2.15/24
 	Gateway    string `yaml:",omitempty"` // e.g. 10.0.2.255
 	DNSServers string `yaml:"dns_servers,omitempty"`
+
+	Wireguard *WireguardConfig `yaml:",omitempty"`
+}
+type WireguardConfig struct {
+	PrivateKeyFile string                `yaml:"private_key_file,omitempty"`
+	Address        string                `yaml:",omitempty"`
+	Peers          []WireguardPeerConfig `yaml:",omitempty"`
+}
+type WireguardPeerConfig struct {
+	PublicKey  string   `yaml:"public_key,omitempty"`
+	Endpoint   string   `yaml:",omitempty"`
+	AllowedIPs []string `yaml:"allowed_ips,omitempty"`
 }
 type GeneratorConfig struct {
 	Network              *NetworkConfig `yaml:",omitempty"`
@@ -121,6 +133,8 @@ type GeneratorConfig struct {
 	ExtraFiles           string         `yaml:"extra_files,omitempty"`
 	StripBinaries        bool           `yaml:"strip,omitempty"` // strip symbols from the binaries, shared libraries and kernel modules
 	EnableVirtualConsole bool           `yaml:"vconsole,omitempty"`
+	MeasurePCR           int            `yaml:"measure_pcr,omitempty"`
+	Watchdog             string         `yaml:"watchdog,omitempty"`
 }
 
 func generateBoosterConfig(opts Opts) (string, error) {
@@ -142,6 +156,25 @@ func generateBoosterConfig(opts Opts) (string, error) {
 		}
 
 		net.Interfaces = opts.activeNetIfaces
+
+		if opts.enableWireguard {
+			_, serverPub, err := wireguardKey("server")
+			if err != nil {
+				return "", err
+			}
+			if _, _, err := wireguardKey("guest"); err != nil {
+				return "", err
+			}
+			net.Wireguard = &WireguardConfig{
+				PrivateKeyFile: filepath.Join(wireguardKeysDir, "guest.key"),
+				Address:        wireguardGuestAddr + "/24",
+				Peers: []WireguardPeerConfig{{
+					PublicKey:  serverPub,
+					Endpoint:   fmt.Sprintf("10.0.2.2:%d", wireguardPort),
+					AllowedIPs: []string{wireguardPeerAddr + "/32"},
+				}},
+			}
+		}
 	}
 	conf.Universal = true
 	conf.Compression = opts.compression
@@ -150,6 +183,10 @@ func generateBoosterConfig(opts Opts) (string, error) {
 	conf.StripBinaries = opts.stripBinaries
 	conf.EnableVirtualConsole = opts.enableVirtualConsole
 	conf.ModulesForceLoad = opts.modulesForceLoad
+	conf.MeasurePCR = opts.measurePCR
+	if opts.watchdog != 0 {
+		conf.Watchdog = strconv.Itoa(opts.watchdog) + "s"
+	}
 
 	data, err := yaml.Marshal(&conf)
 	if err != nil {
@@ -171,6 +208,7 @@ type Opts struct {
 	password             string
 	modulesForceLoad     string
 	enableTangd          bool
+	enableWireguard      bool // tang server is reachable through WireGuard tunnel only
 	useDhcp              bool
 	activeNetIfaces      string
 	enableTpm2           bool
@@ -184,6 +222,8 @@ type Opts struct {
 	forceKill            bool // if true then kill VM rather than do a graceful shutdown
 	stripBinaries        bool
 	enableVirtualConsole bool
+	measurePCR           int // TPM PCR to measure the boot inputs into
+	watchdog             int // hardware watchdog timeout in seconds
 }
 
 func boosterTest(opts Opts) func(*testing.T) {
@@ -209,6 +249,14 @@ func boosterTest(opts Opts) func(*testing.T) {
 			t.Fatal("System does not have 'linux' package installed needed for the integration tests")
 		}
 
+		if opts.enableWireguard {
+			wgPeer, err := NewWireguardPeer()
+			if err != nil {
+				t.Skip(err)
+			}
+			defer wgPeer.Stop()
+		}
+
 		initRamfs, err := generateInitRamfs(opts)
 		if err != nil {
 			t.Fatal(err)
@@ -237,7 +285,15 @@ func boosterTest(opts Opts) func(*testing.T) {
 			}
 		}
 
-		if opts.enableTangd {
+		if opts.enableWireguard {
+			tangd, err := NewTangServerAt("assets/tang", fmt.Sprintf("%s:5697", wireguardPeerAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tangd.Stop()
+			// unrestricted user network lets the guest reach the WireGuard peer at the host loopback as 10.0.2.2
+			params = append(params, "-nic", "user,id=n1")
+		} else if opts.enableTangd {
 			tangd, err := NewTangServer("assets/tang")
 			if err != nil {
 				t.Fatal(err)
@@ -414,6 +470,7 @@ func initAssetsGenerators() error {
 	assetGenerators["assets/luks1.clevis.tang.img"] = assetGenerator{"generate_asset_luks.sh", []string{"OUTPUT=assets/luks1.clevis.tang.img", "LUKS_VERSION=1", "LUKS_PASSWORD=1234", "LUKS_UUID=4cdaa447-ef43-42a6-bfef-89ebb0c61b05", "FS_UUID=c23aacf4-9e7e-4206-ba6c-af017934e6fa", "CLEVIS_PIN=tang", `CLEVIS_CONFIG={"url":"http://10.0.2.100:5697", "adv":"assets/tang/adv.jwk"}`}}
 	assetGenerators["assets/luks2.clevis.tpm2.img"] = assetGenerator{"generate_asset_luks.sh", []string{"OUTPUT=assets/luks2.clevis.tpm2.img", "LUKS_VERSION=2", "LUKS_PASSWORD=1234", "LUKS_UUID=3756ba2c-1505-4283-8f0b-b1d1bd7b844f", "FS_UUID=c3cc0321-fba8-42c3-ad73-d13f8826d8d7", "CLEVIS_PIN=tpm2", "CLEVIS_CONFIG={}"}}
 	assetGenerators["assets/luks2.clevis.tang.img"] = assetGenerator{"generate_asset_luks.sh", []string{"OUTPUT=assets/luks2.clevis.tang.img", "LUKS_VERSION=2", "LUKS_PASSWORD=1234", "LUKS_UUID=f2473f71-9a68-4b16-ae54-8f942b2daf50", "FS_UUID=7acb3a9e-9b50-4aa2-9965-e41ae8467d8a", "CLEVIS_PIN=tang", `CLEVIS_CONFIG={"url":"http://10.0.2.100:5697", "adv":"assets/tang/adv.jwk"}`}}
+	assetGenerators["assets/luks2.clevis.tang.wireguard.img"] = assetGenerator{"generate_asset_luks.sh", []string{"OUTPUT=assets/luks2.clevis.tang.wireguard.img", "LUKS_VERSION=2", "LUKS_PASSWORD=1234", "LUKS_UUID=9a0c8a5b-5d1e-4c63-9f4e-1f7b2a3c4d5e", "FS_UUID=0b5e8c1d-2f6a-4e7b-8c9d-3a4b5c6d7e8f", "CLEVIS_PIN=tang", `CLEVIS_CONFIG={"url":"http://10.100.0.1:5697", "adv":"assets/tang/adv.jwk"}`}}
 	assetGenerators["assets/archlinux.ext4.raw"] = assetGenerator{"generate_asset_archlinux_ext4.sh", []string{"OUTPUT=assets/archlinux.ext4.raw"}}
 	assetGenerators["assets/archlinux.btrfs.raw"] = assetGenerator{"generate_asset_archlinux_btrfs.sh", []string{"OUTPUT=assets/archlinux.btrfs.raw", "LUKS_PASSWORD=hello"}}
 
@@ -631,6 +688,20 @@ func TestBooster(t *testing.T) {
 		activeNetIfaces: "52-54-00-12-34-53,52:54:00:12:34:56,52:54:00:12:34:57", // 52:54:00:12:34:56 is QEMU's NIC address
 		kernelArgs:      []string{"rd.luks.uuid=f2473f71-9a68-4b16-ae54-8f942b2daf50", "root=UUID=7acb3a9e-9b50-4aa2-9965-e41ae8467d8a"},
 	}))
+	t.Run("Wireguard", boosterTest(Opts{
+		disk:            "assets/luks2.clevis.tang.wireguard.img",
+		enableTangd:     true,
+		enableWireguard: true,
+		useDhcp:         true,
+		kernelArgs:      []string{"rd.luks.uuid=9a0c8a5b-5d1e-4c63-9f4e-1f7b2a3c4d5e", "root=UUID=0b5e8c1d-2f6a-4e7b-8c9d-3a4b5c6d7e8f"},
+	}))
+	t.Run("ActiveNetworkPredictableName", boosterTest(Opts{
+		disk:            "assets/luks2.clevis.tang.img",
+		enableTangd:     true,
+		useDhcp:         true,
+		activeNetIfaces: "wl*,enp0s*", // QEMU's NIC is at PCI slot 00:03.0
+		kernelArgs:      []string{"rd.luks.uuid=f2473f71-9a68-4b16-ae54-8f942b2daf50", "root=UUID=7acb3a9e-9b50-4aa2-9965-e41ae8467d8a"},
+	}))
 	t.Run("InactiveNetwork", boosterTest(Opts{
 		disk:            "assets/luks2.clevis.tang.img",
 		enableTangd:     true,
@@ -647,6 +718,80 @@ func TestBooster(t *testing.T) {
 		},
 	}))
 
+	t.Run("RootNotFound.Diagnostics", boosterTest(Opts{
+		compression:  "none",
+		disk:         "assets/ext4.img",
+		kernelArgs:   []string{"root=UUID=00000000-1111-2222-3333-444444444444"},
+		mountTimeout: 5,
+		forceKill:    true,
+		checkVmState: func(vm *vmtest.Qemu, t *testing.T) {
+			for _, s := range []string{
+				"Root filesystem is not found. Boot diagnostics:",
+				"root=UUID=00000000-1111-2222-3333-444444444444",
+				"LABEL=\"atestlabel12\", does not match root=UUID=00000000-1111-2222-3333-444444444444: UUID",
+				"Timeout waiting for root filesystem",
+			} {
+				if err := vm.ConsoleExpect(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+	}))
+
+	t.Run("RootNotFound.Retry", boosterTest(Opts{
+		compression:  "none",
+		disk:         "assets/ext4.img",
+		kernelArgs:   []string{"root=UUID=00000000-1111-2222-3333-444444444444", "booster.on_failure=retry", "panic=1"},
+		mountTimeout: 1,
+		forceKill:    true,
+		checkVmState: func(vm *vmtest.Qemu, t *testing.T) {
+			for _, s := range []string{
+				"retrying device discovery (1/3), waiting 2s for the root filesystem",
+				"retrying device discovery (3/3), waiting 8s for the root filesystem",
+				"Rebooting in 1 seconds",
+			} {
+				if err := vm.ConsoleExpect(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+	}))
+
+	t.Run("Watchdog", boosterTest(Opts{
+		compression: "none",
+		disk:        "assets/ext4.img",
+		kernelArgs:  []string{"root=UUID=5c92fc66-7315-408b-b652-176dc554d370"},
+		params:      []string{"-device", "i6300esb"}, // the default watchdog action is reset
+		watchdog:    30,
+		checkVmState: func(vm *vmtest.Qemu, t *testing.T) {
+			for _, s := range []string{
+				"watchdog /dev/watchdog is armed with 30s timeout",
+				"watchdog is handed over to the root filesystem init",
+				"Hello, booster!",
+			} {
+				if err := vm.ConsoleExpect(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+	}))
+	t.Run("Watchdog.Reset", boosterTest(Opts{
+		compression:  "none",
+		disk:         "assets/ext4.img",
+		kernelArgs:   []string{"root=UUID=00000000-1111-2222-3333-444444444444", "booster.watchdog=3"},
+		params:       []string{"-device", "i6300esb"},
+		mountTimeout: 60,
+		forceKill:    true,
+		checkVmState: func(vm *vmtest.Qemu, t *testing.T) {
+			// the boot stalls waiting for the root device and the watchdog resets the VM
+			for i := 0; i < 2; i++ {
+				if err := vm.ConsoleExpect("watchdog /dev/watchdog is armed with 3s timeout"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+	}))
+
 	t.Run("LUKS1.Clevis.Tpm2", boosterTest(Opts{
 		disk:       "assets/luks1.clevis.tpm2.img",
 		enableTpm2: true,
@@ -657,6 +802,25 @@ func TestBooster(t *testing.T) {
 		enableTpm2: true,
 		kernelArgs: []string{"rd.luks.uuid=3756ba2c-1505-4283-8f0b-b1d1bd7b844f", "root=UUID=c3cc0321-fba8-42c3-ad73-d13f8826d8d7"},
 	}))
+	t.Run("LUKS2.Clevis.Tpm2.Measure", boosterTest(Opts{
+		disk:       "assets/luks2.clevis.tpm2.img",
+		enableTpm2: true,
+		measurePCR: 9,
+		kernelArgs: []string{"rd.luks.uuid=3756ba2c-1505-4283-8f0b-b1d1bd7b844f", "root=UUID=c3cc0321-fba8-42c3-ad73-d13f8826d8d7"},
+		checkVmState: func(vm *vmtest.Qemu, t *testing.T) {
+			for _, s := range []string{
+				"measured phase 'enter-initrd' into PCR 9",
+				"measured config '/etc/booster.init.yaml' into PCR 9",
+				"measured cryptsetup 'luks-3756ba2c-1505-4283-8f0b-b1d1bd7b844f:3756ba2c-1505-4283-8f0b-b1d1bd7b844f' into PCR 9",
+				"measured phase 'leave-initrd' into PCR 9",
+				"Hello, booster!",
+			} {
+				if err := vm.ConsoleExpect(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+	}))
 
 	// boot Arch userspace (with systemd) against all installed linux packages
 	for pkg, ver := range kernelVersions {
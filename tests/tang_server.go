@@ -20,13 +20,18 @@ type TangServer struct {
 }
 
 func NewTangServer(keysDir string) (*TangServer, error) {
+	return NewTangServerAt(keysDir, ":0")
+}
+
+// NewTangServerAt starts a tang server that listens at the given address
+func NewTangServerAt(keysDir, addr string) (*TangServer, error) {
 	path, err := findTangdLocation()
 	if err != nil {
 		return nil, err
 	}
 
 	var l net.Listener
-	l, err = net.Listen("tcp", ":0")
+	l, err = net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	wireguardKeysDir    = "assets/wireguard"
+	wireguardPeerIfname = "wgbooster"
+	wireguardPeerAddr   = "10.100.0.1"
+	wireguardGuestAddr  = "10.100.0.2"
+	wireguardPort       = 51820
+)
+
+// wireguardKey returns base64 encoded private and public keys stored at assets/wireguard/$name.{key,pub}.
+// The keys are generated if they do not exist yet.
+func wireguardKey(name string) (string, string, error) {
+	keyFile := filepath.Join(wireguardKeysDir, name+".key")
+	pubFile := filepath.Join(wireguardKeysDir, name+".pub")
+
+	if !fileExists(keyFile) {
+		if err := os.MkdirAll(wireguardKeysDir, 0755); err != nil {
+			return "", "", err
+		}
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return "", "", err
+		}
+		// clamp the scalar the same way 'wg genkey' does
+		key[0] &= 248
+		key[31] = (key[31] & 127) | 64
+		pub, err := curve25519.X25519(key[:], curve25519.Basepoint)
+		if err != nil {
+			return "", "", err
+		}
+		if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key[:])+"\n"), 0600); err != nil {
+			return "", "", err
+		}
+		if err := os.WriteFile(pubFile, []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644); err != nil {
+			return "", "", err
+		}
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := os.ReadFile(pubFile)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(string(key)), strings.TrimSpace(string(pub)), nil
+}
+
+// WireguardPeer is a userspace WireGuard peer (wireguard-go) at the host side. The guest reaches it
+// at 10.0.2.2 which QEMU user network maps to the host's loopback.
+type WireguardPeer struct {
+	cmd *exec.Cmd
+}
+
+func NewWireguardPeer() (*WireguardPeer, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("creating a WireGuard interface requires root")
+	}
+	for _, tool := range []string{"wireguard-go", "wg", "ip"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, err
+		}
+	}
+
+	_, _, err := wireguardKey("server")
+	if err != nil {
+		return nil, err
+	}
+	_, guestPub, err := wireguardKey("guest")
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("wireguard-go", "-f", wireguardPeerIfname)
+	if testing.Verbose() {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &WireguardPeer{cmd: cmd}
+
+	if err := waitForFile("/sys/class/net/"+wireguardPeerIfname, 5*time.Second); err != nil {
+		p.Stop()
+		return nil, err
+	}
+
+	setup := [][]string{
+		{"wg", "set", wireguardPeerIfname, "private-key", filepath.Join(wireguardKeysDir, "server.key"), "listen-port", fmt.Sprint(wireguardPort),
+			"peer", guestPub, "allowed-ips", wireguardGuestAddr + "/32"},
+		{"ip", "address", "add", wireguardPeerAddr + "/24", "dev", wireguardPeerIfname},
+		{"ip", "link", "set", wireguardPeerIfname, "up"},
+	}
+	for _, args := range setup {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			p.Stop()
+			return nil, fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	return p, nil
+}
+
+// Stop terminates wireguard-go, the interface is removed together with the process
+func (p *WireguardPeer) Stop() {
+	_ = p.cmd.Process.Kill()
+	_ = p.cmd.Wait()
+}